@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// Claim outcomes, the same in sync and async mode
+const (
+	outcomeWon            = "won"
+	outcomeNoStock        = "no_stock"
+	outcomeAlreadyClaimed = "already_claimed"
+	outcomeError          = "error"
+)
+
+// client talks to the coupon API over HTTP like any other client would
+type client struct {
+	baseURL string
+	http    *http.Client
+	// How often a pending async claim ticket is polled
+	pollInterval time.Duration
+}
+
+func newClient(baseURL string, conns int, timeout time.Duration) *client {
+	return &client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http: &http.Client{
+			Timeout: timeout,
+			// Enough idle connections for every concurrent claim, the default of 2 per host
+			// would have most of them wait for a new TCP connection
+			Transport: &http.Transport{
+				MaxIdleConns:        conns,
+				MaxIdleConnsPerHost: conns,
+			},
+		},
+		pollInterval: 20 * time.Millisecond,
+	}
+}
+
+type apiError struct {
+	Status int
+	Body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, strings.TrimSpace(e.Body))
+}
+
+// do sends body as JSON (unless it's already a reader) and decodes a 2xx answer into out
+func (c *client) do(ctx context.Context, method string, path string, contentType string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, &apiError{Status: resp.StatusCode, Body: string(data)}
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %w", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// waitHealthy polls GET /api/health until it answers 200 or ctx is done
+func (c *client) waitHealthy(ctx context.Context) error {
+	for {
+		_, err := c.do(ctx, http.MethodGet, "/api/health", "", nil, nil)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("service not healthy: %w", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// seedUsers creates the users with one bulk import, which reports every row that failed
+func (c *client) seedUsers(ctx context.Context, userIDs []string) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, id := range userIDs {
+		enc.Encode(map[string]string{"user_id": id, "name": "loadtest " + id})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/users/bulk", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return &apiError{Status: resp.StatusCode, Body: string(data)}
+	}
+
+	// One line per failed row, then the totals
+	var summary struct {
+		Inserted int    `json:"inserted"`
+		Failed   int    `json:"failed"`
+		Error    string `json:"error"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		summary.Error = ""
+		if err := dec.Decode(&summary); err != nil {
+			return fmt.Errorf("user import: %w", err)
+		}
+	}
+	if summary.Error != "" || summary.Failed > 0 || summary.Inserted != len(userIDs) {
+		return fmt.Errorf("user import: inserted %d of %d users, %d failed %s", summary.Inserted, len(userIDs), summary.Failed, summary.Error)
+	}
+	return nil
+}
+
+func (c *client) createCoupon(ctx context.Context, name string, amount int, shards int) error {
+	body := map[string]interface{}{"name": name, "amount": amount}
+	if shards > 1 {
+		body["shards"] = shards
+	}
+	_, err := c.do(ctx, http.MethodPost, "/api/coupons", "application/json", body, nil)
+	return err
+}
+
+// claim claims the coupon and returns the outcome. In async mode it polls the ticket until the claim is done,
+// so the time it takes covers the whole claim either way.
+func (c *client) claim(ctx context.Context, userID string, couponName string) (string, error) {
+	var ticket model.ClaimTicket
+	status, err := c.do(ctx, http.MethodPost, "/api/coupons/claim", "application/json",
+		map[string]string{"user_id": userID, "coupon_name": couponName}, &ticket)
+	switch {
+	case err == nil && status == http.StatusOK:
+		return outcomeWon, nil
+	case err == nil && status == http.StatusAccepted && ticket.ID != "":
+		return c.waitTicket(ctx, ticket.ID)
+	case status == http.StatusBadRequest && strings.Contains(err.Error(), "no stock"):
+		return outcomeNoStock, nil
+	case status == http.StatusConflict:
+		return outcomeAlreadyClaimed, nil
+	case err == nil:
+		return outcomeError, fmt.Errorf("unexpected status %d", status)
+	}
+	return outcomeError, err
+}
+
+func (c *client) waitTicket(ctx context.Context, id string) (string, error) {
+	for {
+		var ticket model.ClaimTicket
+		if _, err := c.do(ctx, http.MethodGet, "/api/claims/tickets/"+url.PathEscape(id), "", nil, &ticket); err != nil {
+			return outcomeError, err
+		}
+		switch ticket.Status {
+		case model.TicketStatusWon:
+			return outcomeWon, nil
+		case model.TicketStatusNoStock:
+			return outcomeNoStock, nil
+		case model.TicketStatusAlreadyClaimed:
+			return outcomeAlreadyClaimed, nil
+		case model.TicketStatusFailed:
+			return outcomeError, fmt.Errorf("claim ticket %s failed: %s", id, ticket.Error)
+		case model.TicketStatusPending:
+		default:
+			return outcomeError, fmt.Errorf("claim ticket %s: unexpected status %q", id, ticket.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return outcomeError, ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+type couponDetails struct {
+	Name            string   `json:"name"`
+	Amount          int      `json:"amount"`
+	RemainingAmount int      `json:"remaining_amount"`
+	ClaimedBy       []string `json:"claimed_by"`
+	NextCursor      string   `json:"next_cursor"`
+}
+
+// couponDetails fetches the coupon with every page of claimed_by
+func (c *client) couponDetails(ctx context.Context, name string) (*couponDetails, error) {
+	var details *couponDetails
+	cursor := ""
+	for {
+		path := "/api/coupons/" + url.PathEscape(name) + "?limit=1000"
+		if cursor != "" {
+			path += "&after=" + url.QueryEscape(cursor)
+		}
+		var page couponDetails
+		if _, err := c.do(ctx, http.MethodGet, path, "", nil, &page); err != nil {
+			return nil, err
+		}
+		if details == nil {
+			details = &page
+		} else {
+			details.ClaimedBy = append(details.ClaimedBy, page.ClaimedBy...)
+		}
+		if page.NextCursor == "" {
+			return details, nil
+		}
+		cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,107 @@
+// Command loadtest fires concurrent claims at a running coupon service and checks that none of them
+// broke the stock: the flash sale (more users than stock) and double dip (one user, many claims at once)
+// scenarios. It exits with 1 when any check fails, so it can gate a build.
+//
+//	go run ./cmd/loadtest -url http://localhost:8080 -users 200 -stock 20 -rounds 5
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	baseURL := fs.String("url", "http://localhost:8080", "base URL of the coupon service")
+	scenarios := fs.String("scenarios", "flash-sale,double-dip", "comma separated scenarios to run: flash-sale, double-dip")
+	rounds := fs.Int("rounds", 1, "runs of each scenario, each on a fresh coupon")
+	users := fs.Int("users", 50, "flash-sale: users claiming at once")
+	stock := fs.Int("stock", 5, "flash-sale: stock of the coupon")
+	shards := fs.Int("shards", 1, "flash-sale: stock shards of the coupon")
+	attempts := fs.Int("attempts", 10, "double-dip: claims the user sends at once")
+	dipStock := fs.Int("dip-stock", 10, "double-dip: stock of the coupon")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each request")
+	wait := fs.Duration("wait", 0, "wait up to this long for GET /api/health to pass before starting")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	var selected []scenario
+	for _, name := range strings.Split(*scenarios, ",") {
+		switch strings.TrimSpace(name) {
+		case "flash-sale":
+			selected = append(selected, flashSale(*users, *stock, *shards))
+		case "double-dip":
+			selected = append(selected, doubleDip(*attempts, *dipStock))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown scenario %q\n", name)
+			return 2
+		}
+	}
+	if *rounds < 1 || *users < 1 || *stock < 1 || *shards < 1 || *attempts < 1 || *dipStock < 1 {
+		fmt.Fprintln(os.Stderr, "-rounds, -users, -stock, -shards, -attempts and -dip-stock must be at least 1")
+		return 2
+	}
+
+	c := newClient(*baseURL, max(*users, *attempts), *timeout)
+	ctx := context.Background()
+	if *wait > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, *wait)
+		err := c.waitHealthy(waitCtx)
+		cancel()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	failed := 0
+	for round := 1; round <= *rounds; round++ {
+		for _, s := range selected {
+			// A fresh coupon and users every run, so runs against the same database don't see each other
+			runID := newRunID()
+			result, err := s.run(ctx, c, runID)
+			if err != nil {
+				log.Printf("%s round %d: %v", s.name, round, err)
+				failed++
+				continue
+			}
+			if *rounds > 1 {
+				fmt.Printf("round %d: ", round)
+			}
+			result.report()
+			if len(result.failures) > 0 {
+				failed++
+			}
+		}
+	}
+
+	total := *rounds * len(selected)
+	if failed > 0 {
+		fmt.Printf("FAIL: %d of %d runs failed\n", failed, total)
+		return 1
+	}
+	fmt.Printf("ok: %d runs passed\n", total)
+	return 0
+}
+
+func newRunID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scenario seeds its own users and coupon, fires the claims, then checks the end state
+type scenario struct {
+	name string
+	// Stock of the coupon and how it's sharded
+	stock  int
+	shards int
+	// The user sending each claim, the same user may send many
+	users func(runID string) []string
+	check func(s *scenarioResult) []string
+}
+
+type claimResult struct {
+	userID   string
+	outcome  string
+	err      error
+	duration time.Duration
+}
+
+type scenarioResult struct {
+	name       string
+	couponName string
+	stock      int
+	claims     []claimResult
+	elapsed    time.Duration
+	details    *couponDetails
+	// Checks that failed, empty when the run passed
+	failures []string
+}
+
+func (r *scenarioResult) count(outcome string) int {
+	n := 0
+	for _, c := range r.claims {
+		if c.outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// winners are the users whose claim went through
+func (r *scenarioResult) winners() []string {
+	var ids []string
+	for _, c := range r.claims {
+		if c.outcome == outcomeWon {
+			ids = append(ids, c.userID)
+		}
+	}
+	return ids
+}
+
+// flashSale has many users go for a coupon with less stock than users, exactly stock of them may win
+func flashSale(users int, stock int, shards int) scenario {
+	return scenario{
+		name:   "flash-sale",
+		stock:  stock,
+		shards: shards,
+		users: func(runID string) []string {
+			ids := make([]string, users)
+			for i := range ids {
+				ids[i] = fmt.Sprintf("flash_%s_%d", runID, i)
+			}
+			return ids
+		},
+		check: func(r *scenarioResult) []string {
+			won := min(users, stock)
+			return checkClaims(r, won, map[string]int{
+				outcomeWon:     won,
+				outcomeNoStock: users - won,
+			})
+		},
+	}
+}
+
+// doubleDip has one user claim the same coupon many times at once, exactly one claim may go through
+func doubleDip(attempts int, stock int) scenario {
+	return scenario{
+		name:   "double-dip",
+		stock:  stock,
+		shards: 1,
+		users: func(runID string) []string {
+			ids := make([]string, attempts)
+			for i := range ids {
+				ids[i] = "dip_" + runID
+			}
+			return ids
+		},
+		check: func(r *scenarioResult) []string {
+			return checkClaims(r, 1, map[string]int{
+				outcomeWon:            1,
+				outcomeAlreadyClaimed: attempts - 1,
+			})
+		},
+	}
+}
+
+// checkClaims checks the outcome counts, then that the stored coupon agrees with them:
+// stock left, claimed_by holding exactly the winners, and nobody in it twice
+func checkClaims(r *scenarioResult, won int, outcomes map[string]int) []string {
+	var failures []string
+	for _, outcome := range []string{outcomeWon, outcomeNoStock, outcomeAlreadyClaimed, outcomeError} {
+		if got, want := r.count(outcome), outcomes[outcome]; got != want {
+			failures = append(failures, fmt.Sprintf("%d claims %s, want %d", got, outcome, want))
+		}
+	}
+
+	d := r.details
+	if d.RemainingAmount != r.stock-won {
+		failures = append(failures, fmt.Sprintf("remaining_amount is %d, want %d", d.RemainingAmount, r.stock-won))
+	}
+	if len(d.ClaimedBy) != won {
+		failures = append(failures, fmt.Sprintf("claimed_by has %d ids, want %d", len(d.ClaimedBy), won))
+	}
+
+	seen := map[string]bool{}
+	for _, id := range d.ClaimedBy {
+		if seen[id] {
+			failures = append(failures, fmt.Sprintf("%s is in claimed_by twice", id))
+		}
+		seen[id] = true
+	}
+	for _, id := range r.winners() {
+		if !seen[id] {
+			failures = append(failures, fmt.Sprintf("%s got a successful claim but isn't in claimed_by", id))
+		}
+		delete(seen, id)
+	}
+	for id := range seen {
+		failures = append(failures, fmt.Sprintf("%s is in claimed_by without a successful claim", id))
+	}
+	return failures
+}
+
+// run seeds the scenario, releases every claim at once and checks the outcome
+func (s scenario) run(ctx context.Context, c *client, runID string) (*scenarioResult, error) {
+	userIDs := s.users(runID)
+	result := &scenarioResult{
+		name:       s.name,
+		couponName: fmt.Sprintf("LOADTEST_%s_%s", s.name, runID),
+		stock:      s.stock,
+		claims:     make([]claimResult, len(userIDs)),
+	}
+
+	unique := map[string]bool{}
+	var seed []string
+	for _, id := range userIDs {
+		if !unique[id] {
+			unique[id] = true
+			seed = append(seed, id)
+		}
+	}
+	if err := c.seedUsers(ctx, seed); err != nil {
+		return nil, fmt.Errorf("seed users: %w", err)
+	}
+	if err := c.createCoupon(ctx, result.couponName, s.stock, s.shards); err != nil {
+		return nil, fmt.Errorf("create coupon: %w", err)
+	}
+
+	// Every claim waits at the gate, so they hit the server together instead of trickling in
+	gate := make(chan struct{})
+	var ready, done sync.WaitGroup
+	for i, userID := range userIDs {
+		ready.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			ready.Done()
+			<-gate
+			start := time.Now()
+			outcome, err := c.claim(ctx, userID, result.couponName)
+			result.claims[i] = claimResult{userID: userID, outcome: outcome, err: err, duration: time.Since(start)}
+		}()
+	}
+	ready.Wait()
+	start := time.Now()
+	close(gate)
+	done.Wait()
+	result.elapsed = time.Since(start)
+
+	details, err := c.couponDetails(ctx, result.couponName)
+	if err != nil {
+		return nil, fmt.Errorf("coupon details: %w", err)
+	}
+	result.details = details
+	result.failures = s.check(result)
+	return result, nil
+}
+
+// percentile is the nearest-rank percentile p (0-100) of sorted
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.999999) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+func (r *scenarioResult) report() {
+	durations := make([]time.Duration, len(r.claims))
+	errs := map[string]int{}
+	for i, c := range r.claims {
+		durations[i] = c.duration
+		if c.err != nil {
+			errs[c.err.Error()]++
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	rate := float64(len(r.claims)) / r.elapsed.Seconds()
+	fmt.Printf("%s (coupon %s)\n", r.name, r.couponName)
+	fmt.Printf("  claims:    %d in %v (%.0f/s)\n", len(r.claims), r.elapsed.Round(time.Millisecond), rate)
+	fmt.Printf("  outcomes:  %d won, %d no stock, %d already claimed, %d errors\n",
+		r.count(outcomeWon), r.count(outcomeNoStock), r.count(outcomeAlreadyClaimed), r.count(outcomeError))
+	fmt.Printf("  latency:   p50 %v  p90 %v  p99 %v  max %v\n",
+		round(percentile(durations, 50)), round(percentile(durations, 90)),
+		round(percentile(durations, 99)), round(percentile(durations, 100)))
+	fmt.Printf("  coupon:    %d of %d left, %d in claimed_by\n", r.details.RemainingAmount, r.details.Amount, len(r.details.ClaimedBy))
+	for msg, n := range errs {
+		fmt.Printf("  error:     %dx %s\n", n, msg)
+	}
+
+	if len(r.failures) == 0 {
+		fmt.Println("  PASS")
+		return
+	}
+	for _, f := range r.failures {
+		fmt.Printf("  FAIL: %s\n", f)
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/api"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/controller"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/redis"
+)
+
+// app is the application container. It builds every dependency once from the config,
+// and owns the database and redis connections.
+type app struct {
+	db    *gorm.DB
+	redis *goredis.Client
+	deps  api.Dependencies
+}
+
+func newApp(cfg *config.Config) *app {
+	// Connect to database, and bring the schema up to date
+	gormDB := db.ConnectDatabase(cfg.Database)
+	db.MigrateDatabase(gormDB, cfg.Database)
+
+	// Connect to Redis
+	redisClient := redis.ConnectRedis(cfg.Redis)
+
+	a := &app{
+		db:    gormDB,
+		redis: redisClient,
+	}
+	a.deps.HealthChecks = map[string]controller.DependencyCheck{
+		"database": func(ctx context.Context) error { return db.CheckHealth(ctx, gormDB) },
+		"redis":    func(ctx context.Context) error { return redis.CheckHealth(ctx, redisClient) },
+	}
+
+	// Repositories
+	a.deps.Locks = repository.NewRedisLocker(redisClient, cfg.Claims.LockTTL.D(), cfg.Claims.LockRetryInterval.D())
+	userRepo := repository.NewUserRepository(gormDB)
+	couponRepo := repository.NewCouponRepository(gormDB, a.deps.Locks)
+	webhookRepo := repository.NewWebhookRepository(gormDB)
+	stockFeed := repository.NewStockFeedRepository(redisClient)
+
+	// Services
+	a.deps.Users = service.NewUserService(userRepo)
+
+	webhookService := service.NewWebhookService(webhookRepo, cfg.Webhooks.Timeout.D(),
+		cfg.Webhooks.MaxAttempts, cfg.Webhooks.BaseBackoff.D(), cfg.Webhooks.MaxBackoff.D())
+	a.deps.Webhooks = webhookService
+	a.worker(func(ctx context.Context) { webhookService.RunDispatcher(ctx, cfg.Webhooks.DispatchInterval.D()) })
+
+	// Live stock updates, published by the outbox relay and fanned out to every instance through redis pub/sub
+	stockPublisher := service.NewStockPublisher(stockFeed, cfg.Stock.PublishInterval.D())
+	a.worker(stockPublisher.Run)
+	a.deps.StockHub = service.NewStockHub(stockFeed)
+	// The hub stops when the server closes it on shutdown
+	a.worker(func(context.Context) { a.deps.StockHub.Run() })
+
+	sinks := append(outboxSinks(cfg.Outbox, webhookService, redisClient), stockPublisher)
+
+	var couponOpts []service.CouponServiceOption
+	// Coupon details cache, invalidated by the outbox events and by the coupon service's own changes.
+	// CACHE_TTL=0 turns it off.
+	if ttl := cfg.Cache.TTL.D(); ttl > 0 {
+		detailsCache := service.NewDetailsCache(repository.NewDetailsCacheRepository(redisClient),
+			ttl, cfg.Cache.StaleWhileRevalidate.D(), cfg.Cache.LocalTTL.D())
+		couponOpts = append(couponOpts, service.WithDetailsCache(detailsCache))
+		sinks = append(sinks, detailsCache)
+		a.worker(detailsCache.Run)
+	}
+
+	outboxRelay := service.NewOutboxRelay(repository.NewOutboxRepository(gormDB), sinks...)
+	a.worker(func(ctx context.Context) { outboxRelay.Run(ctx, cfg.Outbox.RelayInterval.D()) })
+	// Published events are only kept for a while, OUTBOX_RETENTION=0 keeps them forever
+	if retention := cfg.Outbox.Retention.D(); retention > 0 {
+		a.worker(func(ctx context.Context) { outboxRelay.RunRetention(ctx, cfg.Outbox.RetentionInterval.D(), retention) })
+	}
+
+	// Group commit is opt-in, e.g. CLAIM_BATCH_WINDOW=5ms
+	if window := cfg.Claims.BatchWindow.D(); window > 0 {
+		couponOpts = append(couponOpts, service.WithBatching(window, cfg.Claims.BatchSize, cfg.Claims.BatchTimeout.D()))
+		log.Printf("Claim batching enabled (window=%s, size=%d)", window, cfg.Claims.BatchSize)
+	}
+	// Async claims are opt-in, e.g. CLAIM_ASYNC_WORKERS=16
+	if workers := cfg.Claims.AsyncWorkers; workers > 0 {
+		couponOpts = append(couponOpts, service.WithAsyncClaims(
+			repository.NewTicketRepository(redisClient, cfg.Claims.TicketTTL.D()),
+			cfg.Claims.AsyncPollTimeout.D(), cfg.Claims.AsyncClaimTimeout.D()))
+		log.Printf("Async claims enabled (workers=%d)", workers)
+	}
+	a.deps.Coupons = service.NewCouponService(couponRepo, couponOpts...)
+	if workers := cfg.Claims.AsyncWorkers; workers > 0 {
+		a.worker(func(ctx context.Context) { a.deps.Coupons.RunClaimWorkers(ctx, workers) })
+	}
+
+	a.deps.Reconciler = service.NewStockReconciler(couponRepo)
+	// Scheduled stock reconciliation, RECONCILE_INTERVAL=0 turns it off
+	if interval := cfg.Reconcile.Interval.D(); interval > 0 {
+		a.worker(func(ctx context.Context) { a.deps.Reconciler.Run(ctx, interval, cfg.Reconcile.Repair) })
+	}
+
+	return a
+}
+
+func (a *app) worker(run func(ctx context.Context)) {
+	a.deps.Workers = append(a.deps.Workers, run)
+}
+
+// Close closes the connections, once the server stopped using them
+func (a *app) Close() {
+	if err := a.redis.Close(); err != nil {
+		log.Printf("Failed to close redis: %v", err)
+	}
+	if err := db.Close(a.db); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+}
+
+// outboxSinks builds the outbox relay sinks out of cfg.Sinks, any of webhook, redis and log.
+// The log sink appends to cfg.LogFile.
+func outboxSinks(cfg config.OutboxConfig, webhooks *service.WebhookService, redisClient *goredis.Client) []service.EventPublisher {
+	var sinks []service.EventPublisher
+	for _, name := range cfg.Sinks {
+		switch name {
+		case "webhook":
+			sinks = append(sinks, webhooks)
+		case "redis":
+			sinks = append(sinks, repository.NewEventStreamRepository(redisClient))
+		case "log":
+			f, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				log.Fatal("Failed to open outbox log file: ", err)
+			}
+			sinks = append(sinks, service.NewLogSink(f))
+		default:
+			log.Fatalf("Unknown outbox sink %q", name)
+		}
+	}
+
+	return sinks
+}
@@ -1,27 +1,52 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/api"
-	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
-	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/redis"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
 )
 
 func main() {
+	// main [flags] migrate up|down|status, see migrate.go
+	// main [flags] reconcile [-repair], see reconcile.go
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) > 0 && args[0] == "migrate" {
+		os.Exit(runMigrate(cfg, args[1:]))
+	}
+	if len(args) > 0 && args[0] == "reconcile" {
+		os.Exit(runReconcile(cfg, args[1:]))
+	}
+
 	log.Println("Server is starting...")
-	// Connect to database
-	db.ConnectDatabase()
+	a := newApp(cfg)
+	defer a.Close()
 
-	// Connect to Redis
-	redis.ConnectRedis()
+	// Setup server
+	server := api.NewServer(cfg, a.deps)
 
-	// Setup router
-	r := api.SetupRouter()
+	// SIGTERM (docker stop, rolling deploys) and Ctrl-C start a graceful shutdown.
+	// A second signal kills the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
 	// Run server
-	log.Println("Server starting on :8080")
-	if err := r.Run(":8080"); err != nil {
+	if err := server.Run(ctx); err != nil {
 		log.Fatal("Failed to start server: ", err)
 	}
 }
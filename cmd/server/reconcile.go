@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/redis"
+)
+
+// runReconcile runs the reconcile subcommand and returns the exit code:
+// 0 when every coupon's stock adds up (after repair, with -repair), 1 otherwise
+func runReconcile(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: main [flags] reconcile [-repair]")
+		flags.PrintDefaults()
+	}
+	repair := flags.Bool("repair", false, "fix the issues found, under the coupon lock")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	gormDB := db.ConnectDatabase(cfg.Database)
+	defer db.Close(gormDB)
+	// Repairs take the claim lock, like the server does
+	redisClient := redis.ConnectRedis(cfg.Redis)
+	defer redisClient.Close()
+
+	locks := repository.NewRedisLocker(redisClient, cfg.Claims.LockTTL.D(), cfg.Claims.LockRetryInterval.D())
+	reconciler := service.NewStockReconciler(repository.NewCouponRepository(gormDB, locks))
+	report, err := reconciler.Reconcile(context.Background(), *repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reconcile:", err)
+		return 1
+	}
+
+	if len(report.Issues) == 0 {
+		fmt.Println("stock of every coupon adds up")
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COUPON\tAMOUNT\tREMAINING\tEXPECTED\tCLAIMS\tDUPLICATES\tPROBLEMS\tREPAIRED")
+	for _, issue := range report.Issues {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%t\n", issue.CouponName, issue.Amount, issue.Remaining,
+			issue.Expected, issue.Claims, issue.DuplicateClaims, strings.Join(issue.Problems, ","), issue.Repaired)
+	}
+	w.Flush()
+
+	if n := report.Unresolved(); n > 0 {
+		fmt.Printf("%d coupon(s) still need attention\n", n)
+		return 1
+	}
+	return 0
+}
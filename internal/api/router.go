@@ -1,33 +1,68 @@
 package api
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/controller"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
-	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
-	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/redis"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
 )
 
-func SetupRouter() *gin.Engine {
+// Dependencies are what the server is built from, wired up by the application container in main
+type Dependencies struct {
+	Users    service.UserService
+	Coupons  service.CouponService
+	Webhooks *service.WebhookService
+	StockHub *service.StockHub
+	// Stock checks of POST /api/reconcile
+	Reconciler *service.StockReconciler
+	// Claim locks still held by requests the drain deadline cut off are released on shutdown
+	Locks repository.Locker
+	// Background work, run until shutdown. Each one returns once its ctx is done.
+	Workers []func(ctx context.Context)
+	// Pinged by GET /api/health, by name
+	HealthChecks map[string]controller.DependencyCheck
+}
+
+// NewServer sets up the routes and starts the background workers, which run until Run shuts down
+func NewServer(cfg *config.Config, deps Dependencies) *Server {
 	r := gin.Default()
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	s := &Server{
+		config:      cfg,
+		locks:       deps.Locks,
+		stopWorkers: stopWorkers,
+	}
+	for _, worker := range deps.Workers {
+		s.goWorker(func() { worker(workerCtx) })
+	}
 
-	// Initialize dependencies
-	userRepo := repository.NewUserRepository(db.DB)
-	userService := service.NewUserService(userRepo)
-	userController := controller.NewUserController(userService)
-	couponRepo := repository.NewCouponRepository(db.DB, redis.Client)
-	couponService := service.NewCouponService(couponRepo)
-	couponController := controller.NewCouponController(couponService)
-	devController := controller.NewDevController()
+	userController := controller.NewUserController(deps.Users)
+	couponController := controller.NewCouponController(deps.Coupons)
+	stockStreamController := controller.NewStockStreamController(deps.Coupons, deps.StockHub)
+	webhookController := controller.NewWebhookController(deps.Webhooks)
+	reconcileController := controller.NewReconcileController(deps.Reconciler)
+	devController := controller.NewDevController(cfg, deps.HealthChecks)
+	s.health = devController
 
 	// Routes
 	v1 := r.Group("/api")
 	{
 		// Users
 		v1.POST("/users", userController.CreateUser)
+		v1.POST("/users/bulk", userController.BulkCreateUsers)
 		v1.GET("/users", userController.GetUsers)
 		v1.GET("/users/:id", userController.GetUser)
+		v1.PUT("/users/:id", userController.UpsertUser)
+		v1.PATCH("/users/:id", userController.UpdateUser)
+		v1.DELETE("/users/:id", userController.DeleteUser)
+		// gin wants the same param name as above, :id is the external user_id here
+		v1.GET("/users/:id/coupons", couponController.GetUserCoupons)
 
 		// Coupons
 		v1.POST("/coupons", couponController.CreateCoupon)
@@ -35,10 +70,53 @@ func SetupRouter() *gin.Engine {
 		// not sure which one is preferred based on the requirements, so i supported both
 		v1.GET("/coupons", couponController.GetCoupon)
 		v1.GET("/coupons/:name", couponController.GetCoupon)
+		v1.PATCH("/coupons/:name", couponController.UpdateCoupon)
+		v1.DELETE("/coupons/:name", couponController.DeleteCoupon)
+		v1.POST("/coupons/:name/archive", couponController.ArchiveCoupon)
+		v1.POST("/coupons/:name/unarchive", couponController.UnarchiveCoupon)
+		v1.GET("/coupons/:name/claims", couponController.GetClaims)
+		v1.GET("/coupons/:name/stream", stockStreamController.StreamCoupon)
+		v1.POST("/coupons/:name/draw", couponController.DrawLottery)
+		v1.GET("/coupons/:name/draw", couponController.GetDraw)
+
+		// Coupon templates
+		v1.POST("/coupon-templates", couponController.CreateTemplate)
+		v1.GET("/coupon-templates", couponController.ListTemplates)
+		v1.GET("/coupon-templates/:name", couponController.GetTemplate)
+		v1.DELETE("/coupon-templates/:name", couponController.DeleteTemplate)
+		v1.POST("/coupon-templates/:name/coupons", couponController.CreateCouponsFromTemplate)
+
+		// Claim tickets (async mode)
+		v1.GET("/claims/tickets/:id", couponController.GetClaimTicket)
+
+		// Claims export
+		v1.GET("/claims/export", couponController.ExportClaims)
+
+		// Webhooks
+		v1.POST("/webhooks", webhookController.CreateWebhook)
+		v1.GET("/webhooks", webhookController.GetWebhooks)
+		v1.DELETE("/webhooks/:id", webhookController.DeleteWebhook)
+		v1.GET("/webhooks/:id/deliveries", webhookController.GetDeliveries)
+		v1.POST("/webhooks/deliveries/:id/redeliver", webhookController.Redeliver)
+
+		// Stock reconciliation
+		v1.POST("/reconcile", reconcileController.Reconcile)
 
 		// DEV
 		v1.GET("/health", devController.HealthCheck)
+		v1.GET("/config", devController.GetConfig)
+	}
+
+	s.http = &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: r,
 	}
+	// Streams never end on their own, closing the hub ends them so they don't hold up the drain
+	s.http.RegisterOnShutdown(func() {
+		if err := deps.StockHub.Close(); err != nil {
+			log.Printf("Failed to close stock hub: %v", err)
+		}
+	})
 
-	return r
+	return s
 }
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/controller"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
+)
+
+// Server is the HTTP server together with the background workers it started
+type Server struct {
+	config *config.Config
+	http   *http.Server
+	health *controller.DevController
+	locks  repository.Locker
+
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+}
+
+func (s *Server) goWorker(run func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		run()
+	}()
+}
+
+// Run serves until ctx is done, then shuts down gracefully:
+//  1. the health check turns unhealthy, and the server keeps taking requests for the drain delay
+//     so load balancers have time to notice
+//  2. the listener closes and in-flight requests (claims included) get until the shutdown timeout to finish
+//  3. the background workers stop, the ones in the middle of a claim finish it first
+//  4. claim locks still held by requests the deadline cut off are released
+//
+// Closing the database and redis pools is left to the caller.
+func (s *Server) Run(ctx context.Context) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Server starting on " + s.http.Addr)
+		serveErr <- s.http.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		s.stopWorkers()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining for %s", s.config.Server.DrainDelay.D())
+	s.health.SetDraining()
+	time.Sleep(s.config.Server.DrainDelay.D())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.Server.ShutdownTimeout.D())
+	defer cancel()
+
+	if err := s.http.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still running at the shutdown deadline, closing their connections: %v", err)
+		s.http.Close()
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server error: %v", err)
+	}
+
+	s.stopWorkers()
+	stopped := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Println("Background workers still running at the shutdown deadline")
+	}
+
+	releaseCtx, cancelRelease := context.WithTimeout(context.Background(), s.config.Server.LockReleaseTimeout.D())
+	defer cancelRelease()
+	if n := s.locks.ReleaseAll(releaseCtx); n > 0 {
+		log.Printf("Released %d claim locks left by cut off requests", n)
+	}
+
+	log.Println("Server stopped")
+	return nil
+}
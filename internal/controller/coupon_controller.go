@@ -1,25 +1,43 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
 )
 
 type CouponController struct {
-	service *service.CouponService
+	service service.CouponService
 }
 
-func NewCouponController(service *service.CouponService) *CouponController {
+func NewCouponController(service service.CouponService) *CouponController {
 	return &CouponController{
 		service: service,
 	}
 }
 
 type CreateCouponRequest struct {
-	Name   string `json:"name" binding:"required"`
-	Amount int    `json:"amount" binding:"required,min=1"`
+	Name          string     `json:"name" binding:"required"`
+	Amount        int        `json:"amount" binding:"required,min=1"`
+	Mode          string     `json:"mode" binding:"omitempty,oneof=fcfs lottery"`
+	EntryDeadline *time.Time `json:"entry_deadline"`
+	// Split stock across this many counters, each with its own lock. For very hot fcfs coupons.
+	Shards int `json:"shards" binding:"omitempty,min=1,max=256"`
+	// Optional claim window
+	StartsAt  *time.Time `json:"starts_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Optional, percent (1-100) or fixed
+	DiscountType  string                 `json:"discount_type" binding:"omitempty,oneof=percent fixed"`
+	DiscountValue int                    `json:"discount_value" binding:"min=0"`
+	Rules         map[string]interface{} `json:"rules"`
 }
 
 type ClaimCouponRequest struct {
@@ -27,6 +45,20 @@ type ClaimCouponRequest struct {
 	CouponName string `json:"coupon_name" binding:"required"`
 }
 
+// UpdateCouponRequest is a partial update, omitted fields are left as they are
+type UpdateCouponRequest struct {
+	Name          *string    `json:"name" binding:"omitempty,min=1"`
+	Amount        *int       `json:"amount" binding:"omitempty,min=1"`
+	StartsAt      *time.Time `json:"starts_at"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	EntryDeadline *time.Time `json:"entry_deadline"`
+}
+
+type DrawLotteryRequest struct {
+	// Optional, a random seed is generated when omitted
+	Seed *int64 `json:"seed"`
+}
+
 type CouponDetailsResponse struct {
 	Name            string   `json:"name"`
 	Amount          int      `json:"amount"`
@@ -47,14 +79,26 @@ func (c *CouponController) CreateCoupon(ctx *gin.Context) {
 	}
 
 	coupon, err := c.service.CreateCoupon(ctx.Request.Context(), &service.CreateCouponRequest{
-		Name:   req.Name,
-		Amount: req.Amount,
+		Name:          req.Name,
+		Amount:        req.Amount,
+		Mode:          req.Mode,
+		EntryDeadline: req.EntryDeadline,
+		Shards:        req.Shards,
+		StartsAt:      req.StartsAt,
+		ExpiresAt:     req.ExpiresAt,
+		DiscountType:  req.DiscountType,
+		DiscountValue: req.DiscountValue,
+		Rules:         req.Rules,
 	})
 	if err != nil {
 		if err == service.ErrCouponAlreadyExists {
 			ctx.JSON(http.StatusConflict, ErrorResponse{Error: "coupon already exists"})
 			return
 		}
+		if err == service.ErrShardedLottery || err == service.ErrInvalidWindow || err == service.ErrInvalidDiscount {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
@@ -63,6 +107,7 @@ func (c *CouponController) CreateCoupon(ctx *gin.Context) {
 }
 
 // ClaimCoupon - POST /api/coupons/claim
+// Lottery coupons only record an entry here, and answer 202 instead of 200
 func (c *CouponController) CreateCouponClaim(ctx *gin.Context) {
 	var req ClaimCouponRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
@@ -70,7 +115,21 @@ func (c *CouponController) CreateCouponClaim(ctx *gin.Context) {
 		return
 	}
 
-	err := c.service.ClaimCoupon(ctx.Request.Context(), &service.ClaimCouponRequest{
+	// Async mode, answer with a ticket and let the workers do the claim
+	if c.service.AsyncClaims() {
+		ticket, err := c.service.SubmitClaim(ctx.Request.Context(), &service.ClaimCouponRequest{
+			UserID:     req.UserID,
+			CouponName: req.CouponName,
+		})
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusAccepted, ticket)
+		return
+	}
+
+	result, err := c.service.ClaimCoupon(ctx.Request.Context(), &service.ClaimCouponRequest{
 		UserID:     req.UserID,
 		CouponName: req.CouponName,
 	})
@@ -87,14 +146,33 @@ func (c *CouponController) CreateCouponClaim(ctx *gin.Context) {
 			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "no stock available"})
 			return
 		}
+		if err == service.ErrAlreadyEntered {
+			ctx.JSON(http.StatusConflict, ErrorResponse{Error: "user already entered this lottery"})
+			return
+		}
+		if err == service.ErrEntriesClosed {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "lottery entries are closed"})
+			return
+		}
+		if err == service.ErrCouponNotStarted || err == service.ErrCouponExpired || err == service.ErrCouponArchived {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
 
+	if result.Status == service.ClaimStatusEntered {
+		ctx.JSON(http.StatusAccepted, gin.H{"message": "lottery entry recorded", "status": model.EntryStatusPending})
+		return
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{"message": "coupon claimed successfully"})
 }
 
 // GetCoupon - GET /api/coupons?name={name} or /api/coupons/{name}
+// claimed_by is paginated, pass limit and after={next_cursor} for the next page
+// Without a name it lists coupons instead, see listCoupons
 func (c *CouponController) GetCoupon(ctx *gin.Context) {
 	// not sure which one is preferred based on the requirements, so i supported both
 	name := ctx.Param("name")
@@ -102,11 +180,17 @@ func (c *CouponController) GetCoupon(ctx *gin.Context) {
 		name = ctx.Query("name")
 	}
 	if name == "" {
-		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "coupon name is required"})
+		c.listCoupons(ctx)
 		return
 	}
 
-	details, err := c.service.GetCouponDetails(ctx.Request.Context(), name)
+	page, err := pagination.Parse(ctx.Query("limit"), ctx.Query("after"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	details, err := c.service.GetCouponDetails(ctx.Request.Context(), name, page)
 	if err != nil {
 		if err == service.ErrCouponNotFound {
 			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon not found"})
@@ -116,5 +200,278 @@ func (c *CouponController) GetCoupon(ctx *gin.Context) {
 		return
 	}
 
+	ctx.Header("ETag", details.ETag)
 	ctx.JSON(http.StatusOK, details)
 }
+
+// listCoupons - GET /api/coupons?status={status}&prefix={prefix}&sort={sort}&limit={limit}&after={cursor}
+// status is active, sold_out, expired or archived. sort is created_at or remaining_amount, "-" prefix for descending (default -created_at)
+func (c *CouponController) listCoupons(ctx *gin.Context) {
+	status := ctx.Query("status")
+	switch status {
+	case "", model.CouponStatusActive, model.CouponStatusSoldOut, model.CouponStatusExpired, model.CouponStatusArchived:
+	default:
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "status must be one of active, sold_out, expired, archived"})
+		return
+	}
+
+	page, err := pagination.Parse(ctx.Query("limit"), ctx.Query("after"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	coupons, err := c.service.ListCoupons(ctx.Request.Context(), &service.ListCouponsRequest{
+		Status:     status,
+		NamePrefix: ctx.Query("prefix"),
+		Sort:       ctx.Query("sort"),
+		Page:       page,
+	})
+	if err != nil {
+		if err == service.ErrInvalidSort || err == service.ErrInvalidCursor {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, coupons)
+}
+
+// GetClaims - GET /api/coupons/:name/claims?limit={limit}&after={cursor}
+func (c *CouponController) GetClaims(ctx *gin.Context) {
+	page, err := pagination.Parse(ctx.Query("limit"), ctx.Query("after"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	claims, err := c.service.ListClaims(ctx.Request.Context(), ctx.Param("name"), page)
+	if err != nil {
+		if err == service.ErrCouponNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, claims)
+}
+
+// ExportClaims - GET /api/claims/export?format={csv|ndjson}&coupon={name}&from={time}&to={time}&columns={a,b,c}
+// Streams every matching claim, oldest first. from and to are RFC 3339, the range is [from, to).
+func (c *CouponController) ExportClaims(ctx *gin.Context) {
+	req := &service.ClaimExportRequest{
+		Format:     ctx.Query("format"),
+		CouponName: ctx.Query("coupon"),
+	}
+	for param, dst := range map[string]*time.Time{"from": &req.From, "to": &req.To} {
+		if value := ctx.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: param + " must be an RFC 3339 time"})
+				return
+			}
+			*dst = t
+		}
+	}
+	if columns := ctx.Query("columns"); columns != "" {
+		for _, column := range strings.Split(columns, ",") {
+			req.Columns = append(req.Columns, strings.TrimSpace(column))
+		}
+	}
+
+	export, err := c.service.NewClaimExport(ctx.Request.Context(), req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrCouponNotFound):
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon not found"})
+		case errors.Is(err, service.ErrInvalidExportFormat), errors.Is(err, service.ErrInvalidExportColumn),
+			errors.Is(err, service.ErrInvalidExportRange):
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		}
+		return
+	}
+
+	filename := "claims"
+	if req.CouponName != "" {
+		filename += "-" + req.CouponName
+	}
+	ctx.Header("Content-Type", export.ContentType())
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+"."+export.FileExtension()))
+	ctx.Status(http.StatusOK)
+
+	if err := export.Stream(ctx.Request.Context(), ctx.Writer); err != nil {
+		// The status is long gone, all we can do is cut the export short
+		log.Printf("claim export: %v", err)
+	}
+}
+
+// GetUserCoupons - GET /api/users/:id/coupons?limit={limit}&after={cursor}
+// :id is the external user_id, the numeric ID works too. Newest claim first.
+func (c *CouponController) GetUserCoupons(ctx *gin.Context) {
+	page, err := pagination.Parse(ctx.Query("limit"), ctx.Query("after"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	wallet, err := c.service.GetWallet(ctx.Request.Context(), ctx.Param("id"), page)
+	if err != nil {
+		if err == service.ErrUserNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, wallet)
+}
+
+// GetClaimTicket - GET /api/claims/tickets/:id
+func (c *CouponController) GetClaimTicket(ctx *gin.Context) {
+	if !c.service.AsyncClaims() {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "async claims are not enabled"})
+		return
+	}
+
+	ticket, err := c.service.GetClaimTicket(ctx.Request.Context(), ctx.Param("id"))
+	if err != nil {
+		if err == service.ErrTicketNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "claim ticket not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ticket)
+}
+
+// DrawLottery - POST /api/coupons/:name/draw
+func (c *CouponController) DrawLottery(ctx *gin.Context) {
+	var req DrawLotteryRequest
+	// Body is optional
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	draw, err := c.service.DrawLottery(ctx.Request.Context(), ctx.Param("name"), req.Seed)
+	if err != nil {
+		c.drawError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, draw)
+}
+
+// GetDraw - GET /api/coupons/:name/draw
+// Re-runs the recorded draw with its seed so anyone can verify the result
+func (c *CouponController) GetDraw(ctx *gin.Context) {
+	draw, err := c.service.VerifyDraw(ctx.Request.Context(), ctx.Param("name"))
+	if err != nil {
+		c.drawError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, draw)
+}
+
+func (c *CouponController) drawError(ctx *gin.Context, err error) {
+	switch err {
+	case service.ErrCouponNotFound:
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon not found"})
+	case service.ErrDrawNotFound:
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "lottery not drawn yet"})
+	case service.ErrNotLottery:
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "coupon is not a lottery coupon"})
+	case service.ErrEntriesStillOpen:
+		ctx.JSON(http.StatusConflict, ErrorResponse{Error: "lottery entries are still open"})
+	case service.ErrAlreadyDrawn:
+		ctx.JSON(http.StatusConflict, ErrorResponse{Error: "lottery already drawn"})
+	case service.ErrCouponNotStarted, service.ErrCouponExpired, service.ErrCouponArchived:
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+}
+
+// UpdateCoupon - PATCH /api/coupons/:name
+// Send the ETag of GET /api/coupons/:name as If-Match to only update the version you read, 412 otherwise
+func (c *CouponController) UpdateCoupon(ctx *gin.Context) {
+	var req UpdateCouponRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	coupon, err := c.service.UpdateCoupon(ctx.Request.Context(), ctx.Param("name"), ctx.GetHeader("If-Match"), &service.UpdateCouponRequest{
+		Name:          req.Name,
+		Amount:        req.Amount,
+		StartsAt:      req.StartsAt,
+		ExpiresAt:     req.ExpiresAt,
+		EntryDeadline: req.EntryDeadline,
+	})
+	if err != nil {
+		c.editError(ctx, err)
+		return
+	}
+
+	ctx.Header("ETag", coupon.ETag())
+	ctx.JSON(http.StatusOK, coupon)
+}
+
+// ArchiveCoupon - POST /api/coupons/:name/archive
+func (c *CouponController) ArchiveCoupon(ctx *gin.Context) {
+	c.setArchived(ctx, true)
+}
+
+// UnarchiveCoupon - POST /api/coupons/:name/unarchive
+func (c *CouponController) UnarchiveCoupon(ctx *gin.Context) {
+	c.setArchived(ctx, false)
+}
+
+func (c *CouponController) setArchived(ctx *gin.Context, archived bool) {
+	coupon, err := c.service.SetArchived(ctx.Request.Context(), ctx.Param("name"), ctx.GetHeader("If-Match"), archived)
+	if err != nil {
+		c.editError(ctx, err)
+		return
+	}
+
+	ctx.Header("ETag", coupon.ETag())
+	ctx.JSON(http.StatusOK, coupon)
+}
+
+// DeleteCoupon - DELETE /api/coupons/:name
+// Soft delete, the claims are kept and the name can be used again
+func (c *CouponController) DeleteCoupon(ctx *gin.Context) {
+	if err := c.service.DeleteCoupon(ctx.Request.Context(), ctx.Param("name"), ctx.GetHeader("If-Match")); err != nil {
+		c.editError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *CouponController) editError(ctx *gin.Context, err error) {
+	switch err {
+	case service.ErrCouponNotFound:
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon not found"})
+	case service.ErrPreconditionFailed:
+		ctx.JSON(http.StatusPreconditionFailed, ErrorResponse{Error: err.Error()})
+	case service.ErrCouponAlreadyExists, service.ErrAlreadyDrawn:
+		ctx.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+	case service.ErrAmountBelowClaimed, service.ErrInvalidWindow, service.ErrNotLottery:
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+}
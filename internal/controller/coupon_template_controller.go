@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+)
+
+type CreateTemplateRequest struct {
+	Name          string                 `json:"name" binding:"required"`
+	Amount        int                    `json:"amount" binding:"required,min=1"`
+	Mode          string                 `json:"mode" binding:"omitempty,oneof=fcfs lottery"`
+	Shards        int                    `json:"shards" binding:"omitempty,min=1,max=256"`
+	StartsAt      *time.Time             `json:"starts_at"`
+	ExpiresAt     *time.Time             `json:"expires_at"`
+	EntryDeadline *time.Time             `json:"entry_deadline"`
+	DiscountType  string                 `json:"discount_type" binding:"omitempty,oneof=percent fixed"`
+	DiscountValue int                    `json:"discount_value" binding:"min=0"`
+	Rules         map[string]interface{} `json:"rules"`
+}
+
+// CouponOverrideRequest is one coupon of a bulk create, omitted fields take the template's value
+type CouponOverrideRequest struct {
+	Name          string                 `json:"name" binding:"required"`
+	Amount        *int                   `json:"amount" binding:"omitempty,min=1"`
+	Mode          *string                `json:"mode" binding:"omitempty,oneof=fcfs lottery"`
+	Shards        *int                   `json:"shards" binding:"omitempty,min=1,max=256"`
+	StartsAt      *time.Time             `json:"starts_at"`
+	ExpiresAt     *time.Time             `json:"expires_at"`
+	EntryDeadline *time.Time             `json:"entry_deadline"`
+	DiscountType  *string                `json:"discount_type" binding:"omitempty,oneof=percent fixed"`
+	DiscountValue *int                   `json:"discount_value" binding:"omitempty,min=0"`
+	Rules         map[string]interface{} `json:"rules"`
+}
+
+type BulkCreateCouponsRequest struct {
+	Coupons []CouponOverrideRequest `json:"coupons" binding:"required,min=1,max=1000,dive"`
+}
+
+// CreateTemplate - POST /api/coupon-templates
+func (c *CouponController) CreateTemplate(ctx *gin.Context) {
+	var req CreateTemplateRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	template, err := c.service.CreateTemplate(ctx.Request.Context(), &service.CreateTemplateRequest{
+		Name:          req.Name,
+		Amount:        req.Amount,
+		Mode:          req.Mode,
+		Shards:        req.Shards,
+		StartsAt:      req.StartsAt,
+		ExpiresAt:     req.ExpiresAt,
+		EntryDeadline: req.EntryDeadline,
+		DiscountType:  req.DiscountType,
+		DiscountValue: req.DiscountValue,
+		Rules:         req.Rules,
+	})
+	if err != nil {
+		switch err {
+		case service.ErrTemplateAlreadyExists:
+			ctx.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		case service.ErrShardedLottery, service.ErrInvalidWindow, service.ErrInvalidDiscount:
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, template)
+}
+
+// ListTemplates - GET /api/coupon-templates
+func (c *CouponController) ListTemplates(ctx *gin.Context) {
+	templates, err := c.service.ListTemplates(ctx.Request.Context())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, templates)
+}
+
+// GetTemplate - GET /api/coupon-templates/:name
+func (c *CouponController) GetTemplate(ctx *gin.Context) {
+	template, err := c.service.GetTemplate(ctx.Request.Context(), ctx.Param("name"))
+	if err != nil {
+		c.templateError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, template)
+}
+
+// DeleteTemplate - DELETE /api/coupon-templates/:name
+func (c *CouponController) DeleteTemplate(ctx *gin.Context) {
+	if err := c.service.DeleteTemplate(ctx.Request.Context(), ctx.Param("name")); err != nil {
+		c.templateError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// CreateCouponsFromTemplate - POST /api/coupon-templates/:name/coupons
+// Creates every coupon in one transaction, each one can still fail on its own (see results)
+func (c *CouponController) CreateCouponsFromTemplate(ctx *gin.Context) {
+	var req BulkCreateCouponsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	items := make([]service.CouponOverride, len(req.Coupons))
+	for i, item := range req.Coupons {
+		items[i] = service.CouponOverride{
+			Name:          item.Name,
+			Amount:        item.Amount,
+			Mode:          item.Mode,
+			Shards:        item.Shards,
+			StartsAt:      item.StartsAt,
+			ExpiresAt:     item.ExpiresAt,
+			EntryDeadline: item.EntryDeadline,
+			DiscountType:  item.DiscountType,
+			DiscountValue: item.DiscountValue,
+			Rules:         item.Rules,
+		}
+	}
+
+	resp, err := c.service.CreateCouponsFromTemplate(ctx.Request.Context(), ctx.Param("name"), items)
+	if err != nil {
+		c.templateError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (c *CouponController) templateError(ctx *gin.Context, err error) {
+	if err == service.ErrTemplateNotFound {
+		ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon template not found"})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+}
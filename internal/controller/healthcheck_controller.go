@@ -1,19 +1,38 @@
 package controller
 
 import (
+	"context"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
-	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
-	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/redis"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
 )
 
-type DevController struct{}
+// DependencyCheck pings a dependency of the service, nil means healthy
+type DependencyCheck func(ctx context.Context) error
 
-func NewDevController() *DevController {
-	return &DevController{}
+type DevController struct {
+	config *config.Config
+	// Dependencies the health check pings, by name
+	checks map[string]DependencyCheck
+
+	// Set once shutdown starts, so the health check sends traffic elsewhere while requests drain
+	draining atomic.Bool
+}
+
+func NewDevController(cfg *config.Config, checks map[string]DependencyCheck) *DevController {
+	return &DevController{
+		config: cfg,
+		checks: checks,
+	}
+}
+
+// SetDraining makes the health check report the service unhealthy from now on
+func (c *DevController) SetDraining() {
+	c.draining.Store(true)
 }
 
 type HealthStatus struct {
@@ -35,56 +54,42 @@ func (c *DevController) HealthCheck(ctx *gin.Context) {
 		Services:  make(map[string]ServiceHealth),
 	}
 
-	// Check database health
-	dbStart := time.Now()
-	sqlDB, err := db.DB.DB()
-	if err != nil {
-		health.Services["database"] = ServiceHealth{
-			Status:  "unhealthy",
-			Message: "failed to get database instance: " + err.Error(),
-		}
-		health.Status = "unhealthy"
-	} else {
-		err = sqlDB.Ping()
-		latency := time.Since(dbStart)
+	// Check the dependencies (database, redis)
+	for name, check := range c.checks {
+		checkCtx, cancel := context.WithTimeout(ctx.Request.Context(), c.config.Server.HealthCheckTimeout.D())
+		start := time.Now()
+		err := check(checkCtx)
+		latency := time.Since(start)
+		cancel()
+
 		if err != nil {
-			health.Services["database"] = ServiceHealth{
+			health.Services[name] = ServiceHealth{
 				Status:  "unhealthy",
-				Message: "database ping failed: " + err.Error(),
+				Message: err.Error(),
 				Latency: latency,
 			}
 			health.Status = "unhealthy"
 		} else {
-			health.Services["database"] = ServiceHealth{
+			health.Services[name] = ServiceHealth{
 				Status:  "healthy",
 				Latency: latency,
 			}
 		}
 	}
 
-	// Check Redis health
-	redisStart := time.Now()
-	err = redis.CheckHealth()
-	latency := time.Since(redisStart)
-	if err != nil {
-		health.Services["redis"] = ServiceHealth{
+	// Check service health (healthy while the server is running, until shutdown starts)
+	if c.draining.Load() {
+		health.Services["service"] = ServiceHealth{
 			Status:  "unhealthy",
-			Message: err.Error(),
-			Latency: latency,
+			Message: "shutting down",
 		}
 		health.Status = "unhealthy"
 	} else {
-		health.Services["redis"] = ServiceHealth{
-			Status:  "healthy",
-			Latency: latency,
+		health.Services["service"] = ServiceHealth{
+			Status: "healthy",
 		}
 	}
 
-	// Check service health (always healthy if server is running)
-	health.Services["service"] = ServiceHealth{
-		Status: "healthy",
-	}
-
 	// Determine HTTP status code
 	statusCode := http.StatusOK
 	if health.Status == "unhealthy" {
@@ -93,3 +98,9 @@ func (c *DevController) HealthCheck(ctx *gin.Context) {
 
 	ctx.JSON(statusCode, health)
 }
+
+// GetConfig - GET /api/config
+// The configuration the service runs with, secrets redacted
+func (c *DevController) GetConfig(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.config.Redacted())
+}
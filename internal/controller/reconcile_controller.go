@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+)
+
+type ReconcileController struct {
+	reconciler *service.StockReconciler
+}
+
+func NewReconcileController(reconciler *service.StockReconciler) *ReconcileController {
+	return &ReconcileController{
+		reconciler: reconciler,
+	}
+}
+
+// Reconcile - POST /api/reconcile?repair={bool}
+// Checks the stock of every coupon against its claims. Only reports unless repair is true.
+func (c *ReconcileController) Reconcile(ctx *gin.Context) {
+	repair := false
+	if raw := ctx.Query("repair"); raw != "" {
+		var err error
+		if repair, err = strconv.ParseBool(raw); err != nil {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "repair must be true or false"})
+			return
+		}
+	}
+
+	report, err := c.reconciler.Reconcile(ctx.Request.Context(), repair)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+)
+
+type StockStreamController struct {
+	service service.CouponService
+	hub     *service.StockHub
+}
+
+func NewStockStreamController(service service.CouponService, hub *service.StockHub) *StockStreamController {
+	return &StockStreamController{
+		service: service,
+		hub:     hub,
+	}
+}
+
+// Storefronts live on other origins, and the stream is the same public data as GET /api/coupons/:name
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type StockMessage struct {
+	Event string             `json:"event"`
+	Data  *model.StockUpdate `json:"data"`
+}
+
+func stockEventName(update *model.StockUpdate) string {
+	if update.SoldOut {
+		return "sold_out"
+	}
+	return "stock"
+}
+
+// StreamCoupon - GET /api/coupons/:name/stream
+// Server-Sent Events by default, WebSocket when the request asks for an upgrade.
+// The current stock is sent first, then every (throttled) change.
+func (c *StockStreamController) StreamCoupon(ctx *gin.Context) {
+	name := ctx.Param("name")
+
+	// Subscribe before reading the current stock, so nothing falls in between
+	updates, stop, err := c.hub.Subscribe(ctx.Request.Context(), name)
+	if err != nil {
+		if err == service.ErrStockHubClosed {
+			ctx.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "server is shutting down"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+	defer stop()
+
+	current, err := c.service.GetStock(ctx.Request.Context(), name)
+	if err != nil {
+		if err == service.ErrCouponNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "coupon not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(ctx.Request) {
+		c.streamWebSocket(ctx, current, updates)
+		return
+	}
+	c.streamSSE(ctx, current, updates)
+}
+
+func (c *StockStreamController) streamSSE(ctx *gin.Context, current *model.StockUpdate, updates <-chan model.StockUpdate) {
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	// Stop nginx and friends from buffering the stream
+	ctx.Header("X-Accel-Buffering", "no")
+
+	ctx.SSEvent(stockEventName(current), current)
+	ctx.Writer.Flush()
+
+	// Comment lines keep idle connections from being cut by proxies
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				// Shutting down, the client reconnects to another instance
+				return false
+			}
+			ctx.SSEvent(stockEventName(&update), update)
+			return true
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func (c *StockStreamController) streamWebSocket(ctx *gin.Context, current *model.StockUpdate, updates <-chan model.StockUpdate) {
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// Upgrade already answered the request
+		return
+	}
+	defer conn.Close()
+
+	// The stream is one way, reading is only there to notice the client leaving
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := conn.WriteJSON(StockMessage{Event: stockEventName(current), Data: current}); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+				return
+			}
+			if err := conn.WriteJSON(StockMessage{Event: stockEventName(&update), Data: &update}); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-ctx.Request.Context().Done():
+			return
+		}
+	}
+}
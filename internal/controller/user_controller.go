@@ -1,19 +1,31 @@
 package controller
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
 )
 
 type UserController struct {
-	Service *service.UserService
+	Service service.UserService
 }
 
-func NewUserController(service *service.UserService) *UserController {
+type UserListResponse struct {
+	Users      []model.User `json:"users"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// UserRequest is the body of PUT and PATCH /api/users/{user_id}
+type UserRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+func NewUserController(service service.UserService) *UserController {
 	return &UserController{Service: service}
 }
 
@@ -24,7 +36,11 @@ func (c *UserController) CreateUser(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.Service.CreateUser(&user); err != nil {
+	if err := c.Service.CreateUser(ctx.Request.Context(), &user); err != nil {
+		if errors.Is(err, service.ErrUserAlreadyExists) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -32,28 +48,121 @@ func (c *UserController) CreateUser(ctx *gin.Context) {
 	ctx.JSON(http.StatusCreated, user)
 }
 
+// BulkCreateUsers - POST /api/users/bulk
+// Takes NDJSON ({"user_id": ..., "name": ...} per line) or CSV with a user_id,name header, streamed in the body.
+// Answers with NDJSON as the import goes: one line per row that failed, then a last line with the totals.
+func (c *UserController) BulkCreateUsers(ctx *gin.Context) {
+	var format string
+	switch ctx.ContentType() {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		format = service.UserImportNDJSON
+	case "text/csv":
+		format = service.UserImportCSV
+	default:
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": service.ErrUnsupportedImportFormat.Error()})
+		return
+	}
+
+	// Errors are written while the body is still being read, HTTP/1 needs full duplex for that
+	_ = http.NewResponseController(ctx.Writer).EnableFullDuplex()
+
+	ctx.Header("Content-Type", "application/x-ndjson")
+	ctx.Status(http.StatusOK)
+	enc := json.NewEncoder(ctx.Writer)
+
+	summary, err := c.Service.ImportUsers(ctx.Request.Context(), format, ctx.Request.Body, func(rowErr service.UserImportError) {
+		enc.Encode(rowErr)
+		ctx.Writer.Flush()
+	})
+	if err != nil {
+		// Too late for a status code, the error goes into the last line
+		enc.Encode(gin.H{"inserted": summary.Inserted, "failed": summary.Failed, "error": err.Error()})
+		return
+	}
+	enc.Encode(summary)
+}
+
+// GetUsers - GET /api/users?limit={limit}&after={cursor}
 func (c *UserController) GetUsers(ctx *gin.Context) {
-	users, err := c.Service.GetAllUsers()
+	page, err := pagination.Parse(ctx.Query("limit"), ctx.Query("after"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	users, next, err := c.Service.GetAllUsers(ctx.Request.Context(), page)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, users)
+	ctx.JSON(http.StatusOK, UserListResponse{Users: users, NextCursor: next})
 }
 
+// GetUser - GET /api/users/{user_id}, the numeric ID works too
 func (c *UserController) GetUser(ctx *gin.Context) {
-	id, err := strconv.Atoi(ctx.Param("id"))
+	user, err := c.Service.GetUser(ctx.Request.Context(), ctx.Param("id"))
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		userError(ctx, err)
 		return
 	}
 
-	user, err := c.Service.GetUserByID(uint(id))
+	ctx.JSON(http.StatusOK, user)
+}
+
+// UpdateUser - PATCH /api/users/{user_id}
+func (c *UserController) UpdateUser(ctx *gin.Context) {
+	var req UserRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := c.Service.UpdateUser(ctx.Request.Context(), ctx.Param("id"), req.Name)
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		userError(ctx, err)
 		return
 	}
 
 	ctx.JSON(http.StatusOK, user)
 }
+
+// UpsertUser - PUT /api/users/{user_id}, 201 when the user was created, 200 when it was updated
+func (c *UserController) UpsertUser(ctx *gin.Context) {
+	var req UserRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := model.User{Name: req.Name, UserID: ctx.Param("id")}
+	created, err := c.Service.UpsertUser(ctx.Request.Context(), &user)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	ctx.JSON(status, user)
+}
+
+// DeleteUser - DELETE /api/users/{user_id}, revokes the user's claims and returns their units to stock
+func (c *UserController) DeleteUser(ctx *gin.Context) {
+	if err := c.Service.DeleteUser(ctx.Request.Context(), ctx.Param("id")); err != nil {
+		userError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func userError(ctx *gin.Context, err error) {
+	if errors.Is(err, service.ErrUserNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
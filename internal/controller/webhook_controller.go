@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/service"
+)
+
+type WebhookController struct {
+	service *service.WebhookService
+}
+
+func NewWebhookController(service *service.WebhookService) *WebhookController {
+	return &WebhookController{
+		service: service,
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL        string   `json:"url" binding:"required,url"`
+	EventTypes []string `json:"event_types" binding:"required,min=1"`
+	Secret     string   `json:"secret"`
+}
+
+type WebhookResponse struct {
+	ID         uint      `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Only on create, it can't be read back afterwards
+	Secret string `json:"secret,omitempty"`
+}
+
+func toWebhookResponse(sub *model.WebhookSubscription) WebhookResponse {
+	return WebhookResponse{
+		ID:         sub.ID,
+		URL:        sub.URL,
+		EventTypes: strings.Split(sub.EventTypes, ","),
+		Active:     sub.Active,
+		CreatedAt:  sub.CreatedAt,
+	}
+}
+
+// CreateWebhook - POST /api/webhooks
+func (c *WebhookController) CreateWebhook(ctx *gin.Context) {
+	var req CreateWebhookRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	sub, secret, err := c.service.CreateSubscription(ctx.Request.Context(), &service.CreateWebhookRequest{
+		URL:        req.URL,
+		EventTypes: req.EventTypes,
+		Secret:     req.Secret,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrUnknownEventType) {
+			ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	resp := toWebhookResponse(sub)
+	resp.Secret = secret
+	ctx.JSON(http.StatusCreated, resp)
+}
+
+// GetWebhooks - GET /api/webhooks
+func (c *WebhookController) GetWebhooks(ctx *gin.Context) {
+	subs, err := c.service.ListSubscriptions(ctx.Request.Context())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	resp := make([]WebhookResponse, len(subs))
+	for i := range subs {
+		resp[i] = toWebhookResponse(&subs[i])
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// DeleteWebhook - DELETE /api/webhooks/:id
+func (c *WebhookController) DeleteWebhook(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid ID"})
+		return
+	}
+
+	if err := c.service.DeleteSubscription(ctx.Request.Context(), uint(id)); err != nil {
+		if err == service.ErrWebhookNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "webhook not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetDeliveries - GET /api/webhooks/:id/deliveries
+// Latest 100 deliveries of a subscription, newest first
+func (c *WebhookController) GetDeliveries(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid ID"})
+		return
+	}
+
+	deliveries, err := c.service.ListDeliveries(ctx.Request.Context(), uint(id))
+	if err != nil {
+		if err == service.ErrWebhookNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "webhook not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, deliveries)
+}
+
+// Redeliver - POST /api/webhooks/deliveries/:id/redeliver
+// Puts a delivery (usually a dead one) back in the queue
+func (c *WebhookController) Redeliver(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid ID"})
+		return
+	}
+
+	delivery, err := c.service.Redeliver(ctx.Request.Context(), uint(id))
+	if err != nil {
+		if err == service.ErrDeliveryNotFound {
+			ctx.JSON(http.StatusNotFound, ErrorResponse{Error: "webhook delivery not found"})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, delivery)
+}
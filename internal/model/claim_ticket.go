@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// Claim ticket statuses
+const (
+	TicketStatusPending        = "pending"
+	TicketStatusWon            = "won"
+	TicketStatusEntered        = "entered"
+	TicketStatusNoStock        = "no_stock"
+	TicketStatusAlreadyClaimed = "already_claimed"
+	TicketStatusFailed         = "failed"
+)
+
+// ClaimTicket tracks an asynchronous claim request.
+// Tickets live in redis (not postgres), they're short lived and any instance must be able to answer a poll.
+type ClaimTicket struct {
+	ID         string    `json:"ticket_id" redis:"-"`
+	UserID     string    `json:"user_id" redis:"user_id"`
+	CouponName string    `json:"coupon_name" redis:"coupon_name"`
+	Status     string    `json:"status" redis:"status"`
+	Error      string    `json:"error,omitempty" redis:"error"`
+	CreatedAt  time.Time `json:"created_at" redis:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" redis:"updated_at"`
+}
@@ -1,10 +1,82 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Coupon modes.
+// FCFS hands out stock to whoever claims first, Lottery collects entries and draws winners later.
+const (
+	CouponModeFCFS    = "fcfs"
+	CouponModeLottery = "lottery"
+)
+
+// Discount types. Percent takes 1-100, fixed an amount in the smallest currency unit.
+const (
+	DiscountTypePercent = "percent"
+	DiscountTypeFixed   = "fixed"
+)
+
+// Coupon statuses, derived from the claim window and the stock left
+const (
+	CouponStatusActive   = "active"
+	CouponStatusSoldOut  = "sold_out"
+	CouponStatusExpired  = "expired"
+	CouponStatusArchived = "archived"
+)
 
 type Coupon struct {
 	gorm.Model
-	Name            string `json:"coupon_name"`
+	// Unique among coupons that aren't deleted, a deleted coupon frees its name
+	Name            string `json:"coupon_name" gorm:"uniqueIndex:idx_coupons_name_live,where:deleted_at IS NULL"`
 	Amount          int    `json:"amount"`
 	RemainingAmount int    `json:"remaining_amount"`
+	Mode            string `json:"mode" gorm:"type:text;not null;default:fcfs"`
+
+	// Number of stock sub-counters (see CouponShard). 1 means RemainingAmount is the only counter.
+	// For sharded coupons RemainingAmount is not updated on claim, the shards hold the real stock.
+	Shards int `json:"shards" gorm:"not null;default:1"`
+
+	// Claim window, both optional. Claims outside of it are rejected.
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Lottery only. Entries are rejected after EntryDeadline (if set) or once the draw happened.
+	EntryDeadline *time.Time `json:"entry_deadline,omitempty"`
+	DrawnAt       *time.Time `json:"drawn_at,omitempty"`
+
+	// What the coupon is worth, optional. See the DiscountType values.
+	DiscountType  string `json:"discount_type,omitempty" gorm:"type:text"`
+	DiscountValue int    `json:"discount_value,omitempty"`
+	// Conditions for redeeming the coupon, free-form. Stored and handed out as is, this service doesn't enforce them.
+	Rules map[string]interface{} `json:"rules,omitempty" gorm:"type:jsonb;serializer:json"`
+
+	// Archived coupons reject new claims but stay visible, and keep their name reserved
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+
+	// Bumped on every edit (not on claims), backs the ETag
+	Version int `json:"version" gorm:"not null;default:1"`
+}
+
+// ETag identifies this version of the coupon. The ID is part of it, so an ETag never matches
+// a later coupon that reused the name.
+func (c *Coupon) ETag() string {
+	return fmt.Sprintf(`"%d.%d"`, c.ID, c.Version)
+}
+
+// Status derives the status of the coupon at now, given the stock left (see CouponRepository.RemainingStock)
+func (c *Coupon) Status(remaining int, now time.Time) string {
+	if c.ArchivedAt != nil {
+		return CouponStatusArchived
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return CouponStatusExpired
+	}
+	if remaining <= 0 {
+		return CouponStatusSoldOut
+	}
+	return CouponStatusActive
 }
@@ -1,11 +1,70 @@
 package model
 
+import (
+	"crypto/rand"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Claim statuses, as seen from the user's wallet
+const (
+	ClaimStatusActive  = "active"
+	ClaimStatusExpired = "expired"
+)
+
+// Claim codes use an alphabet without look-alikes (0/O, 1/I/L), they get read out and typed in by hand
+const claimCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
 type CouponClaims struct {
-	ID       uint
-	CouponID uint   `json:"coupon_id" gorm:"not null;index:idx_coupon_user,unique"`
+	// (coupon_id, id) backs the keyset pagination of a coupon's claims
+	ID       uint   `json:"id" gorm:"primaryKey;index:idx_coupon_claims_keyset,priority:2"`
+	CouponID uint   `json:"coupon_id" gorm:"not null;index:idx_coupon_user,unique;index:idx_coupon_claims_keyset,priority:1"`
 	Coupon   Coupon `gorm:"belongsTo;foreignKey:CouponID;references:ID"`
 
 	// Use User.UserID, instead of User.ID
-	UserID string `json:"user_id" gorm:"type:text;not null;index:idx_coupon_user,unique"`
+	UserID string `json:"user_id" gorm:"type:text;not null;index:idx_coupon_user,unique;index:idx_coupon_claims_user"`
 	User   User   `gorm:"belongsTo;foreignKey:UserID;references:UserID"`
+
+	// Redemption code of this claim, generated on insert
+	Code      string    `json:"code" gorm:"type:text;not null;uniqueIndex"`
+	ClaimedAt time.Time `json:"claimed_at" gorm:"autoCreateTime"`
+}
+
+// BeforeCreate gives every new claim a code, whichever path created it (single, batch, sharded or lottery)
+func (c *CouponClaims) BeforeCreate(tx *gorm.DB) error {
+	if c.Code != "" {
+		return nil
+	}
+	code, err := NewClaimCode()
+	if err != nil {
+		return err
+	}
+	c.Code = code
+	return nil
+}
+
+// NewClaimCode returns a random code like "K7Q2-M9XP-3DHR", about 59 bits of entropy
+func NewClaimCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, 0, 14)
+	for i, v := range b {
+		if i > 0 && i%4 == 0 {
+			code = append(code, '-')
+		}
+		code = append(code, claimCodeAlphabet[int(v)%len(claimCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// Status of the claim at now, it expires together with its coupon (Coupon must be loaded)
+func (c *CouponClaims) Status(now time.Time) string {
+	if c.Coupon.ExpiresAt != nil && !now.Before(*c.Coupon.ExpiresAt) {
+		return ClaimStatusExpired
+	}
+	return ClaimStatusActive
 }
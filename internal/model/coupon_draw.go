@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// CouponDraw is the audit record of a lottery draw.
+// Re-running the draw with the same Seed over the same entries must give the same winners.
+type CouponDraw struct {
+	ID          uint      `json:"id"`
+	CouponID    uint      `json:"coupon_id" gorm:"not null;uniqueIndex"`
+	Seed        int64     `json:"seed"`
+	Stock       int       `json:"stock"`
+	EntryCount  int       `json:"entry_count"`
+	WinnerCount int       `json:"winner_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// Lottery entry statuses
+const (
+	EntryStatusPending     = "pending"
+	EntryStatusWon         = "won"
+	EntryStatusNotSelected = "not_selected"
+)
+
+// CouponEntry is a user's ticket in a lottery coupon draw
+type CouponEntry struct {
+	ID        uint      `json:"id"`
+	CouponID  uint      `json:"coupon_id" gorm:"not null;index:idx_entry_coupon_user,unique"`
+	UserID    string    `json:"user_id" gorm:"type:text;not null;index:idx_entry_coupon_user,unique"`
+	Status    string    `json:"status" gorm:"type:text;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
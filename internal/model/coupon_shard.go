@@ -0,0 +1,10 @@
+package model
+
+// CouponShard is one stock sub-counter of a sharded coupon.
+// The remaining stock of the coupon is the sum of all its shards.
+type CouponShard struct {
+	ID         uint `json:"id"`
+	CouponID   uint `json:"coupon_id" gorm:"not null;index:idx_coupon_shard,unique"`
+	ShardIndex int  `json:"shard_index" gorm:"not null;index:idx_coupon_shard,unique"`
+	Remaining  int  `json:"remaining" gorm:"not null"`
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// CouponTemplate holds the defaults for creating many similar coupons, see CouponService.CreateCouponsFromTemplate
+type CouponTemplate struct {
+	ID     uint   `json:"id"`
+	Name   string `json:"name" gorm:"type:text;not null;uniqueIndex"`
+	Amount int    `json:"amount" gorm:"not null"`
+	Mode   string `json:"mode" gorm:"type:text;not null;default:fcfs"`
+	Shards int    `json:"shards" gorm:"not null;default:1"`
+
+	StartsAt      *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	EntryDeadline *time.Time `json:"entry_deadline,omitempty"`
+
+	DiscountType  string                 `json:"discount_type,omitempty" gorm:"type:text"`
+	DiscountValue int                    `json:"discount_value,omitempty"`
+	Rules         map[string]interface{} `json:"rules,omitempty" gorm:"type:jsonb;serializer:json"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
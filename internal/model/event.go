@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// Coupon event types
+// See docs/events.md for the schema of each of them.
+const (
+	EventCouponCreated    = "coupon.created"
+	EventCouponClaimed    = "coupon.claimed"
+	EventCouponSoldOut    = "coupon.sold_out"
+	EventCouponRestocked  = "coupon.restocked"
+	EventCouponRevoked    = "coupon.revoked"
+	EventCouponRedeemed   = "coupon.redeemed"
+	EventCouponReconciled = "coupon.reconciled"
+)
+
+// Event is something that happened to a coupon, as published to external systems
+type Event struct {
+	ID              string    `json:"id"`
+	Type            string    `json:"type"`
+	CouponName      string    `json:"coupon_name"`
+	UserID          string    `json:"user_id,omitempty"`
+	Amount          int       `json:"amount,omitempty"`
+	RemainingAmount int       `json:"remaining_amount"`
+	OccurredAt      time.Time `json:"occurred_at"`
+	// Position in the outbox, set by the relay. Later events of a coupon have a higher one.
+	Sequence uint64 `json:"-"`
+}
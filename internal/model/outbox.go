@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// Outbox event statuses
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusPublished = "published"
+)
+
+// OutboxEvent is an Event waiting to be published.
+// It's written in the same transaction as the change it describes, so an event exists if and only if the change committed.
+type OutboxEvent struct {
+	ID          uint       `json:"id"`
+	EventID     string     `json:"event_id" gorm:"type:text;not null;uniqueIndex"`
+	Type        string     `json:"type" gorm:"type:text;not null"`
+	CouponName  string     `json:"coupon_name" gorm:"type:text;not null"`
+	Payload     string     `json:"payload" gorm:"type:text;not null"`
+	Status      string     `json:"status" gorm:"type:text;not null;index"`
+	Attempts    int        `json:"attempts" gorm:"not null"`
+	LastError   string     `json:"last_error,omitempty" gorm:"type:text"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+}
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// StockUpdate is a live stock change of a coupon, as pushed to stream subscribers
+type StockUpdate struct {
+	CouponName      string    `json:"coupon_name"`
+	RemainingAmount int       `json:"remaining_amount"`
+	SoldOut         bool      `json:"sold_out"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	// Sequence of the event the update comes from, 0 for a snapshot
+	Sequence uint64 `json:"-"`
+}
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// Webhook delivery statuses
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusDead      = "dead"
+)
+
+type WebhookSubscription struct {
+	ID  uint   `json:"id"`
+	URL string `json:"url" gorm:"type:text;not null"`
+	// Comma separated event types, "*" means every event
+	EventTypes string    `json:"event_types" gorm:"type:text;not null"`
+	Secret     string    `json:"-" gorm:"type:text;not null"`
+	Active     bool      `json:"active" gorm:"not null;default:true"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event to be sent to one subscription, there's at most one per subscription and event
+type WebhookDelivery struct {
+	ID             uint                `json:"id"`
+	SubscriptionID uint                `json:"subscription_id" gorm:"not null;uniqueIndex:idx_webhook_deliveries_event"`
+	Subscription   WebhookSubscription `json:"-" gorm:"foreignKey:SubscriptionID;constraint:OnDelete:CASCADE"`
+	EventID        string              `json:"event_id" gorm:"type:text;not null;uniqueIndex:idx_webhook_deliveries_event"`
+	EventType      string              `json:"event_type" gorm:"type:text;not null"`
+	Payload        string              `json:"payload" gorm:"type:text;not null"`
+	Status         string              `json:"status" gorm:"type:text;not null;index:idx_delivery_due"`
+	Attempts       int                 `json:"attempts" gorm:"not null"`
+	NextAttemptAt  time.Time           `json:"next_attempt_at" gorm:"index:idx_delivery_due"`
+	LastError      string              `json:"last_error,omitempty" gorm:"type:text"`
+	LastStatusCode int                 `json:"last_status_code,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+	UpdatedAt      time.Time           `json:"updated_at"`
+}
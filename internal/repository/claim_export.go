@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+var ErrInvalidExportColumn = errors.New("unknown export column")
+
+// claimExportColumns maps the export columns to their SQL, over coupon_claims joined with users and coupons
+var claimExportColumns = map[string]string{
+	"claim_id":       "coupon_claims.id",
+	"code":           "coupon_claims.code",
+	"claimed_at":     "coupon_claims.claimed_at",
+	"user_id":        "coupon_claims.user_id",
+	"user_name":      "users.name",
+	"coupon_id":      "coupons.id",
+	"coupon_name":    "coupons.name",
+	"coupon_mode":    "coupons.mode",
+	"discount_type":  "coupons.discount_type",
+	"discount_value": "coupons.discount_value",
+	"expires_at":     "coupons.expires_at",
+}
+
+// ClaimExportColumns is every column an export can have, in the default order
+var ClaimExportColumns = []string{
+	"claim_id", "code", "claimed_at", "user_id", "user_name",
+	"coupon_id", "coupon_name", "coupon_mode", "discount_type", "discount_value", "expires_at",
+}
+
+// ClaimExportFilter narrows an export down, zero fields don't filter
+type ClaimExportFilter struct {
+	// Claims of these coupons, nil for every coupon
+	CouponIDs []uint
+	// Claimed in [From, To)
+	From time.Time
+	To   time.Time
+}
+
+// ExportClaims runs the export query and calls row for every claim, oldest first, with the values of columns.
+// Rows are read off the result as they come in, so memory stays flat whatever the row count.
+// values is reused between calls.
+func (r *couponRepository) ExportClaims(ctx context.Context, filter ClaimExportFilter, columns []string, row func(values []interface{}) error) error {
+	selects := make([]string, len(columns))
+	for i, column := range columns {
+		expr, ok := claimExportColumns[column]
+		if !ok {
+			return ErrInvalidExportColumn
+		}
+		selects[i] = expr
+	}
+
+	// Deleted coupons are part of the history, so no soft delete scope on the join
+	q := r.db.WithContext(ctx).Model(&model.CouponClaims{}).
+		Select(selects).
+		Joins("JOIN users ON users.user_id = coupon_claims.user_id").
+		Joins("JOIN coupons ON coupons.id = coupon_claims.coupon_id")
+	if filter.CouponIDs != nil {
+		q = q.Where("coupon_claims.coupon_id IN ?", filter.CouponIDs)
+	}
+	if !filter.From.IsZero() {
+		q = q.Where("coupon_claims.claimed_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		q = q.Where("coupon_claims.claimed_at < ?", filter.To)
+	}
+
+	rows, err := q.Order("coupon_claims.id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if err := row(values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// BatchClaimResult is the outcome of one claim in a batch.
+// Remaining is the stock left right after this claim, only meaningful when Err is nil.
+type BatchClaimResult struct {
+	Err       error
+	Remaining int
+}
+
+// ClaimCouponBatch claims one coupon for many users in a single transaction (group commit).
+// Claims are settled in slice order, so earlier users win when stock runs out mid batch.
+// The returned slice has one result per user, the error is only set when the whole batch failed.
+func (r *couponRepository) ClaimCouponBatch(ctx context.Context, couponName string, userIDs []string) ([]BatchClaimResult, error) {
+	// Same lock as ClaimCoupon, so batched and single claims can run side by side
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s", couponName))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	results := make([]BatchClaimResult, len(userIDs))
+
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var coupon model.Coupon
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("name = ?", couponName).First(&coupon).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCouponNotFound
+			}
+			return err
+		}
+		if err := checkClaimable(&coupon, time.Now()); err != nil {
+			return err
+		}
+
+		var users []model.User
+		if err := tx.Where("user_id IN ?", userIDs).Find(&users).Error; err != nil {
+			return err
+		}
+		known := make(map[string]bool, len(users))
+		for _, u := range users {
+			known[u.UserID] = true
+		}
+
+		var existingClaims []model.CouponClaims
+		if err := tx.Where("coupon_id = ? AND user_id IN ?", coupon.ID, userIDs).
+			Find(&existingClaims).Error; err != nil {
+			return err
+		}
+		claimed := make(map[string]bool, len(existingClaims))
+		for _, c := range existingClaims {
+			claimed[c.UserID] = true
+		}
+
+		remaining := coupon.RemainingAmount
+		var claims []model.CouponClaims
+		var events []model.Event
+		for i, userID := range userIDs {
+			switch {
+			case !known[userID]:
+				results[i].Err = errUnknownUser(userID)
+			case claimed[userID]:
+				// Also catches the same user twice in one batch
+				results[i].Err = ErrAlreadyClaimed
+			case remaining <= 0:
+				results[i].Err = ErrNoStock
+			default:
+				claimed[userID] = true
+				remaining--
+				results[i].Remaining = remaining
+				claims = append(claims, model.CouponClaims{CouponID: coupon.ID, UserID: userID})
+				events = append(events, claimEvents(&coupon, userID, remaining)...)
+			}
+		}
+
+		if len(claims) == 0 {
+			return nil
+		}
+
+		// One multi-row insert and one decrement for the whole batch
+		if err := tx.Create(&claims).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&coupon).Update("remaining_amount", remaining).Error; err != nil {
+			return err
+		}
+		return writeOutbox(tx, events...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
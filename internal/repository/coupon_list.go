@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+var ErrInvalidSort = errors.New("sort must be one of created_at, -created_at, remaining_amount, -remaining_amount")
+
+// Stock left of a coupon in SQL, sharded coupons don't keep coupons.remaining_amount up to date
+const remainingExpr = `CASE WHEN coupons.shards > 1
+	THEN (SELECT COALESCE(SUM(remaining), 0) FROM coupon_shards WHERE coupon_shards.coupon_id = coupons.id)
+	ELSE coupons.remaining_amount END`
+
+// CouponFilter narrows down and orders ListCoupons
+type CouponFilter struct {
+	// One of the model.CouponStatus values, empty for all
+	Status     string
+	NamePrefix string
+	// created_at or remaining_amount, prefixed with "-" for descending
+	Sort string
+}
+
+// CouponSortKey is the keyset sort key of a coupon for the given sort, it goes into the page cursor
+func CouponSortKey(coupon model.Coupon, sort string) string {
+	if strings.TrimPrefix(sort, "-") == "remaining_amount" {
+		return strconv.Itoa(coupon.RemainingAmount)
+	}
+	return coupon.CreatedAt.Format(time.RFC3339Nano)
+}
+
+// ListCoupons returns one page of coupons (up to page.Limit+1 rows).
+// RemainingAmount of the returned coupons is the real stock left, shards included.
+func (r *couponRepository) ListCoupons(ctx context.Context, filter CouponFilter, page pagination.Params) ([]model.Coupon, error) {
+	desc := strings.HasPrefix(filter.Sort, "-")
+	var sortExpr string
+	var afterKey interface{}
+	switch strings.TrimPrefix(filter.Sort, "-") {
+	case "created_at":
+		sortExpr = "coupons.created_at"
+		if page.AfterKey != "" {
+			t, err := time.Parse(time.RFC3339Nano, page.AfterKey)
+			if err != nil {
+				return nil, pagination.ErrInvalidCursor
+			}
+			afterKey = t
+		}
+	case "remaining_amount":
+		sortExpr = "(" + remainingExpr + ")"
+		if page.AfterKey != "" {
+			n, err := strconv.Atoi(page.AfterKey)
+			if err != nil {
+				return nil, pagination.ErrInvalidCursor
+			}
+			afterKey = n
+		}
+	default:
+		return nil, ErrInvalidSort
+	}
+
+	now := time.Now()
+	// The alias comes after coupons.*, so it's the one that ends up in RemainingAmount
+	q := r.db.WithContext(ctx).Model(&model.Coupon{}).
+		Select("coupons.*, (" + remainingExpr + ") AS remaining_amount")
+
+	// Mirrors model.Coupon.Status, archived wins over everything else
+	switch filter.Status {
+	case model.CouponStatusArchived:
+		q = q.Where("coupons.archived_at IS NOT NULL")
+	case model.CouponStatusExpired:
+		q = q.Where("coupons.archived_at IS NULL AND coupons.expires_at IS NOT NULL AND coupons.expires_at <= ?", now)
+	case model.CouponStatusSoldOut:
+		q = q.Where("coupons.archived_at IS NULL AND (coupons.expires_at IS NULL OR coupons.expires_at > ?) AND ("+remainingExpr+") <= 0", now)
+	case model.CouponStatusActive:
+		q = q.Where("coupons.archived_at IS NULL AND (coupons.expires_at IS NULL OR coupons.expires_at > ?) AND ("+remainingExpr+") > 0", now)
+	}
+
+	if filter.NamePrefix != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.NamePrefix)
+		q = q.Where(`coupons.name LIKE ? ESCAPE '\'`, escaped+"%")
+	}
+
+	// Keyset on (sort key, id), the id breaks ties between equal sort keys
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+	if afterKey != nil {
+		q = q.Where("("+sortExpr+", coupons.id) "+op+" (?, ?)", afterKey, page.After)
+	} else if page.After != 0 {
+		return nil, pagination.ErrInvalidCursor
+	}
+
+	var coupons []model.Coupon
+	err := q.Order(sortExpr + " " + dir).Order("coupons.id " + dir).
+		Limit(page.Limit + 1).Find(&coupons).Error
+	return coupons, err
+}
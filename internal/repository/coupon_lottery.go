@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+var (
+	ErrNotLottery       = errors.New("coupon is not a lottery coupon")
+	ErrAlreadyEntered   = errors.New("user already entered this lottery")
+	ErrEntriesClosed    = errors.New("lottery entries are closed")
+	ErrEntriesStillOpen = errors.New("lottery entries are still open")
+	ErrAlreadyDrawn     = errors.New("lottery already drawn")
+	ErrDrawNotFound     = errors.New("lottery not drawn yet")
+)
+
+// DrawWinners picks up to amount winners out of entries using a seeded RNG.
+// Entries are ordered by ID first, so the same seed over the same entries always gives the same winners.
+// math/rand's NewSource sequence is stable across Go versions, which is what makes a draw re-runnable.
+func DrawWinners(entries []model.CouponEntry, seed int64, amount int) []model.CouponEntry {
+	pool := make([]model.CouponEntry, len(entries))
+	copy(pool, entries)
+	sort.Slice(pool, func(i, j int) bool { return pool[i].ID < pool[j].ID })
+
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+
+	if amount > len(pool) {
+		amount = len(pool)
+	}
+	if amount < 0 {
+		amount = 0
+	}
+	return pool[:amount]
+}
+
+// CreateEntry records a user's entry into a lottery coupon
+func (r *couponRepository) CreateEntry(ctx context.Context, userID string, couponName string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Shared lock, so entries can't sneak in while a draw or an archive is running
+		var coupon model.Coupon
+		if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Where("name = ?", couponName).First(&coupon).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCouponNotFound
+			}
+			return err
+		}
+
+		if coupon.Mode != model.CouponModeLottery {
+			return ErrNotLottery
+		}
+		if err := checkClaimable(&coupon, time.Now()); err != nil {
+			return err
+		}
+		if coupon.DrawnAt != nil || (coupon.EntryDeadline != nil && time.Now().After(*coupon.EntryDeadline)) {
+			return ErrEntriesClosed
+		}
+
+		var user model.User
+		if err := tx.Where("user_id = ?", userID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errUnknownUser(userID)
+			}
+			return err
+		}
+
+		entry := &model.CouponEntry{
+			CouponID: coupon.ID,
+			UserID:   user.UserID,
+			Status:   model.EntryStatusPending,
+		}
+		if err := tx.Create(entry).Error; err != nil {
+			if isUniqueViolation(err) {
+				return ErrAlreadyEntered
+			}
+			return err
+		}
+
+		return nil
+	})
+}
+
+// DrawLottery closes entries and picks winners with the given seed.
+// Winners get a CouponClaims row, everyone else is marked not selected.
+func (r *couponRepository) DrawLottery(ctx context.Context, couponName string, seed int64) (*model.CouponDraw, []string, error) {
+	var draw *model.CouponDraw
+	var winnerIDs []string
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var coupon model.Coupon
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("name = ?", couponName).First(&coupon).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCouponNotFound
+			}
+			return err
+		}
+
+		if coupon.Mode != model.CouponModeLottery {
+			return ErrNotLottery
+		}
+		if coupon.DrawnAt != nil {
+			return ErrAlreadyDrawn
+		}
+		now := time.Now()
+		if err := checkClaimable(&coupon, now); err != nil {
+			return err
+		}
+		if coupon.EntryDeadline != nil && now.Before(*coupon.EntryDeadline) {
+			return ErrEntriesStillOpen
+		}
+
+		var entries []model.CouponEntry
+		if err := tx.Where("coupon_id = ?", coupon.ID).Order("id").Find(&entries).Error; err != nil {
+			return err
+		}
+
+		// Keep the stock at draw time, the coupon struct gets the new remaining amount below
+		stock := coupon.RemainingAmount
+		winners := DrawWinners(entries, seed, stock)
+		winnerEntryIDs := make([]uint, len(winners))
+		claims := make([]model.CouponClaims, len(winners))
+		winnerIDs = make([]string, len(winners))
+		var events []model.Event
+		for i, w := range winners {
+			winnerEntryIDs[i] = w.ID
+			winnerIDs[i] = w.UserID
+			claims[i] = model.CouponClaims{CouponID: coupon.ID, UserID: w.UserID}
+			events = append(events, claimEvents(&coupon, w.UserID, stock-(i+1))...)
+		}
+
+		if len(winners) > 0 {
+			if err := tx.Create(&claims).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&model.CouponEntry{}).Where("id IN ?", winnerEntryIDs).
+				Update("status", model.EntryStatusWon).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&model.CouponEntry{}).
+			Where("coupon_id = ? AND status = ?", coupon.ID, model.EntryStatusPending).
+			Update("status", model.EntryStatusNotSelected).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&coupon).Updates(map[string]interface{}{
+			"remaining_amount": stock - len(winners),
+			"drawn_at":         now,
+		}).Error; err != nil {
+			return err
+		}
+
+		draw = &model.CouponDraw{
+			CouponID:    coupon.ID,
+			Seed:        seed,
+			Stock:       stock,
+			EntryCount:  len(entries),
+			WinnerCount: len(winners),
+		}
+		if err := tx.Create(draw).Error; err != nil {
+			return err
+		}
+		return writeOutbox(tx, events...)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return draw, winnerIDs, nil
+}
+
+// GetDraw returns the draw record of a lottery coupon and all of its entries, ordered by ID
+func (r *couponRepository) GetDraw(ctx context.Context, couponName string) (*model.Coupon, *model.CouponDraw, []model.CouponEntry, error) {
+	coupon, err := r.GetCouponByName(ctx, couponName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if coupon.Mode != model.CouponModeLottery {
+		return nil, nil, nil, ErrNotLottery
+	}
+
+	var draw model.CouponDraw
+	if err := r.db.WithContext(ctx).Where("coupon_id = ?", coupon.ID).First(&draw).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil, ErrDrawNotFound
+		}
+		return nil, nil, nil, err
+	}
+
+	var entries []model.CouponEntry
+	if err := r.db.WithContext(ctx).Where("coupon_id = ?", coupon.ID).Order("id").Find(&entries).Error; err != nil {
+		return nil, nil, nil, err
+	}
+
+	return coupon, &draw, entries, nil
+}
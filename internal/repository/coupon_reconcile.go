@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// Stock problems found by reconciliation
+const (
+	// The stock left isn't Amount minus the claims
+	StockProblemMismatch = "stock_mismatch"
+	// A user holds more than one claim of the coupon
+	StockProblemDuplicateClaims = "duplicate_claims"
+	// More users hold the coupon than its Amount. Repair can't fix it, the extra claims have to be revoked by hand.
+	StockProblemOverIssued = "over_issued"
+)
+
+// StockIssue is a coupon whose stock doesn't add up with its claims
+type StockIssue struct {
+	CouponID   uint   `json:"coupon_id"`
+	CouponName string `json:"coupon_name"`
+	Amount     int    `json:"amount"`
+	// Stock left as stored, the shard sum for sharded coupons
+	Remaining int `json:"remaining_amount"`
+	Claims    int `json:"claims"`
+	// Claims beyond the first one of each user
+	DuplicateClaims int `json:"duplicate_claims"`
+	// What the stock left should be, Amount minus one claim per user (never below 0)
+	Expected int      `json:"expected_remaining"`
+	Problems []string `json:"problems"`
+	// Set once RepairStock removed the duplicate claims and stored Expected as the stock left
+	Repaired bool `json:"repaired"`
+}
+
+// check fills in Expected and Problems from the counts
+func (i *StockIssue) check() {
+	holders := i.Claims - i.DuplicateClaims
+	i.Expected = max(i.Amount-holders, 0)
+	i.Problems = nil
+	if i.Remaining != i.Expected {
+		i.Problems = append(i.Problems, StockProblemMismatch)
+	}
+	if i.DuplicateClaims > 0 {
+		i.Problems = append(i.Problems, StockProblemDuplicateClaims)
+	}
+	if holders > i.Amount {
+		i.Problems = append(i.Problems, StockProblemOverIssued)
+	}
+}
+
+// FindStockIssues checks every coupon that isn't deleted and returns the ones whose stock doesn't add up.
+// It's one statement, so it sees a consistent snapshot even while claims go on, and takes no locks.
+func (r *couponRepository) FindStockIssues(ctx context.Context) ([]StockIssue, error) {
+	var rows []struct {
+		CouponID        uint
+		CouponName      string
+		Amount          int
+		Remaining       int
+		Claims          int
+		DuplicateClaims int
+	}
+	err := r.db.WithContext(ctx).Raw(`
+		SELECT * FROM (
+			SELECT c.id AS coupon_id, c.name AS coupon_name, c.amount,
+				CASE WHEN c.shards > 1 THEN COALESCE(s.remaining, 0) ELSE c.remaining_amount END AS remaining,
+				COALESCE(cl.claims, 0) AS claims,
+				COALESCE(cl.claims - cl.holders, 0) AS duplicate_claims
+			FROM coupons c
+			LEFT JOIN (
+				SELECT coupon_id, SUM(remaining) AS remaining FROM coupon_shards GROUP BY coupon_id
+			) s ON s.coupon_id = c.id
+			LEFT JOIN (
+				SELECT coupon_id, COUNT(*) AS claims, COUNT(DISTINCT user_id) AS holders FROM coupon_claims GROUP BY coupon_id
+			) cl ON cl.coupon_id = c.id
+			WHERE c.deleted_at IS NULL
+		) stock
+		WHERE duplicate_claims > 0
+			OR claims - duplicate_claims > amount
+			OR remaining <> GREATEST(amount - (claims - duplicate_claims), 0)
+		ORDER BY coupon_id`).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]StockIssue, len(rows))
+	for i, row := range rows {
+		issues[i] = StockIssue{
+			CouponID:        row.CouponID,
+			CouponName:      row.CouponName,
+			Amount:          row.Amount,
+			Remaining:       row.Remaining,
+			Claims:          row.Claims,
+			DuplicateClaims: row.DuplicateClaims,
+		}
+		issues[i].check()
+	}
+	return issues, nil
+}
+
+// RepairStock checks the coupon again under its claim lock and row locks, and if its stock doesn't add up
+// deletes the duplicate claims (keeping each user's first one) and stores the expected stock left.
+// The returned issue holds the counts from before the repair, its Problems are empty if there was nothing to fix.
+// The repair writes a coupon.reconciled event.
+func (r *couponRepository) RepairStock(ctx context.Context, name string) (*StockIssue, error) {
+	// The claim lock keeps fcfs claims and batches out, the row locks below keep sharded claims out
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s", name))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var issue *StockIssue
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		coupon, err := lockCoupon(tx, name, "")
+		if err != nil {
+			return err
+		}
+
+		remaining := coupon.RemainingAmount
+		var shards []model.CouponShard
+		if coupon.Shards > 1 {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("coupon_id = ?", coupon.ID).Order("shard_index").Find(&shards).Error
+			if err != nil {
+				return err
+			}
+			remaining = 0
+			for _, shard := range shards {
+				remaining += shard.Remaining
+			}
+		}
+
+		var counts struct {
+			Claims  int
+			Holders int
+		}
+		err = tx.Raw("SELECT COUNT(*) AS claims, COUNT(DISTINCT user_id) AS holders FROM coupon_claims WHERE coupon_id = ?", coupon.ID).
+			Scan(&counts).Error
+		if err != nil {
+			return err
+		}
+
+		issue = &StockIssue{
+			CouponID:        coupon.ID,
+			CouponName:      coupon.Name,
+			Amount:          coupon.Amount,
+			Remaining:       remaining,
+			Claims:          counts.Claims,
+			DuplicateClaims: counts.Claims - counts.Holders,
+		}
+		issue.check()
+		if len(issue.Problems) == 0 {
+			return nil
+		}
+
+		if issue.DuplicateClaims > 0 {
+			err := tx.Exec(`DELETE FROM coupon_claims WHERE coupon_id = ? AND id NOT IN (
+				SELECT MIN(id) FROM coupon_claims WHERE coupon_id = ? GROUP BY user_id
+			)`, coupon.ID, coupon.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		if issue.Remaining != issue.Expected {
+			if coupon.Shards == 1 {
+				err = tx.Model(coupon).Update("remaining_amount", issue.Expected).Error
+			} else {
+				err = spreadStock(tx, coupon.ID, shards, issue.Expected)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		issue.Repaired = true
+		return writeOutbox(tx, reconciledEvent(coupon, issue.Expected))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return issue, nil
+}
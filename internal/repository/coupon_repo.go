@@ -6,10 +6,11 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
 )
 
 var (
@@ -17,46 +18,127 @@ var (
 	ErrCouponAlreadyExists = errors.New("coupon already exists")
 	ErrNoStock             = errors.New("no stock available")
 	ErrAlreadyClaimed      = errors.New("coupon already claimed by user")
+	ErrCouponArchived      = errors.New("coupon is archived")
+	ErrCouponNotStarted    = errors.New("coupon is not claimable yet")
+	ErrCouponExpired       = errors.New("coupon expired")
 )
 
-type CouponRepository struct {
-	db    *gorm.DB
-	redis *redis.Client
+// checkClaimable rejects claims of an archived coupon, or outside its claim window. The claim paths call it on the
+// row read under the coupon's lock, so a claim racing an archive or an edit of the window sees its outcome.
+func checkClaimable(coupon *model.Coupon, now time.Time) error {
+	switch {
+	case coupon.ArchivedAt != nil:
+		return ErrCouponArchived
+	case coupon.StartsAt != nil && now.Before(*coupon.StartsAt):
+		return ErrCouponNotStarted
+	case coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt):
+		return ErrCouponExpired
+	}
+	return nil
+}
+
+// CouponRepository stores coupons with their claims, lottery entries and templates.
+// Methods return the Err* values of this package for the cases callers handle.
+type CouponRepository interface {
+	CreateCoupon(ctx context.Context, coupon *model.Coupon) (*model.Coupon, error)
+	// CreateCoupons creates the coupons in one transaction with a savepoint per coupon, returning one error (or nil)
+	// per coupon: a coupon that fails is rolled back alone and the others still commit. When the returned error is
+	// set the transaction as a whole failed and nothing was created.
+	CreateCoupons(ctx context.Context, coupons []*model.Coupon) ([]error, error)
+	GetCouponByName(ctx context.Context, name string) (*model.Coupon, error)
+	// FindCouponsByName returns every coupon that has or had the name, deleted ones included, oldest first
+	FindCouponsByName(ctx context.Context, name string) ([]model.Coupon, error)
+	GetCouponDetails(ctx context.Context, name string, page pagination.Params) (*model.Coupon, []model.CouponClaims, error)
+	ListCoupons(ctx context.Context, filter CouponFilter, page pagination.Params) ([]model.Coupon, error)
+	RemainingStock(ctx context.Context, coupon *model.Coupon) (int, error)
+	UpdateCoupon(ctx context.Context, name string, ifMatch string, patch CouponPatch) (*model.Coupon, error)
+	SetArchived(ctx context.Context, name string, ifMatch string, archived bool) (*model.Coupon, error)
+	DeleteCoupon(ctx context.Context, name string, ifMatch string) error
+
+	// Claims return the stock left right after the claim
+	ClaimCoupon(ctx context.Context, userID string, couponName string) (int, error)
+	ClaimShardedCoupon(ctx context.Context, userID string, coupon *model.Coupon) (int, error)
+	ClaimCouponBatch(ctx context.Context, couponName string, userIDs []string) ([]BatchClaimResult, error)
+	ListClaims(ctx context.Context, name string, page pagination.Params) ([]model.CouponClaims, error)
+	ListUserClaims(ctx context.Context, userRef string, page pagination.Params) (*model.User, []model.CouponClaims, error)
+	ExportClaims(ctx context.Context, filter ClaimExportFilter, columns []string, row func(values []interface{}) error) error
+
+	// Stock reconciliation
+	FindStockIssues(ctx context.Context) ([]StockIssue, error)
+	RepairStock(ctx context.Context, name string) (*StockIssue, error)
+
+	// Lottery
+	CreateEntry(ctx context.Context, userID string, couponName string) error
+	DrawLottery(ctx context.Context, couponName string, seed int64) (*model.CouponDraw, []string, error)
+	GetDraw(ctx context.Context, couponName string) (*model.Coupon, *model.CouponDraw, []model.CouponEntry, error)
+
+	// Templates
+	CreateTemplate(ctx context.Context, template *model.CouponTemplate) error
+	ListTemplates(ctx context.Context) ([]model.CouponTemplate, error)
+	GetTemplate(ctx context.Context, name string) (*model.CouponTemplate, error)
+	DeleteTemplate(ctx context.Context, name string) error
 }
 
-func NewCouponRepository(db *gorm.DB, redisClient *redis.Client) *CouponRepository {
-	return &CouponRepository{
+type couponRepository struct {
+	db *gorm.DB
+	// Claims of a coupon (or of a shard) take its lock before the transaction
+	locks Locker
+}
+
+func NewCouponRepository(db *gorm.DB, locks Locker) CouponRepository {
+	return &couponRepository{
 		db:    db,
-		redis: redisClient,
+		locks: locks,
 	}
 }
 
-func (r *CouponRepository) CreateCoupon(ctx context.Context, name string, amount int) (*model.Coupon, error) {
-	// Check if coupon already exists
-	var existingCoupon model.Coupon
-	err := r.db.WithContext(ctx).Where("name = ?", name).First(&existingCoupon).Error
-	if err == nil {
-		return nil, ErrCouponAlreadyExists
-	}
-	if !errors.Is(err, gorm.ErrRecordNotFound) {
+func (r *couponRepository) CreateCoupon(ctx context.Context, coupon *model.Coupon) (*model.Coupon, error) {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return createCoupon(tx, coupon)
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	// Create new coupon
-	coupon := &model.Coupon{
-		Name:            name,
-		Amount:          amount,
-		RemainingAmount: amount,
-	}
+	return coupon, nil
+}
 
-	if err := r.db.WithContext(ctx).Create(coupon).Error; err != nil {
-		return nil, err
+// setCouponDefaults prepares a new coupon for insert, every backend does the same
+func setCouponDefaults(coupon *model.Coupon) {
+	coupon.RemainingAmount = coupon.Amount
+	coupon.Version = 1
+	if coupon.Mode == "" {
+		coupon.Mode = model.CouponModeFCFS
+	}
+	// No point having shards that can never hold stock
+	if coupon.Shards > coupon.Amount {
+		coupon.Shards = coupon.Amount
+	}
+	if coupon.Shards < 1 {
+		coupon.Shards = 1
 	}
+}
 
-	return coupon, nil
+// createCoupon fills in the defaults and writes the coupon, its shards and its created event with tx
+func createCoupon(tx *gorm.DB, coupon *model.Coupon) error {
+	setCouponDefaults(coupon)
+
+	// The partial unique index on name decides between concurrent creates, no need to look first
+	if err := tx.Create(coupon).Error; err != nil {
+		if isUniqueViolation(err) {
+			return ErrCouponAlreadyExists
+		}
+		return err
+	}
+	if coupon.Shards > 1 {
+		if err := tx.Create(splitStock(coupon)).Error; err != nil {
+			return err
+		}
+	}
+	return writeOutbox(tx, createdEvent(coupon))
 }
 
-func (r *CouponRepository) GetCouponByName(ctx context.Context, name string) (*model.Coupon, error) {
+func (r *couponRepository) GetCouponByName(ctx context.Context, name string) (*model.Coupon, error) {
 	var coupon model.Coupon
 	err := r.db.WithContext(ctx).Where("name = ?", name).First(&coupon).Error
 	if err != nil {
@@ -69,7 +151,19 @@ func (r *CouponRepository) GetCouponByName(ctx context.Context, name string) (*m
 	return &coupon, nil
 }
 
-func (r *CouponRepository) ClaimCoupon(ctx context.Context, userID string, couponName string) error {
+func (r *couponRepository) FindCouponsByName(ctx context.Context, name string) ([]model.Coupon, error) {
+	var coupons []model.Coupon
+	if err := r.db.WithContext(ctx).Unscoped().Where("name = ?", name).Order("id").Find(&coupons).Error; err != nil {
+		return nil, err
+	}
+	if len(coupons) == 0 {
+		return nil, ErrCouponNotFound
+	}
+	return coupons, nil
+}
+
+// ClaimCoupon claims the coupon for the user and returns the stock left after the claim
+func (r *couponRepository) ClaimCoupon(ctx context.Context, userID string, couponName string) (int, error) {
 	// Use Redis distributed lock for this coupon claim operation.
 	// The lock is taken per coupon, and concurrent claim attempts for the same
 	// coupon will wait until the lock becomes available (queue-like behavior).
@@ -77,51 +171,28 @@ func (r *CouponRepository) ClaimCoupon(ctx context.Context, userID string, coupo
 	// DISADVATAGE: CMIIW but this would result in a random process order, instead of sequentially from request order.
 	// in other words, not a strict FIFO.
 
-	lockKey := fmt.Sprintf("coupon_claim:%s", couponName)
-	lockValue := fmt.Sprintf("%d", time.Now().UnixNano())
-
-	// Try to acquire lock with SET NX EX, waiting while another claim is in progress.
-	for {
-		acquired, err := r.redis.SetNX(ctx, lockKey, lockValue, 30*time.Second).Result()
-		if err != nil {
-			return err
-		}
-		if acquired {
-			break
-		}
-
-		// Wait a short period before retrying, or exit if the context is done.
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(50 * time.Millisecond):
-		}
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s", couponName))
+	if err != nil {
+		return 0, err
 	}
-
-	// Ensure lock is released
-	defer func() {
-		// Use Lua script to safely delete lock only if we still own it
-		script := `
-			if redis.call("GET", KEYS[1]) == ARGV[1] then
-				return redis.call("DEL", KEYS[1])
-			else
-				return 0
-			end
-		`
-		r.redis.Eval(ctx, script, []string{lockKey}, lockValue)
-	}()
+	defer release()
 
 	// Start database transaction
-	return r.db.Transaction(func(tx *gorm.DB) error {
+	var remaining int
+	err = r.db.Transaction(func(tx *gorm.DB) error {
 		// Get coupon with pessimistic lock
+		// (gorm v2 ignores the old "gorm:query_option" setting, it needs the locking clause)
 		var coupon model.Coupon
-		if err := tx.WithContext(ctx).Set("gorm:query_option", "FOR UPDATE").
+		if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).
 			Where("name = ?", couponName).First(&coupon).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				return ErrCouponNotFound
 			}
 			return err
 		}
+		if err := checkClaimable(&coupon, time.Now()); err != nil {
+			return err
+		}
 
 		// Check if there's stock available
 		if coupon.RemainingAmount <= 0 {
@@ -132,7 +203,7 @@ func (r *CouponRepository) ClaimCoupon(ctx context.Context, userID string, coupo
 		var user model.User
 		if err := tx.WithContext(ctx).Where("user_id = ?", userID).First(&user).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return fmt.Errorf("user not found: %s", userID)
+				return errUnknownUser(userID)
 			}
 			return err
 		}
@@ -158,16 +229,25 @@ func (r *CouponRepository) ClaimCoupon(ctx context.Context, userID string, coupo
 		}
 
 		// Update remaining amount
+		remaining = coupon.RemainingAmount - 1
 		if err := tx.WithContext(ctx).Model(&coupon).
-			Update("remaining_amount", coupon.RemainingAmount-1).Error; err != nil {
+			Update("remaining_amount", remaining).Error; err != nil {
 			return err
 		}
 
-		return nil
+		// Events go out through the outbox, so they're only published if this commits
+		return writeOutbox(tx.WithContext(ctx), claimEvents(&coupon, user.UserID, remaining)...)
 	})
+	if err != nil {
+		return 0, err
+	}
+
+	return remaining, nil
 }
 
-func (r *CouponRepository) GetCouponDetails(ctx context.Context, name string) (*model.Coupon, []string, error) {
+// GetCouponDetails returns the coupon and one page of its claims, oldest first.
+// Up to page.Limit+1 claims are returned, so the caller can tell whether there's a next page.
+func (r *couponRepository) GetCouponDetails(ctx context.Context, name string, page pagination.Params) (*model.Coupon, []model.CouponClaims, error) {
 	var coupon model.Coupon
 	err := r.db.WithContext(ctx).Where("name = ?", name).First(&coupon).Error
 	if err != nil {
@@ -177,17 +257,34 @@ func (r *CouponRepository) GetCouponDetails(ctx context.Context, name string) (*
 		return nil, nil, err
 	}
 
-	// Get all users who claimed this coupon
-	var claims []model.CouponClaims
-	err = r.db.WithContext(ctx).Preload("User").Where("coupon_id = ?", coupon.ID).Find(&claims).Error
+	claims, err := r.listClaims(ctx, coupon.ID, page)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	claimedBy := make([]string, len(claims))
-	for i, claim := range claims {
-		claimedBy[i] = claim.User.UserID
+	if coupon.Shards > 1 {
+		remaining, err := shardedRemaining(r.db.WithContext(ctx), coupon.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		coupon.RemainingAmount = remaining
+	}
+
+	return &coupon, claims, nil
+}
+
+// ListClaims returns one page of the claims of a coupon, oldest first (up to page.Limit+1 rows)
+func (r *couponRepository) ListClaims(ctx context.Context, name string, page pagination.Params) ([]model.CouponClaims, error) {
+	coupon, err := r.GetCouponByName(ctx, name)
+	if err != nil {
+		return nil, err
 	}
+	return r.listClaims(ctx, coupon.ID, page)
+}
 
-	return &coupon, claimedBy, nil
+func (r *couponRepository) listClaims(ctx context.Context, couponID uint, page pagination.Params) ([]model.CouponClaims, error) {
+	var claims []model.CouponClaims
+	err := r.db.WithContext(ctx).Where("coupon_id = ? AND id > ?", couponID, page.After).
+		Order("id").Limit(page.Limit + 1).Find(&claims).Error
+	return claims, err
 }
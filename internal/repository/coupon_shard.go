@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// splitStock spreads the coupon amount evenly across its shards, the first shards get the leftovers
+func splitStock(coupon *model.Coupon) []model.CouponShard {
+	shards := make([]model.CouponShard, coupon.Shards)
+	for i := range shards {
+		shards[i] = model.CouponShard{
+			CouponID:   coupon.ID,
+			ShardIndex: i,
+			Remaining:  coupon.Amount / coupon.Shards,
+		}
+		if i < coupon.Amount%coupon.Shards {
+			shards[i].Remaining++
+		}
+	}
+	return shards
+}
+
+// shardFor routes a user to a shard. The same user always lands on the same shard,
+// so their concurrent attempts are serialized by the same shard lock.
+func shardFor(userID string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// RemainingStock returns the stock left of a coupon, summing the shards of sharded coupons
+func (r *couponRepository) RemainingStock(ctx context.Context, coupon *model.Coupon) (int, error) {
+	if coupon.Shards > 1 {
+		return shardedRemaining(r.db.WithContext(ctx), coupon.ID)
+	}
+	return coupon.RemainingAmount, nil
+}
+
+func shardedRemaining(db *gorm.DB, couponID uint) (int, error) {
+	var remaining int
+	err := db.Model(&model.CouponShard{}).
+		Where("coupon_id = ?", couponID).
+		Select("COALESCE(SUM(remaining), 0)").Scan(&remaining).Error
+	return remaining, err
+}
+
+// ClaimShardedCoupon claims a coupon whose stock is split across shards.
+// Only the user's shard is locked, so claims routed to different shards run in parallel.
+// If the user's shard is empty, stock is borrowed from the sibling shards.
+// The returned stock left is summed after commit, so it can lag behind claims on other shards.
+//
+// Sold out can't always be decided inside the transaction, two shards emptying at the same time would each still
+// see the other's unit. So when the claim didn't see the stock reach 0 it's checked again after commit, and
+// shardedSoldOutEvent's ID dedupes the racing writes. A failure of that check only means a missed sold out
+// event, it's logged and the claim, already committed, still succeeds.
+func (r *couponRepository) ClaimShardedCoupon(ctx context.Context, userID string, coupon *model.Coupon) (int, error) {
+	shard := shardFor(userID, coupon.Shards)
+
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s:%d", coupon.Name, shard))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var remaining int
+	var soldOut bool
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// coupon was read before the lock. Read it again with a share lock, claims on other shards don't wait on it
+		// but an archive or edit (which lock it for update) is ordered with this claim.
+		var current model.Coupon
+		if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&current, coupon.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrCouponNotFound
+			}
+			return err
+		}
+		if err := checkClaimable(&current, time.Now()); err != nil {
+			return err
+		}
+
+		// Get user by user_id
+		var user model.User
+		if err := tx.Where("user_id = ?", userID).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errUnknownUser(userID)
+			}
+			return err
+		}
+
+		// Check if user already claimed this coupon
+		var existingClaim model.CouponClaims
+		err := tx.Where("coupon_id = ? AND user_id = ?", coupon.ID, user.UserID).First(&existingClaim).Error
+		if err == nil {
+			return ErrAlreadyClaimed
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// Take one from our own shard first, then walk the siblings.
+		// The conditional update is what keeps the total from going over Amount,
+		// borrowing doesn't need the sibling's redis lock.
+		taken := false
+		for i := 0; i < coupon.Shards && !taken; i++ {
+			res := tx.Model(&model.CouponShard{}).
+				Where("coupon_id = ? AND shard_index = ? AND remaining > 0", coupon.ID, (shard+i)%coupon.Shards).
+				Update("remaining", gorm.Expr("remaining - 1"))
+			if res.Error != nil {
+				return res.Error
+			}
+			taken = res.RowsAffected == 1
+		}
+		if !taken {
+			return ErrNoStock
+		}
+
+		// Create the claim, the unique index is the last line of defence for one claim per user
+		claim := &model.CouponClaims{
+			CouponID: coupon.ID,
+			UserID:   user.UserID,
+		}
+		if err := tx.Create(claim).Error; err != nil {
+			if isUniqueViolation(err) {
+				return ErrAlreadyClaimed
+			}
+			return err
+		}
+
+		stock, err := shardedStock(tx, coupon.ID)
+		if err != nil {
+			return err
+		}
+		remaining = stock.Remaining
+		events := []model.Event{claimedEvent(coupon, user.UserID, remaining)}
+		if remaining == 0 {
+			soldOut = true
+			events = append(events, shardedSoldOutEvent(coupon, stock.LastClaimID))
+		}
+		return writeOutbox(tx, events...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if soldOut {
+		return 0, nil
+	}
+
+	stock, err := shardedStock(r.db.WithContext(ctx), coupon.ID)
+	if err != nil {
+		log.Printf("sharded claim of %s: failed to check for sold out: %v", coupon.Name, err)
+		return remaining, nil
+	}
+	if stock.Remaining == 0 {
+		if err := writeOutbox(r.db.WithContext(ctx), shardedSoldOutEvent(coupon, stock.LastClaimID)); err != nil {
+			log.Printf("sharded claim of %s: failed to write sold out event: %v", coupon.Name, err)
+		}
+	}
+	return stock.Remaining, nil
+}
+
+type shardStock struct {
+	Remaining   int
+	LastClaimID uint
+}
+
+// shardedStock reads the stock left and the newest claim of a sharded coupon in one snapshot
+func shardedStock(db *gorm.DB, couponID uint) (shardStock, error) {
+	var stock shardStock
+	err := db.Raw(`SELECT
+			(SELECT COALESCE(SUM(remaining), 0) FROM coupon_shards WHERE coupon_id = ?) AS remaining,
+			(SELECT COALESCE(MAX(id), 0) FROM coupon_claims WHERE coupon_id = ?) AS last_claim_id`,
+		couponID, couponID).Scan(&stock).Error
+	return stock, err
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+var (
+	ErrTemplateNotFound      = errors.New("coupon template not found")
+	ErrTemplateAlreadyExists = errors.New("coupon template already exists")
+)
+
+func (r *couponRepository) CreateTemplate(ctx context.Context, template *model.CouponTemplate) error {
+	if template.Mode == "" {
+		template.Mode = model.CouponModeFCFS
+	}
+	if template.Shards < 1 {
+		template.Shards = 1
+	}
+
+	err := r.db.WithContext(ctx).Create(template).Error
+	if isUniqueViolation(err) {
+		return ErrTemplateAlreadyExists
+	}
+	return err
+}
+
+func (r *couponRepository) ListTemplates(ctx context.Context) ([]model.CouponTemplate, error) {
+	var templates []model.CouponTemplate
+	err := r.db.WithContext(ctx).Order("name").Find(&templates).Error
+	return templates, err
+}
+
+func (r *couponRepository) GetTemplate(ctx context.Context, name string) (*model.CouponTemplate, error) {
+	var template model.CouponTemplate
+	err := r.db.WithContext(ctx).Where("name = ?", name).First(&template).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTemplateNotFound
+		}
+		return nil, err
+	}
+	return &template, nil
+}
+
+// DeleteTemplate deletes the template only, coupons created from it are independent of it
+func (r *couponRepository) DeleteTemplate(ctx context.Context, name string) error {
+	res := r.db.WithContext(ctx).Where("name = ?", name).Delete(&model.CouponTemplate{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// CreateCoupons creates the coupons in one transaction and returns the error of each, in order.
+// Every coupon gets its own savepoint, so a duplicate name only drops that coupon and the others still commit.
+// The returned error is for the transaction as a whole, nothing was created when it's set.
+func (r *couponRepository) CreateCoupons(ctx context.Context, coupons []*model.Coupon) ([]error, error) {
+	errs := make([]error, len(coupons))
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, coupon := range coupons {
+			errs[i] = tx.Transaction(func(tx *gorm.DB) error {
+				return createCoupon(tx, coupon)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
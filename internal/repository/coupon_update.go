@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+var (
+	ErrPreconditionFailed = errors.New("coupon was modified, ETag does not match")
+	ErrAmountBelowClaimed = errors.New("amount can't go below the number of claims")
+	ErrInvalidWindow      = errors.New("expires_at must be after starts_at")
+)
+
+// CouponPatch holds the editable fields of a coupon, nil fields are left as they are
+type CouponPatch struct {
+	Name          *string
+	Amount        *int
+	StartsAt      *time.Time
+	ExpiresAt     *time.Time
+	EntryDeadline *time.Time
+}
+
+// matchesETag reports whether an If-Match header value matches etag. Empty means no precondition.
+func matchesETag(ifMatch string, etag string) bool {
+	if ifMatch == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// lockCoupon loads the coupon FOR UPDATE and checks it against ifMatch
+func lockCoupon(tx *gorm.DB, name string, ifMatch string) (*model.Coupon, error) {
+	var coupon model.Coupon
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&coupon).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCouponNotFound
+		}
+		return nil, err
+	}
+	if !matchesETag(ifMatch, coupon.ETag()) {
+		return nil, ErrPreconditionFailed
+	}
+	return &coupon, nil
+}
+
+// UpdateCoupon applies patch to the coupon, under its row lock so it orders with claims.
+// Changing the amount moves the stock left by the same delta. Raising it writes a coupon.restocked event,
+// lowering it to the number of claims writes coupon.sold_out.
+func (r *couponRepository) UpdateCoupon(ctx context.Context, name string, ifMatch string, patch CouponPatch) (*model.Coupon, error) {
+	var coupon *model.Coupon
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		coupon, err = lockCoupon(tx, name, ifMatch)
+		if err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if patch.Name != nil && *patch.Name != coupon.Name {
+			updates["name"] = *patch.Name
+		}
+
+		startsAt, expiresAt := coupon.StartsAt, coupon.ExpiresAt
+		if patch.StartsAt != nil {
+			startsAt = patch.StartsAt
+			updates["starts_at"] = patch.StartsAt
+		}
+		if patch.ExpiresAt != nil {
+			expiresAt = patch.ExpiresAt
+			updates["expires_at"] = patch.ExpiresAt
+		}
+		if startsAt != nil && expiresAt != nil && !expiresAt.After(*startsAt) {
+			return ErrInvalidWindow
+		}
+		if patch.EntryDeadline != nil {
+			if coupon.Mode != model.CouponModeLottery {
+				return ErrNotLottery
+			}
+			updates["entry_deadline"] = patch.EntryDeadline
+		}
+
+		var events []model.Event
+		if patch.Amount != nil && *patch.Amount != coupon.Amount {
+			remaining, err := resizeStock(tx, coupon, *patch.Amount)
+			if err != nil {
+				return err
+			}
+			updates["amount"] = *patch.Amount
+			if coupon.Shards == 1 {
+				updates["remaining_amount"] = remaining
+			}
+
+			raised := *patch.Amount > coupon.Amount
+			coupon.Amount = *patch.Amount
+			if raised {
+				events = append(events, restockedEvent(coupon, remaining))
+			} else if remaining == 0 {
+				events = append(events, soldOutEvent(coupon))
+			}
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		updates["version"] = coupon.Version + 1
+		if err := tx.Model(coupon).Updates(updates).Error; err != nil {
+			// A rename onto a live coupon's name hits the partial unique index
+			if isUniqueViolation(err) {
+				return ErrCouponAlreadyExists
+			}
+			return err
+		}
+		return writeOutbox(tx, events...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+// resizeStock moves the stock left of a coupon by the change of its amount, and returns the new stock left.
+// Sharded coupons get the change spread over their locked shards.
+func resizeStock(tx *gorm.DB, coupon *model.Coupon, amount int) (int, error) {
+	if coupon.Mode == model.CouponModeLottery && coupon.DrawnAt != nil {
+		return 0, ErrAlreadyDrawn
+	}
+
+	if coupon.Shards == 1 {
+		remaining := coupon.RemainingAmount + amount - coupon.Amount
+		if remaining < 0 {
+			return 0, ErrAmountBelowClaimed
+		}
+		return remaining, nil
+	}
+
+	var shards []model.CouponShard
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("coupon_id = ?", coupon.ID).Order("shard_index").Find(&shards).Error
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, shard := range shards {
+		total += shard.Remaining
+	}
+	remaining := total + amount - coupon.Amount
+	if remaining < 0 {
+		return 0, ErrAmountBelowClaimed
+	}
+
+	if err := spreadStock(tx, coupon.ID, shards, remaining); err != nil {
+		return 0, err
+	}
+	return remaining, nil
+}
+
+// spreadStock stores remaining as the stock left of the locked shards, spread evenly like splitStock does on create
+func spreadStock(tx *gorm.DB, couponID uint, shards []model.CouponShard, remaining int) error {
+	for i, shard := range shards {
+		share := remaining / len(shards)
+		if i < remaining%len(shards) {
+			share++
+		}
+		if share == shard.Remaining {
+			continue
+		}
+		err := tx.Model(&model.CouponShard{}).
+			Where("coupon_id = ? AND shard_index = ?", couponID, shard.ShardIndex).
+			Update("remaining", share).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetArchived archives or unarchives the coupon. Archived coupons reject new claims,
+// everything else (details, claims, wallets, draws) keeps working.
+func (r *couponRepository) SetArchived(ctx context.Context, name string, ifMatch string, archived bool) (*model.Coupon, error) {
+	var coupon *model.Coupon
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		coupon, err = lockCoupon(tx, name, ifMatch)
+		if err != nil {
+			return err
+		}
+		if (coupon.ArchivedAt != nil) == archived {
+			return nil
+		}
+
+		var archivedAt *time.Time
+		if archived {
+			now := time.Now()
+			archivedAt = &now
+		}
+		return tx.Model(coupon).Updates(map[string]interface{}{
+			"archived_at": archivedAt,
+			"version":     coupon.Version + 1,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+// DeleteCoupon soft deletes the coupon. It can't be claimed or looked up by name anymore and the name is
+// free for a new coupon, but its claims stay and still show up in the wallets of their users.
+func (r *couponRepository) DeleteCoupon(ctx context.Context, name string, ifMatch string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		coupon, err := lockCoupon(tx, name, ifMatch)
+		if err != nil {
+			return err
+		}
+		return tx.Delete(coupon).Error
+	})
+}
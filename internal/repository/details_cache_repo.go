@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	detailsInvalidateChannel = "coupon_details:invalidate"
+	// A version only has to outlive the loads racing its invalidation
+	detailsVersionTTL = 24 * time.Hour
+)
+
+// setDetailsScript stores a page of a coupon only if the coupon wasn't invalidated since the version was read,
+// so a load that read the database before a claim can't put its result back after the claim invalidated it
+var setDetailsScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '0') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+// DetailsCacheRepository stores cached coupon details in redis. Every cached page of a coupon is a field of one
+// hash, so invalidating a coupon is one DEL. Invalidations are also published on a pub/sub channel, for
+// whatever each instance keeps in memory.
+type DetailsCacheRepository struct {
+	redis *redis.Client
+}
+
+func NewDetailsCacheRepository(redisClient *redis.Client) *DetailsCacheRepository {
+	return &DetailsCacheRepository{redis: redisClient}
+}
+
+func detailsKey(couponName string) string {
+	return "coupon_details:" + couponName
+}
+
+func detailsVersionKey(couponName string) string {
+	return "coupon_details_version:" + couponName
+}
+
+// Get returns a cached page of a coupon, nil if it isn't cached
+func (r *DetailsCacheRepository) Get(ctx context.Context, couponName string, page string) ([]byte, error) {
+	value, err := r.redis.HGet(ctx, detailsKey(couponName), page).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Version changes every time the coupon is invalidated, read it before loading what goes into Set
+func (r *DetailsCacheRepository) Version(ctx context.Context, couponName string) (string, error) {
+	version, err := r.redis.Get(ctx, detailsVersionKey(couponName)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "0", nil
+	}
+	return version, err
+}
+
+// Set caches a page of a coupon for ttl, unless the coupon was invalidated after version was read.
+// It reports whether the page was stored.
+func (r *DetailsCacheRepository) Set(ctx context.Context, couponName string, page string, value []byte, version string, ttl time.Duration) (bool, error) {
+	stored, err := setDetailsScript.Run(ctx, r.redis,
+		[]string{detailsKey(couponName), detailsVersionKey(couponName)},
+		version, page, value, ttl.Milliseconds()).Int()
+	return stored == 1, err
+}
+
+// Invalidate drops every cached page of the coupon and tells every instance about it
+func (r *DetailsCacheRepository) Invalidate(ctx context.Context, couponName string) error {
+	_, err := r.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, detailsVersionKey(couponName))
+		pipe.Expire(ctx, detailsVersionKey(couponName), detailsVersionTTL)
+		pipe.Del(ctx, detailsKey(couponName))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.redis.Publish(ctx, detailsInvalidateChannel, couponName).Err()
+}
+
+// Invalidations delivers the name of every coupon invalidated by any instance, until ctx is done
+func (r *DetailsCacheRepository) Invalidations(ctx context.Context) <-chan string {
+	names := make(chan string, 256)
+	pubsub := r.redis.Subscribe(ctx, detailsInvalidateChannel)
+
+	go func() {
+		defer close(names)
+		defer pubsub.Close()
+
+		msgs := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case names <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return names
+}
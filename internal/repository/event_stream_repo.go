@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// Redis stream keys of the event feed, see docs/events.md
+const (
+	EventStreamKey       = "coupon_events"
+	couponEventStreamKey = "coupon_events:"
+
+	// Streams are capped (approximately) so they don't grow forever, consumers that fall further behind lose events
+	eventStreamMaxLen       = 1_000_000
+	couponEventStreamMaxLen = 100_000
+)
+
+// CouponEventStreamKey is the stream holding the events of a single coupon
+func CouponEventStreamKey(couponName string) string {
+	return couponEventStreamKey + couponName
+}
+
+// EventStreamRepository appends coupon events to the global stream and to the coupon's own stream
+type EventStreamRepository struct {
+	redis *redis.Client
+}
+
+func NewEventStreamRepository(redisClient *redis.Client) *EventStreamRepository {
+	return &EventStreamRepository{redis: redisClient}
+}
+
+func (r *EventStreamRepository) Publish(ctx context.Context, event model.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{
+		"id":          event.ID,
+		"type":        event.Type,
+		"coupon_name": event.CouponName,
+		"payload":     payload,
+	}
+
+	// Both or neither, so the two streams don't drift apart
+	_, err = r.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: EventStreamKey,
+			MaxLen: eventStreamMaxLen,
+			Approx: true,
+			Values: values,
+		})
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: CouponEventStreamKey(event.CouponName),
+			MaxLen: couponEventStreamMaxLen,
+			Approx: true,
+			Values: values,
+		})
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Locker hands out the locks claims are serialized with, across every instance
+type Locker interface {
+	// Acquire takes the lock at key, waiting while someone else holds it or until ctx is done.
+	// The returned func releases the lock.
+	Acquire(ctx context.Context, key string) (release func(), err error)
+	// ReleaseAll releases every lock this instance still holds and returns how many there were.
+	// It's for shutdown, after the drain deadline cut claims off mid way.
+	ReleaseAll(ctx context.Context) int
+}
+
+// redisLocker is a Locker on SET NX with an expiry, so a crashed instance can't hold a lock forever
+type redisLocker struct {
+	redis *redis.Client
+
+	// Lock expiry, and how often a claim waiting for the lock tries again
+	ttl           time.Duration
+	retryInterval time.Duration
+
+	// Locks this instance holds right now, lock key -> lock value
+	mu   sync.Mutex
+	held map[string]string
+}
+
+func NewRedisLocker(redisClient *redis.Client, ttl, retryInterval time.Duration) Locker {
+	return &redisLocker{
+		redis:         redisClient,
+		ttl:           ttl,
+		retryInterval: retryInterval,
+		held:          make(map[string]string),
+	}
+}
+
+func (l *redisLocker) Acquire(ctx context.Context, lockKey string) (func(), error) {
+	lockValue := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	// Try to acquire lock with SET NX EX, waiting while another claim is in progress.
+	for {
+		acquired, err := l.redis.SetNX(ctx, lockKey, lockValue, l.ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+
+		// Wait a short period before retrying, or exit if the context is done.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.retryInterval):
+		}
+	}
+
+	l.mu.Lock()
+	l.held[lockKey] = lockValue
+	l.mu.Unlock()
+
+	return func() {
+		// Not ctx, a request that was cancelled mid claim still has to give the lock back
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		l.release(releaseCtx, lockKey, lockValue)
+	}, nil
+}
+
+// Deletes the lock only if we still own it
+var releaseLockScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	else
+		return 0
+	end
+`)
+
+func (l *redisLocker) release(ctx context.Context, lockKey string, lockValue string) {
+	l.mu.Lock()
+	if l.held[lockKey] == lockValue {
+		delete(l.held, lockKey)
+	}
+	l.mu.Unlock()
+
+	if err := releaseLockScript.Run(ctx, l.redis, []string{lockKey}, lockValue).Err(); err != nil {
+		log.Printf("failed to release lock %s: %v", lockKey, err)
+	}
+}
+
+// ReleaseAll is safe while the cut off claims are still running: the coupon row lock keeps them
+// in order, and other instances don't have to wait out the lock TTL.
+func (l *redisLocker) ReleaseAll(ctx context.Context) int {
+	l.mu.Lock()
+	held := l.held
+	l.held = make(map[string]string)
+	l.mu.Unlock()
+
+	for lockKey, lockValue := range held {
+		l.release(ctx, lockKey, lockValue)
+	}
+	return len(held)
+}
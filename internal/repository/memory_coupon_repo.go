@@ -0,0 +1,874 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+// memoryCouponRepository is the CouponRepository on a MemoryStore.
+// Claims take the same locks as the postgres version, so lock contention and timeouts behave the same.
+type memoryCouponRepository struct {
+	store *MemoryStore
+	locks Locker
+}
+
+func NewMemoryCouponRepository(store *MemoryStore, locks Locker) CouponRepository {
+	return &memoryCouponRepository{
+		store: store,
+		locks: locks,
+	}
+}
+
+func (r *memoryCouponRepository) CreateCoupon(ctx context.Context, coupon *model.Coupon) (*model.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.insertCoupon(coupon); err != nil {
+		return nil, err
+	}
+	return coupon, nil
+}
+
+func (r *memoryCouponRepository) CreateCoupons(ctx context.Context, coupons []*model.Coupon) ([]error, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make([]error, len(coupons))
+	for i, coupon := range coupons {
+		errs[i] = s.insertCoupon(coupon)
+	}
+	return errs, nil
+}
+
+// insertCoupon is createCoupon on the store, callers hold s.mu
+func (s *MemoryStore) insertCoupon(coupon *model.Coupon) error {
+	setCouponDefaults(coupon)
+	if s.couponIndex(coupon.Name) >= 0 {
+		return ErrCouponAlreadyExists
+	}
+
+	s.lastCouponID++
+	coupon.ID = s.lastCouponID
+	coupon.CreatedAt = s.now()
+	coupon.UpdatedAt = coupon.CreatedAt
+	s.coupons = append(s.coupons, copyCoupon(*coupon))
+
+	if coupon.Shards > 1 {
+		shards := splitStock(coupon)
+		stock := make([]int, len(shards))
+		for i, shard := range shards {
+			stock[i] = shard.Remaining
+		}
+		s.shards[coupon.ID] = stock
+	}
+	return nil
+}
+
+func (r *memoryCouponRepository) GetCouponByName(ctx context.Context, name string) (*model.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(name)
+	if i < 0 {
+		return nil, ErrCouponNotFound
+	}
+	coupon := copyCoupon(s.coupons[i])
+	return &coupon, nil
+}
+
+func (r *memoryCouponRepository) FindCouponsByName(ctx context.Context, name string) ([]model.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var coupons []model.Coupon
+	for _, coupon := range s.coupons {
+		if coupon.Name == name {
+			coupons = append(coupons, copyCoupon(coupon))
+		}
+	}
+	if len(coupons) == 0 {
+		return nil, ErrCouponNotFound
+	}
+	return coupons, nil
+}
+
+func (r *memoryCouponRepository) GetCouponDetails(ctx context.Context, name string, page pagination.Params) (*model.Coupon, []model.CouponClaims, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(name)
+	if i < 0 {
+		return nil, nil, ErrCouponNotFound
+	}
+	coupon := copyCoupon(s.coupons[i])
+	coupon.RemainingAmount = s.remaining(i)
+	return &coupon, s.listClaims(coupon.ID, page), nil
+}
+
+func (r *memoryCouponRepository) ListCoupons(ctx context.Context, filter CouponFilter, page pagination.Params) ([]model.Coupon, error) {
+	desc := strings.HasPrefix(filter.Sort, "-")
+	sortBy := strings.TrimPrefix(filter.Sort, "-")
+	switch sortBy {
+	case "created_at":
+		if page.AfterKey != "" {
+			if _, err := time.Parse(time.RFC3339Nano, page.AfterKey); err != nil {
+				return nil, pagination.ErrInvalidCursor
+			}
+		}
+	case "remaining_amount":
+		if page.AfterKey != "" {
+			if _, err := strconv.Atoi(page.AfterKey); err != nil {
+				return nil, pagination.ErrInvalidCursor
+			}
+		}
+	default:
+		return nil, ErrInvalidSort
+	}
+	if page.AfterKey == "" && page.After != 0 {
+		return nil, pagination.ErrInvalidCursor
+	}
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var coupons []model.Coupon
+	for i := range s.coupons {
+		if s.coupons[i].DeletedAt.Valid {
+			continue
+		}
+		coupon := copyCoupon(s.coupons[i])
+		coupon.RemainingAmount = s.remaining(i)
+		if filter.Status != "" && coupon.Status(coupon.RemainingAmount, now) != filter.Status {
+			continue
+		}
+		if !strings.HasPrefix(coupon.Name, filter.NamePrefix) {
+			continue
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	// Keyset on (sort key, id), the id breaks ties between equal sort keys
+	compare := func(a, b model.Coupon) int {
+		var c int
+		if sortBy == "remaining_amount" {
+			c = a.RemainingAmount - b.RemainingAmount
+		} else {
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		}
+		if c == 0 {
+			c = int(a.ID) - int(b.ID)
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	}
+	sort.Slice(coupons, func(i, j int) bool { return compare(coupons[i], coupons[j]) < 0 })
+
+	if page.AfterKey != "" {
+		// The row the cursor points at, only its sort key and ID matter
+		var after model.Coupon
+		after.ID = page.After
+		if sortBy == "remaining_amount" {
+			after.RemainingAmount, _ = strconv.Atoi(page.AfterKey)
+		} else {
+			after.CreatedAt, _ = time.Parse(time.RFC3339Nano, page.AfterKey)
+		}
+		start := sort.Search(len(coupons), func(i int) bool { return compare(coupons[i], after) > 0 })
+		coupons = coupons[start:]
+	}
+
+	if len(coupons) > page.Limit+1 {
+		coupons = coupons[:page.Limit+1]
+	}
+	return coupons, nil
+}
+
+func (r *memoryCouponRepository) RemainingStock(ctx context.Context, coupon *model.Coupon) (int, error) {
+	if coupon.Shards <= 1 {
+		return coupon.RemainingAmount, nil
+	}
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for _, n := range s.shards[coupon.ID] {
+		total += n
+	}
+	return total, nil
+}
+
+// lockCoupon is lockCoupon on the store: the live coupon with the name, checked against ifMatch.
+// Callers hold s.mu.
+func (s *MemoryStore) lockCoupon(name string, ifMatch string) (int, error) {
+	i := s.couponIndex(name)
+	if i < 0 {
+		return -1, ErrCouponNotFound
+	}
+	if !matchesETag(ifMatch, s.coupons[i].ETag()) {
+		return -1, ErrPreconditionFailed
+	}
+	return i, nil
+}
+
+// UpdateCoupon checks everything before changing anything, like the postgres version rolling back
+func (r *memoryCouponRepository) UpdateCoupon(ctx context.Context, name string, ifMatch string, patch CouponPatch) (*model.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.lockCoupon(name, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	updated := copyCoupon(s.coupons[i])
+	changed := false
+
+	if patch.Name != nil && *patch.Name != updated.Name {
+		updated.Name = *patch.Name
+		changed = true
+	}
+	if patch.StartsAt != nil {
+		updated.StartsAt = patch.StartsAt
+		changed = true
+	}
+	if patch.ExpiresAt != nil {
+		updated.ExpiresAt = patch.ExpiresAt
+		changed = true
+	}
+	if updated.StartsAt != nil && updated.ExpiresAt != nil && !updated.ExpiresAt.After(*updated.StartsAt) {
+		return nil, ErrInvalidWindow
+	}
+	if patch.EntryDeadline != nil {
+		if updated.Mode != model.CouponModeLottery {
+			return nil, ErrNotLottery
+		}
+		updated.EntryDeadline = patch.EntryDeadline
+		changed = true
+	}
+
+	var shardStock []int
+	if patch.Amount != nil && *patch.Amount != updated.Amount {
+		if updated.Mode == model.CouponModeLottery && updated.DrawnAt != nil {
+			return nil, ErrAlreadyDrawn
+		}
+		remaining := s.remaining(i) + *patch.Amount - updated.Amount
+		if remaining < 0 {
+			return nil, ErrAmountBelowClaimed
+		}
+		if updated.Shards == 1 {
+			updated.RemainingAmount = remaining
+		} else {
+			shardStock = make([]int, updated.Shards)
+			spreadShards(shardStock, remaining)
+		}
+		updated.Amount = *patch.Amount
+		changed = true
+	}
+
+	if !changed {
+		return &updated, nil
+	}
+	// A rename onto a live coupon's name, the partial unique index on postgres
+	if updated.Name != s.coupons[i].Name && s.couponIndex(updated.Name) >= 0 {
+		return nil, ErrCouponAlreadyExists
+	}
+
+	updated.Version++
+	updated.UpdatedAt = s.now()
+	s.coupons[i] = copyCoupon(updated)
+	if shardStock != nil {
+		s.shards[updated.ID] = shardStock
+	}
+	return &updated, nil
+}
+
+func (r *memoryCouponRepository) SetArchived(ctx context.Context, name string, ifMatch string, archived bool) (*model.Coupon, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.lockCoupon(name, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	coupon := &s.coupons[i]
+	if (coupon.ArchivedAt != nil) != archived {
+		coupon.ArchivedAt = nil
+		if archived {
+			now := s.now()
+			coupon.ArchivedAt = &now
+		}
+		coupon.Version++
+		coupon.UpdatedAt = s.now()
+	}
+
+	updated := copyCoupon(*coupon)
+	return &updated, nil
+}
+
+func (r *memoryCouponRepository) DeleteCoupon(ctx context.Context, name string, ifMatch string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.lockCoupon(name, ifMatch)
+	if err != nil {
+		return err
+	}
+	s.coupons[i].DeletedAt = gorm.DeletedAt{Time: s.now(), Valid: true}
+	return nil
+}
+
+func (r *memoryCouponRepository) ClaimCoupon(ctx context.Context, userID string, couponName string) (int, error) {
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s", couponName))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(couponName)
+	if i < 0 {
+		return 0, ErrCouponNotFound
+	}
+	coupon := &s.coupons[i]
+	if err := checkClaimable(coupon, time.Now()); err != nil {
+		return 0, err
+	}
+	if coupon.RemainingAmount <= 0 {
+		return 0, ErrNoStock
+	}
+	if s.userIndex(userID) < 0 {
+		return 0, errUnknownUser(userID)
+	}
+	if s.claimIndex(coupon.ID, userID) >= 0 {
+		return 0, ErrAlreadyClaimed
+	}
+
+	if err := s.insertClaim(coupon.ID, userID); err != nil {
+		return 0, err
+	}
+	coupon.RemainingAmount--
+	coupon.UpdatedAt = s.now()
+	return coupon.RemainingAmount, nil
+}
+
+// ClaimShardedCoupon takes the unit from the user's shard first, then from the siblings, like the postgres version
+func (r *memoryCouponRepository) ClaimShardedCoupon(ctx context.Context, userID string, coupon *model.Coupon) (int, error) {
+	shard := shardFor(userID, coupon.Shards)
+
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s:%d", coupon.Name, shard))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// coupon was read before the lock, check the stored one
+	c := s.couponIDIndex(coupon.ID)
+	if c < 0 || s.coupons[c].DeletedAt.Valid {
+		return 0, ErrCouponNotFound
+	}
+	if err := checkClaimable(&s.coupons[c], time.Now()); err != nil {
+		return 0, err
+	}
+	if s.userIndex(userID) < 0 {
+		return 0, errUnknownUser(userID)
+	}
+	if s.claimIndex(coupon.ID, userID) >= 0 {
+		return 0, ErrAlreadyClaimed
+	}
+
+	stock := s.shards[coupon.ID]
+	taken := false
+	for i := 0; i < len(stock) && !taken; i++ {
+		if n := (shard + i) % len(stock); stock[n] > 0 {
+			stock[n]--
+			taken = true
+		}
+	}
+	if !taken {
+		return 0, ErrNoStock
+	}
+
+	if err := s.insertClaim(coupon.ID, userID); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, n := range stock {
+		total += n
+	}
+	return total, nil
+}
+
+func (r *memoryCouponRepository) ClaimCouponBatch(ctx context.Context, couponName string, userIDs []string) ([]BatchClaimResult, error) {
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s", couponName))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(couponName)
+	if i < 0 {
+		return nil, ErrCouponNotFound
+	}
+	coupon := &s.coupons[i]
+	if err := checkClaimable(coupon, time.Now()); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchClaimResult, len(userIDs))
+	for j, userID := range userIDs {
+		switch {
+		case s.userIndex(userID) < 0:
+			results[j].Err = errUnknownUser(userID)
+		case s.claimIndex(coupon.ID, userID) >= 0:
+			// Also catches the same user twice in one batch
+			results[j].Err = ErrAlreadyClaimed
+		case coupon.RemainingAmount <= 0:
+			results[j].Err = ErrNoStock
+		default:
+			if err := s.insertClaim(coupon.ID, userID); err != nil {
+				return nil, err
+			}
+			coupon.RemainingAmount--
+			coupon.UpdatedAt = s.now()
+			results[j].Remaining = coupon.RemainingAmount
+		}
+	}
+	return results, nil
+}
+
+func (r *memoryCouponRepository) ListClaims(ctx context.Context, name string, page pagination.Params) ([]model.CouponClaims, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(name)
+	if i < 0 {
+		return nil, ErrCouponNotFound
+	}
+	return s.listClaims(s.coupons[i].ID, page), nil
+}
+
+// listClaims returns up to page.Limit+1 claims of the coupon after page.After, oldest first. Callers hold s.mu.
+func (s *MemoryStore) listClaims(couponID uint, page pagination.Params) []model.CouponClaims {
+	var claims []model.CouponClaims
+	for _, claim := range s.claims {
+		if claim.CouponID == couponID && claim.ID > page.After && len(claims) < page.Limit+1 {
+			claims = append(claims, claim)
+		}
+	}
+	return claims
+}
+
+func (r *memoryCouponRepository) ListUserClaims(ctx context.Context, userRef string, page pagination.Params) (*model.User, []model.CouponClaims, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.userRefIndex(userRef)
+	if u < 0 {
+		return nil, nil, ErrUserNotFound
+	}
+	user := s.users[u]
+
+	// Newest first, with the coupon even if it was deleted since
+	var claims []model.CouponClaims
+	for i := len(s.claims) - 1; i >= 0 && len(claims) < page.Limit+1; i-- {
+		claim := s.claims[i]
+		if claim.UserID != user.UserID || (page.After != 0 && claim.ID >= page.After) {
+			continue
+		}
+		claim.Coupon = copyCoupon(s.coupons[s.couponIDIndex(claim.CouponID)])
+		claims = append(claims, claim)
+	}
+	return &user, claims, nil
+}
+
+func (r *memoryCouponRepository) ExportClaims(ctx context.Context, filter ClaimExportFilter, columns []string, row func(values []interface{}) error) error {
+	for _, column := range columns {
+		if _, ok := claimExportColumns[column]; !ok {
+			return ErrInvalidExportColumn
+		}
+	}
+
+	// Snapshot the rows first, row may be slow (it writes to the client) and must not hold the store
+	s := r.store
+	s.mu.Lock()
+	var rows [][]interface{}
+	for _, claim := range s.claims {
+		if filter.CouponIDs != nil && !slices.Contains(filter.CouponIDs, claim.CouponID) {
+			continue
+		}
+		if !filter.From.IsZero() && claim.ClaimedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !claim.ClaimedAt.Before(filter.To) {
+			continue
+		}
+		u := s.userIndex(claim.UserID)
+		if u < 0 {
+			continue
+		}
+		rows = append(rows, exportValues(columns, claim, s.users[u], s.coupons[s.couponIDIndex(claim.CouponID)]))
+	}
+	s.mu.Unlock()
+
+	for _, values := range rows {
+		if err := row(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportValues are the values of columns for one claim, typed the way pgx scans them
+func exportValues(columns []string, claim model.CouponClaims, user model.User, coupon model.Coupon) []interface{} {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "claim_id":
+			values[i] = int64(claim.ID)
+		case "code":
+			values[i] = claim.Code
+		case "claimed_at":
+			values[i] = claim.ClaimedAt
+		case "user_id":
+			values[i] = claim.UserID
+		case "user_name":
+			values[i] = user.Name
+		case "coupon_id":
+			values[i] = int64(coupon.ID)
+		case "coupon_name":
+			values[i] = coupon.Name
+		case "coupon_mode":
+			values[i] = coupon.Mode
+		case "discount_type":
+			values[i] = coupon.DiscountType
+		case "discount_value":
+			values[i] = int64(coupon.DiscountValue)
+		case "expires_at":
+			if coupon.ExpiresAt != nil {
+				values[i] = *coupon.ExpiresAt
+			}
+		}
+	}
+	return values
+}
+
+func (r *memoryCouponRepository) FindStockIssues(ctx context.Context) ([]StockIssue, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var issues []StockIssue
+	for i := range s.coupons {
+		if s.coupons[i].DeletedAt.Valid {
+			continue
+		}
+		if issue := s.stockIssue(i); len(issue.Problems) > 0 {
+			issues = append(issues, issue)
+		}
+	}
+	return issues, nil
+}
+
+func (r *memoryCouponRepository) RepairStock(ctx context.Context, name string) (*StockIssue, error) {
+	release, err := r.locks.Acquire(ctx, fmt.Sprintf("coupon_claim:%s", name))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.lockCoupon(name, "")
+	if err != nil {
+		return nil, err
+	}
+	issue := s.stockIssue(i)
+	if len(issue.Problems) == 0 {
+		return &issue, nil
+	}
+
+	// Keep the first claim of each user
+	coupon := &s.coupons[i]
+	seen := map[string]bool{}
+	claims := s.claims[:0]
+	for _, claim := range s.claims {
+		if claim.CouponID == coupon.ID {
+			if seen[claim.UserID] {
+				continue
+			}
+			seen[claim.UserID] = true
+		}
+		claims = append(claims, claim)
+	}
+	s.claims = claims
+
+	if coupon.Shards == 1 {
+		coupon.RemainingAmount = issue.Expected
+	} else {
+		spreadShards(s.shards[coupon.ID], issue.Expected)
+	}
+	issue.Repaired = true
+	return &issue, nil
+}
+
+// spreadShards spreads remaining evenly over the shards, like spreadStock
+func spreadShards(stock []int, remaining int) {
+	for i := range stock {
+		stock[i] = remaining / len(stock)
+		if i < remaining%len(stock) {
+			stock[i]++
+		}
+	}
+}
+
+// stockIssue counts the stock and claims of coupon i, Problems is empty if they add up. Callers hold s.mu.
+func (s *MemoryStore) stockIssue(i int) StockIssue {
+	coupon := s.coupons[i]
+	issue := StockIssue{
+		CouponID:   coupon.ID,
+		CouponName: coupon.Name,
+		Amount:     coupon.Amount,
+		Remaining:  s.remaining(i),
+	}
+	holders := map[string]bool{}
+	for _, claim := range s.claims {
+		if claim.CouponID == coupon.ID {
+			issue.Claims++
+			holders[claim.UserID] = true
+		}
+	}
+	issue.DuplicateClaims = issue.Claims - len(holders)
+	issue.check()
+	return issue
+}
+
+func (r *memoryCouponRepository) CreateEntry(ctx context.Context, userID string, couponName string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(couponName)
+	if i < 0 {
+		return ErrCouponNotFound
+	}
+	coupon := &s.coupons[i]
+	if coupon.Mode != model.CouponModeLottery {
+		return ErrNotLottery
+	}
+	if err := checkClaimable(coupon, time.Now()); err != nil {
+		return err
+	}
+	if coupon.DrawnAt != nil || (coupon.EntryDeadline != nil && time.Now().After(*coupon.EntryDeadline)) {
+		return ErrEntriesClosed
+	}
+	if s.userIndex(userID) < 0 {
+		return errUnknownUser(userID)
+	}
+	for _, entry := range s.entries {
+		if entry.CouponID == coupon.ID && entry.UserID == userID {
+			return ErrAlreadyEntered
+		}
+	}
+
+	s.lastEntryID++
+	s.entries = append(s.entries, model.CouponEntry{
+		ID:        s.lastEntryID,
+		CouponID:  coupon.ID,
+		UserID:    userID,
+		Status:    model.EntryStatusPending,
+		CreatedAt: s.now(),
+	})
+	return nil
+}
+
+func (r *memoryCouponRepository) DrawLottery(ctx context.Context, couponName string, seed int64) (*model.CouponDraw, []string, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(couponName)
+	if i < 0 {
+		return nil, nil, ErrCouponNotFound
+	}
+	coupon := &s.coupons[i]
+	if coupon.Mode != model.CouponModeLottery {
+		return nil, nil, ErrNotLottery
+	}
+	if coupon.DrawnAt != nil {
+		return nil, nil, ErrAlreadyDrawn
+	}
+	now := s.now()
+	if err := checkClaimable(coupon, now); err != nil {
+		return nil, nil, err
+	}
+	if coupon.EntryDeadline != nil && now.Before(*coupon.EntryDeadline) {
+		return nil, nil, ErrEntriesStillOpen
+	}
+
+	entries := s.couponEntries(coupon.ID)
+	stock := coupon.RemainingAmount
+	winners := DrawWinners(entries, seed, stock)
+	won := make(map[uint]bool, len(winners))
+	winnerIDs := make([]string, len(winners))
+	for j, w := range winners {
+		won[w.ID] = true
+		winnerIDs[j] = w.UserID
+		if err := s.insertClaim(coupon.ID, w.UserID); err != nil {
+			return nil, nil, err
+		}
+	}
+	for j := range s.entries {
+		if s.entries[j].CouponID != coupon.ID {
+			continue
+		}
+		if won[s.entries[j].ID] {
+			s.entries[j].Status = model.EntryStatusWon
+		} else if s.entries[j].Status == model.EntryStatusPending {
+			s.entries[j].Status = model.EntryStatusNotSelected
+		}
+	}
+
+	coupon.RemainingAmount = stock - len(winners)
+	coupon.DrawnAt = &now
+	coupon.UpdatedAt = now
+
+	s.lastDrawID++
+	draw := model.CouponDraw{
+		ID:          s.lastDrawID,
+		CouponID:    coupon.ID,
+		Seed:        seed,
+		Stock:       stock,
+		EntryCount:  len(entries),
+		WinnerCount: len(winners),
+		CreatedAt:   now,
+	}
+	s.draws = append(s.draws, draw)
+	return &draw, winnerIDs, nil
+}
+
+// couponEntries returns the lottery entries of a coupon ordered by ID. Callers hold s.mu.
+func (s *MemoryStore) couponEntries(couponID uint) []model.CouponEntry {
+	var entries []model.CouponEntry
+	for _, entry := range s.entries {
+		if entry.CouponID == couponID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (r *memoryCouponRepository) GetDraw(ctx context.Context, couponName string) (*model.Coupon, *model.CouponDraw, []model.CouponEntry, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.couponIndex(couponName)
+	if i < 0 {
+		return nil, nil, nil, ErrCouponNotFound
+	}
+	coupon := copyCoupon(s.coupons[i])
+	if coupon.Mode != model.CouponModeLottery {
+		return nil, nil, nil, ErrNotLottery
+	}
+	for _, draw := range s.draws {
+		if draw.CouponID == coupon.ID {
+			return &coupon, &draw, s.couponEntries(coupon.ID), nil
+		}
+	}
+	return nil, nil, nil, ErrDrawNotFound
+}
+
+func (r *memoryCouponRepository) CreateTemplate(ctx context.Context, template *model.CouponTemplate) error {
+	if template.Mode == "" {
+		template.Mode = model.CouponModeFCFS
+	}
+	if template.Shards < 1 {
+		template.Shards = 1
+	}
+
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.templateIndex(template.Name) >= 0 {
+		return ErrTemplateAlreadyExists
+	}
+	s.lastTemplateID++
+	template.ID = s.lastTemplateID
+	template.CreatedAt = s.now()
+	s.templates = append(s.templates, *template)
+	return nil
+}
+
+func (r *memoryCouponRepository) ListTemplates(ctx context.Context) ([]model.CouponTemplate, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templates := append([]model.CouponTemplate(nil), s.templates...)
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+func (r *memoryCouponRepository) GetTemplate(ctx context.Context, name string) (*model.CouponTemplate, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.templateIndex(name)
+	if i < 0 {
+		return nil, ErrTemplateNotFound
+	}
+	template := s.templates[i]
+	return &template, nil
+}
+
+func (r *memoryCouponRepository) DeleteTemplate(ctx context.Context, name string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.templateIndex(name)
+	if i < 0 {
+		return ErrTemplateNotFound
+	}
+	s.templates = append(s.templates[:i], s.templates[i+1:]...)
+	return nil
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryLocker is a Locker for a single process, for tests and local runs without redis.
+// Locks don't expire, there's no other instance that could crash while holding one.
+type memoryLocker struct {
+	mu sync.Mutex
+	// Lock key -> channel closed on release
+	held map[string]chan struct{}
+}
+
+func NewMemoryLocker() Locker {
+	return &memoryLocker{held: make(map[string]chan struct{})}
+}
+
+func (l *memoryLocker) Acquire(ctx context.Context, lockKey string) (func(), error) {
+	for {
+		l.mu.Lock()
+		released, taken := l.held[lockKey]
+		if !taken {
+			mine := make(chan struct{})
+			l.held[lockKey] = mine
+			l.mu.Unlock()
+
+			var once sync.Once
+			return func() { once.Do(func() { l.release(lockKey, mine) }) }, nil
+		}
+		l.mu.Unlock()
+
+		// Wait for the holder, then race the other waiters for it like SET NX does
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (l *memoryLocker) release(lockKey string, mine chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Only if we still own it, ReleaseAll may have taken it away already
+	if l.held[lockKey] == mine {
+		delete(l.held, lockKey)
+		close(mine)
+	}
+}
+
+func (l *memoryLocker) ReleaseAll(ctx context.Context) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(l.held)
+	for lockKey, ch := range l.held {
+		delete(l.held, lockKey)
+		close(ch)
+	}
+	return n
+}
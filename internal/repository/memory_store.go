@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// MemoryStore holds the data of the in-memory repositories, the stand-in for the database in tests.
+// Users and coupons share one store since claims tie them together, e.g. deleting a user returns stock.
+//
+// Every repository call holds the store lock for its whole duration, which gives it the atomicity of a
+// transaction. Rows are copied in and out, so callers can't change stored data by holding on to a result.
+// There's no outbox, the in-memory repositories don't write events.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	// Rows in ID order, deleted coupons included (soft delete)
+	users     []model.User
+	coupons   []model.Coupon
+	claims    []model.CouponClaims
+	entries   []model.CouponEntry
+	draws     []model.CouponDraw
+	templates []model.CouponTemplate
+	// Stock left of each shard of a sharded coupon, by coupon ID
+	shards map[uint][]int
+
+	// Last ID handed out per table, like a postgres sequence
+	lastUserID, lastCouponID, lastClaimID, lastEntryID, lastDrawID, lastTemplateID uint
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{shards: make(map[uint][]int)}
+}
+
+// now is a timestamp as postgres stores it, in microseconds.
+// Keeps cursors built from timestamps (see CouponSortKey) behaving the same on both backends.
+func (s *MemoryStore) now() time.Time {
+	return time.Now().Round(time.Microsecond)
+}
+
+// Lookups return the index of the row, or -1. Callers hold s.mu.
+
+func (s *MemoryStore) userIndex(userID string) int {
+	for i := range s.users {
+		if s.users[i].UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// userRefIndex is findUserByRef: the user_id first, then the numeric ID
+func (s *MemoryStore) userRefIndex(ref string) int {
+	if i := s.userIndex(ref); i >= 0 {
+		return i
+	}
+	if id, ok := parseID(ref); ok {
+		return s.userIDIndex(id)
+	}
+	return -1
+}
+
+func (s *MemoryStore) userIDIndex(id uint) int {
+	i := sort.Search(len(s.users), func(i int) bool { return s.users[i].ID >= id })
+	if i < len(s.users) && s.users[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+// couponIndex finds the live coupon with the name, deleted coupons don't count
+func (s *MemoryStore) couponIndex(name string) int {
+	for i := range s.coupons {
+		if s.coupons[i].Name == name && !s.coupons[i].DeletedAt.Valid {
+			return i
+		}
+	}
+	return -1
+}
+
+// couponIDIndex finds a coupon by ID, deleted or not
+func (s *MemoryStore) couponIDIndex(id uint) int {
+	i := sort.Search(len(s.coupons), func(i int) bool { return s.coupons[i].ID >= id })
+	if i < len(s.coupons) && s.coupons[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+func (s *MemoryStore) claimIndex(couponID uint, userID string) int {
+	for i := range s.claims {
+		if s.claims[i].CouponID == couponID && s.claims[i].UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *MemoryStore) templateIndex(name string) int {
+	for i := range s.templates {
+		if s.templates[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// remaining is the stock left of the coupon at index i, shards summed
+func (s *MemoryStore) remaining(i int) int {
+	coupon := &s.coupons[i]
+	if coupon.Shards <= 1 {
+		return coupon.RemainingAmount
+	}
+	total := 0
+	for _, n := range s.shards[coupon.ID] {
+		total += n
+	}
+	return total
+}
+
+// insertClaim writes a claim the way the coupon_claims insert does, code and claim time included
+func (s *MemoryStore) insertClaim(couponID uint, userID string) error {
+	code, err := model.NewClaimCode()
+	if err != nil {
+		return err
+	}
+	s.lastClaimID++
+	s.claims = append(s.claims, model.CouponClaims{
+		ID:        s.lastClaimID,
+		CouponID:  couponID,
+		UserID:    userID,
+		Code:      code,
+		ClaimedAt: s.now(),
+	})
+	return nil
+}
+
+// copyCoupon copies the map, the only field a caller could change in place
+func copyCoupon(coupon model.Coupon) model.Coupon {
+	if coupon.Rules != nil {
+		rules := make(map[string]interface{}, len(coupon.Rules))
+		for k, v := range coupon.Rules {
+			rules[k] = v
+		}
+		coupon.Rules = rules
+	}
+	return coupon
+}
+
+func parseID(ref string) (uint, bool) {
+	id, err := strconv.ParseUint(ref, 10, 64)
+	return uint(id), err == nil
+}
@@ -0,0 +1,20 @@
+package repository_test
+
+import (
+	"testing"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository/repotest"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Backend {
+		store := repository.NewMemoryStore()
+		locks := repository.NewMemoryLocker()
+		return repotest.Backend{
+			Coupons: repository.NewMemoryCouponRepository(store, locks),
+			Users:   repository.NewMemoryUserRepository(store),
+			Locks:   locks,
+		}
+	})
+}
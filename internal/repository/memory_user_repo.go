@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+// memoryUserRepository is the UserRepository on a MemoryStore
+type memoryUserRepository struct {
+	store *MemoryStore
+}
+
+func NewMemoryUserRepository(store *MemoryStore) UserRepository {
+	return &memoryUserRepository{store: store}
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user *model.User) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userIndex(user.UserID) >= 0 {
+		return ErrUserAlreadyExists
+	}
+	s.insertUser(user)
+	return nil
+}
+
+// insertUser gives the user its ID and stores it, callers hold s.mu
+func (s *MemoryStore) insertUser(user *model.User) {
+	s.lastUserID++
+	user.ID = s.lastUserID
+	s.users = append(s.users, *user)
+}
+
+func (r *memoryUserRepository) CreateBatch(ctx context.Context, users []model.User) ([]string, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inserted []string
+	for _, user := range users {
+		if s.userIndex(user.UserID) >= 0 {
+			continue
+		}
+		s.insertUser(&user)
+		inserted = append(inserted, user.UserID)
+	}
+	return inserted, nil
+}
+
+func (r *memoryUserRepository) FindAll(ctx context.Context, page pagination.Params) ([]model.User, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []model.User
+	for _, user := range s.users {
+		if user.ID > page.After && len(users) < page.Limit+1 {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (r *memoryUserRepository) FindByRef(ctx context.Context, ref string) (*model.User, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.userRefIndex(ref)
+	if i < 0 {
+		return nil, ErrUserNotFound
+	}
+	user := s.users[i]
+	return &user, nil
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, userID string, name string) (*model.User, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.userIndex(userID)
+	if i < 0 {
+		return nil, ErrUserNotFound
+	}
+	s.users[i].Name = name
+	user := s.users[i]
+	return &user, nil
+}
+
+func (r *memoryUserRepository) Upsert(ctx context.Context, user *model.User) (bool, error) {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.userIndex(user.UserID); i >= 0 {
+		s.users[i].Name = user.Name
+		*user = s.users[i]
+		return false, nil
+	}
+	s.insertUser(user)
+	return true, nil
+}
+
+// Delete revokes the claims of the user like the postgres version: stock goes back, entries of lotteries not drawn yet are dropped
+func (r *memoryUserRepository) Delete(ctx context.Context, userID string) error {
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.userIndex(userID)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+
+	claims := s.claims[:0]
+	for _, claim := range s.claims {
+		if claim.UserID != userID {
+			claims = append(claims, claim)
+			continue
+		}
+		// Deleted coupons get their unit back too
+		c := s.couponIDIndex(claim.CouponID)
+		coupon := &s.coupons[c]
+		if coupon.Shards > 1 {
+			s.shards[coupon.ID][shardFor(userID, coupon.Shards)]++
+		} else {
+			coupon.RemainingAmount++
+			coupon.UpdatedAt = s.now()
+		}
+	}
+	s.claims = claims
+
+	entries := s.entries[:0]
+	for _, entry := range s.entries {
+		if entry.UserID != userID || entry.Status != model.EntryStatusPending {
+			entries = append(entries, entry)
+		}
+	}
+	s.entries = entries
+
+	s.users = append(s.users[:i], s.users[i+1:]...)
+	return nil
+}
@@ -0,0 +1,235 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// Advisory lock key of the outbox relay, only one relay publishes at a time so per coupon order holds
+const outboxRelayLockKey = 7_340_031
+
+type OutboxRepository struct {
+	db *gorm.DB
+}
+
+func NewOutboxRepository(db *gorm.DB) *OutboxRepository {
+	return &OutboxRepository{db: db}
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// The event constructors below leave ID empty, writeOutbox gives the event a random one
+
+func createdEvent(coupon *model.Coupon) model.Event {
+	return model.Event{
+		Type:            model.EventCouponCreated,
+		CouponName:      coupon.Name,
+		Amount:          coupon.Amount,
+		RemainingAmount: coupon.RemainingAmount,
+		OccurredAt:      time.Now(),
+	}
+}
+
+func claimedEvent(coupon *model.Coupon, userID string, remaining int) model.Event {
+	return model.Event{
+		Type:            model.EventCouponClaimed,
+		CouponName:      coupon.Name,
+		UserID:          userID,
+		RemainingAmount: remaining,
+		OccurredAt:      time.Now(),
+	}
+}
+
+func restockedEvent(coupon *model.Coupon, remaining int) model.Event {
+	return model.Event{
+		Type:            model.EventCouponRestocked,
+		CouponName:      coupon.Name,
+		Amount:          coupon.Amount,
+		RemainingAmount: remaining,
+		OccurredAt:      time.Now(),
+	}
+}
+
+func revokedEvent(coupon *model.Coupon, userID string, remaining int) model.Event {
+	return model.Event{
+		Type:            model.EventCouponRevoked,
+		CouponName:      coupon.Name,
+		UserID:          userID,
+		RemainingAmount: remaining,
+		OccurredAt:      time.Now(),
+	}
+}
+
+func reconciledEvent(coupon *model.Coupon, remaining int) model.Event {
+	return model.Event{
+		Type:            model.EventCouponReconciled,
+		CouponName:      coupon.Name,
+		Amount:          coupon.Amount,
+		RemainingAmount: remaining,
+		OccurredAt:      time.Now(),
+	}
+}
+
+func soldOutEvent(coupon *model.Coupon) model.Event {
+	return model.Event{
+		Type:       model.EventCouponSoldOut,
+		CouponName: coupon.Name,
+		OccurredAt: time.Now(),
+	}
+}
+
+// shardedSoldOutEvent is the sold out event of a sharded coupon whose last claim is lastClaimID. Its ID is
+// deterministic, so the writers racing to report the same sell out (see ClaimShardedCoupon) only store it once,
+// while selling out again after a restock takes a new claim and so gets a new ID.
+func shardedSoldOutEvent(coupon *model.Coupon, lastClaimID uint) model.Event {
+	event := soldOutEvent(coupon)
+	event.ID = fmt.Sprintf("coupon-%d-sold-out-at-claim-%d", coupon.ID, lastClaimID)
+	return event
+}
+
+// claimEvents describes one claim: a claimed event, plus a sold out event when it took the last unit
+func claimEvents(coupon *model.Coupon, userID string, remaining int) []model.Event {
+	events := []model.Event{claimedEvent(coupon, userID, remaining)}
+	if remaining == 0 {
+		events = append(events, soldOutEvent(coupon))
+	}
+	return events
+}
+
+// writeOutbox stores events in the outbox, call it with the transaction of the change the events describe.
+// Events without an ID get a random one.
+func writeOutbox(tx *gorm.DB, events ...model.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	rows := make([]model.OutboxEvent, len(events))
+	for i, e := range events {
+		if e.ID == "" {
+			id, err := newEventID()
+			if err != nil {
+				return err
+			}
+			e.ID = id
+		}
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		rows[i] = model.OutboxEvent{
+			EventID:    e.ID,
+			Type:       e.Type,
+			CouponName: e.CouponName,
+			Payload:    string(payload),
+			Status:     model.OutboxStatusPending,
+		}
+	}
+
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+}
+
+// ProcessPending hands up to limit pending events, oldest first, to publish and marks the ones that went through.
+// When an event fails, later events of the same coupon are held back until the next call so per coupon order holds,
+// and the query pages past them, so a coupon whose events keep failing doesn't hold back the others.
+// Only one instance relays at a time, under a session advisory lock, if another instance holds it this is a no-op.
+// No transaction is open while publish runs, each event is marked on its own once publish returned.
+func (r *OutboxRepository) ProcessPending(ctx context.Context, limit int, publish func(model.Event) error) (int, error) {
+	published := 0
+
+	err := r.db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?)", outboxRelayLockKey).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		// Not with ctx, a connection going back to the pool still holding the lock would stop every relay
+		defer conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(?)", outboxRelayLockKey)
+
+		var blocked []string
+		var after uint
+		attempted := 0
+		for attempted < limit {
+			query := conn.Where("status = ? AND id > ?", model.OutboxStatusPending, after)
+			if len(blocked) > 0 {
+				query = query.Where("coupon_name NOT IN ?", blocked)
+			}
+			var rows []model.OutboxEvent
+			if err := query.Order("id").Limit(limit - attempted).Find(&rows).Error; err != nil {
+				return err
+			}
+			if len(rows) == 0 {
+				break
+			}
+
+			for _, row := range rows {
+				after = row.ID
+				if slices.Contains(blocked, row.CouponName) {
+					continue
+				}
+				attempted++
+
+				var event model.Event
+				err := json.Unmarshal([]byte(row.Payload), &event)
+				if err == nil {
+					event.Sequence = uint64(row.ID)
+					err = publish(event)
+				}
+				if err != nil {
+					blocked = append(blocked, row.CouponName)
+					if err := conn.Model(&row).Updates(map[string]interface{}{
+						"attempts":   row.Attempts + 1,
+						"last_error": err.Error(),
+					}).Error; err != nil {
+						return err
+					}
+					continue
+				}
+
+				now := time.Now()
+				if err := conn.Model(&row).Updates(map[string]interface{}{
+					"status":       model.OutboxStatusPublished,
+					"attempts":     row.Attempts + 1,
+					"published_at": now,
+				}).Error; err != nil {
+					return err
+				}
+				published++
+			}
+		}
+
+		return nil
+	})
+
+	return published, err
+}
+
+// DeletePublished deletes up to limit events published before the given time, oldest first, and returns how many
+// it deleted. Pending events are kept however old they are.
+func (r *OutboxRepository) DeletePublished(ctx context.Context, before time.Time, limit int) (int64, error) {
+	res := r.db.WithContext(ctx).Exec(`
+		DELETE FROM outbox_events WHERE id IN (
+			SELECT id FROM outbox_events
+			WHERE status = ? AND published_at < ?
+			ORDER BY id
+			LIMIT ?
+		)`, model.OutboxStatusPublished, before, limit)
+	return res.RowsAffected, res.Error
+}
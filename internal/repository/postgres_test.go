@@ -0,0 +1,182 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository/repotest"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
+)
+
+// The Postgres tests run on the real repositories. They need a database and a redis they may wipe,
+// every test truncates the tables and flushes the redis db:
+//
+//	TEST_DATABASE_DSN="host=localhost user=postgres password=postgres dbname=coupon_test sslmode=disable" \
+//	TEST_REDIS_URL=redis://localhost:6379/15 go test ./internal/repository/
+func TestPostgresBackend(t *testing.T) {
+	gormDB, redisClient := openPostgres(t)
+	repotest.Run(t, func(t *testing.T) repotest.Backend {
+		return postgresBackend(t, gormDB, redisClient)
+	})
+}
+
+// Creates racing on Postgres are decided by idx_coupons_name_live alone: one insert wins, the others hit 23505
+// and get ErrCouponAlreadyExists. The index only covers live coupons, so a deleted coupon's name can be taken again.
+func TestPostgresConcurrentCreateSameName(t *testing.T) {
+	gormDB, redisClient := openPostgres(t)
+	b := postgresBackend(t, gormDB, redisClient)
+	ctx := context.Background()
+
+	var indexes int64
+	err := gormDB.Raw("SELECT COUNT(*) FROM pg_indexes WHERE indexname = 'idx_coupons_name_live'").Scan(&indexes).Error
+	if err != nil || indexes != 1 {
+		t.Fatalf("idx_coupons_name_live: got %d, %v", indexes, err)
+	}
+
+	race := func() {
+		const creators = 20
+		var created, conflicts atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < creators; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := b.Coupons.CreateCoupon(ctx, &model.Coupon{Name: "RACE", Amount: 10})
+				switch {
+				case err == nil:
+					created.Add(1)
+				case errors.Is(err, repository.ErrCouponAlreadyExists):
+					conflicts.Add(1)
+				default:
+					t.Errorf("create: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if created.Load() != 1 || conflicts.Load() != creators-1 {
+			t.Fatalf("got %d created and %d conflicts, want 1 and %d", created.Load(), conflicts.Load(), creators-1)
+		}
+	}
+
+	race()
+	if err := b.Coupons.DeleteCoupon(ctx, "RACE", ""); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	race()
+
+	var live, deleted int64
+	gormDB.Raw("SELECT COUNT(*) FROM coupons WHERE name = 'RACE' AND deleted_at IS NULL").Scan(&live)
+	gormDB.Raw("SELECT COUNT(*) FROM coupons WHERE name = 'RACE' AND deleted_at IS NOT NULL").Scan(&deleted)
+	if live != 1 || deleted != 1 {
+		t.Fatalf("got %d live and %d deleted RACE coupons, want 1 and 1", live, deleted)
+	}
+}
+
+// openPostgres connects to the test database and redis, skipping the test when they aren't configured
+func openPostgres(t *testing.T) (*gorm.DB, *goredis.Client) {
+	t.Helper()
+	dsn, redisURL := os.Getenv("TEST_DATABASE_DSN"), os.Getenv("TEST_REDIS_URL")
+	if dsn == "" || redisURL == "" {
+		t.Skip("TEST_DATABASE_DSN and TEST_REDIS_URL are not set")
+	}
+
+	gormDB, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close(gormDB) })
+	migrator, err := db.NewMigrator(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := goredis.ParseURL(redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient := goredis.NewClient(opts)
+	t.Cleanup(func() { redisClient.Close() })
+	return gormDB, redisClient
+}
+
+// postgresBackend empties the database and redis, and returns the real repositories on them
+func postgresBackend(t *testing.T, gormDB *gorm.DB, redisClient *goredis.Client) repotest.Backend {
+	t.Helper()
+	truncate(t, gormDB)
+	if err := redisClient.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	locks := repository.NewRedisLocker(redisClient, 30*time.Second, 10*time.Millisecond)
+	return repotest.Backend{
+		Coupons: repository.NewCouponRepository(gormDB, locks),
+		Users:   repository.NewUserRepository(gormDB),
+		Locks:   locks,
+	}
+}
+
+// truncate empties every table but the migration bookkeeping
+func truncate(t *testing.T, gormDB *gorm.DB) {
+	t.Helper()
+	var tables []string
+	err := gormDB.Raw(`SELECT quote_ident(tablename) FROM pg_tables
+		WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'`).Scan(&tables).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if err := gormDB.Exec("TRUNCATE " + table + " RESTART IDENTITY CASCADE").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Events get a random ID when written, and only published events are deleted by retention
+func TestPostgresOutboxRetention(t *testing.T) {
+	gormDB, redisClient := openPostgres(t)
+	b := postgresBackend(t, gormDB, redisClient)
+	outbox := repository.NewOutboxRepository(gormDB)
+	ctx := context.Background()
+
+	createCoupon := func(name string) {
+		t.Helper()
+		if _, err := b.Coupons.CreateCoupon(ctx, &model.Coupon{Name: name, Amount: 1}); err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+	}
+	createCoupon("OLD")
+	n, err := outbox.ProcessPending(ctx, 10, func(event model.Event) error {
+		if event.ID == "" || event.Sequence == 0 {
+			t.Errorf("published %+v, want an ID and a sequence", event)
+		}
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("publish: got %d, %v", n, err)
+	}
+	createCoupon("NEW")
+
+	deleted, err := outbox.DeletePublished(ctx, time.Now().Add(time.Second), 10)
+	if err != nil || deleted != 1 {
+		t.Fatalf("delete published: got %d, %v, want 1", deleted, err)
+	}
+	var pending []model.OutboxEvent
+	if err := gormDB.Find(&pending).Error; err != nil || len(pending) != 1 || pending[0].CouponName != "NEW" {
+		t.Fatalf("left: got %+v, %v, want the pending event of NEW", pending, err)
+	}
+}
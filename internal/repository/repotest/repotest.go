@@ -0,0 +1,971 @@
+// Package repotest is the conformance suite of the repository backends. Every CouponRepository,
+// UserRepository and Locker implementation must pass it, so the service behaves the same on any of them.
+//
+// It's called from a _test.go file of the backend:
+//
+//	func TestMemoryBackend(t *testing.T) {
+//		repotest.Run(t, func(t *testing.T) repotest.Backend {
+//			store := repository.NewMemoryStore()
+//			locks := repository.NewMemoryLocker()
+//			return repotest.Backend{
+//				Coupons: repository.NewMemoryCouponRepository(store, locks),
+//				Users:   repository.NewMemoryUserRepository(store),
+//				Locks:   locks,
+//			}
+//		})
+//	}
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+// Backend is one set of repositories sharing the same storage
+type Backend struct {
+	Coupons repository.CouponRepository
+	Users   repository.UserRepository
+	Locks   repository.Locker
+}
+
+// Run runs the suite. newBackend is called once per test and must return a backend with empty storage,
+// e.g. a fresh MemoryStore, or a database truncated with t.Cleanup.
+func Run(t *testing.T, newBackend func(t *testing.T) Backend) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, b Backend)
+	}{
+		{"Users", testUsers},
+		{"UserDeleteReturnsStock", testUserDeleteReturnsStock},
+		{"CreateCoupon", testCreateCoupon},
+		{"ConcurrentCreateSameName", testConcurrentCreateSameName},
+		{"ClaimCoupon", testClaimCoupon},
+		{"FlashSale", testFlashSale},
+		{"DoubleDip", testDoubleDip},
+		{"ShardedClaims", testShardedClaims},
+		{"ClaimBatch", testClaimBatch},
+		{"ListClaims", testListClaims},
+		{"UpdateCoupon", testUpdateCoupon},
+		{"ArchiveAndDelete", testArchiveAndDelete},
+		{"ListCoupons", testListCoupons},
+		{"Lottery", testLottery},
+		{"Templates", testTemplates},
+		{"ExportClaims", testExportClaims},
+		{"StockReconciliation", testStockReconciliation},
+		{"Locker", testLocker},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newBackend(t))
+		})
+	}
+}
+
+func page(limit int) pagination.Params {
+	return pagination.Params{Limit: limit}
+}
+
+func createUsers(t *testing.T, b Backend, n int) []string {
+	t.Helper()
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("user-%03d", i)
+		if err := b.Users.Create(context.Background(), &model.User{Name: "User " + ids[i], UserID: ids[i]}); err != nil {
+			t.Fatalf("create user %s: %v", ids[i], err)
+		}
+	}
+	return ids
+}
+
+func createCoupon(t *testing.T, b Backend, coupon model.Coupon) *model.Coupon {
+	t.Helper()
+	created, err := b.Coupons.CreateCoupon(context.Background(), &coupon)
+	if err != nil {
+		t.Fatalf("create coupon %s: %v", coupon.Name, err)
+	}
+	return created
+}
+
+func remaining(t *testing.T, b Backend, name string) int {
+	t.Helper()
+	coupon, _, err := b.Coupons.GetCouponDetails(context.Background(), name, page(1))
+	if err != nil {
+		t.Fatalf("coupon details %s: %v", name, err)
+	}
+	return coupon.RemainingAmount
+}
+
+func claimCount(t *testing.T, b Backend, name string) int {
+	t.Helper()
+	claims, err := b.Coupons.ListClaims(context.Background(), name, page(pagination.MaxLimit))
+	if err != nil {
+		t.Fatalf("list claims %s: %v", name, err)
+	}
+	return len(claims)
+}
+
+func expectErr(t *testing.T, what string, got error, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Fatalf("%s: got error %v, want %v", what, got, want)
+	}
+}
+
+func testUsers(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 3)
+
+	expectErr(t, "duplicate create", b.Users.Create(ctx, &model.User{UserID: ids[0]}), repository.ErrUserAlreadyExists)
+
+	inserted, err := b.Users.CreateBatch(ctx, []model.User{{UserID: ids[1]}, {Name: "New", UserID: "user-new"}})
+	if err != nil || len(inserted) != 1 || inserted[0] != "user-new" {
+		t.Fatalf("create batch: got %v, %v, want only user-new inserted", inserted, err)
+	}
+
+	user, err := b.Users.FindByRef(ctx, ids[2])
+	if err != nil || user.UserID != ids[2] {
+		t.Fatalf("find by user_id: got %+v, %v", user, err)
+	}
+	byID, err := b.Users.FindByRef(ctx, fmt.Sprint(user.ID))
+	if err != nil || byID.UserID != ids[2] {
+		t.Fatalf("find by numeric id: got %+v, %v", byID, err)
+	}
+	_, err = b.Users.FindByRef(ctx, "nobody")
+	expectErr(t, "find missing", err, repository.ErrUserNotFound)
+
+	updated, err := b.Users.Update(ctx, ids[0], "Renamed")
+	if err != nil || updated.Name != "Renamed" {
+		t.Fatalf("update: got %+v, %v", updated, err)
+	}
+	_, err = b.Users.Update(ctx, "nobody", "x")
+	expectErr(t, "update missing", err, repository.ErrUserNotFound)
+	// Changes take the user_id only, an unknown one must not fall back onto another user's numeric ID
+	_, err = b.Users.Update(ctx, fmt.Sprint(user.ID), "x")
+	expectErr(t, "update by numeric id", err, repository.ErrUserNotFound)
+	expectErr(t, "delete by numeric id", b.Users.Delete(ctx, fmt.Sprint(user.ID)), repository.ErrUserNotFound)
+
+	created, err := b.Users.Upsert(ctx, &model.User{Name: "Again", UserID: ids[0]})
+	if err != nil || created {
+		t.Fatalf("upsert existing: got created=%v, %v", created, err)
+	}
+	created, err = b.Users.Upsert(ctx, &model.User{Name: "Fresh", UserID: "user-upserted"})
+	if err != nil || !created {
+		t.Fatalf("upsert new: got created=%v, %v", created, err)
+	}
+
+	// 5 users in ID order, two per page
+	var all []model.User
+	after := uint(0)
+	for {
+		users, err := b.Users.FindAll(ctx, pagination.Params{Limit: 2, After: after})
+		if err != nil {
+			t.Fatalf("find all: %v", err)
+		}
+		if len(users) > 2 {
+			users = users[:2]
+			after = users[1].ID
+			all = append(all, users...)
+			continue
+		}
+		all = append(all, users...)
+		break
+	}
+	if len(all) != 5 {
+		t.Fatalf("find all: got %d users over all pages, want 5", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].ID <= all[i-1].ID {
+			t.Fatalf("find all: users not in ID order")
+		}
+	}
+
+	if err := b.Users.Delete(ctx, ids[0]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	expectErr(t, "delete again", b.Users.Delete(ctx, ids[0]), repository.ErrUserNotFound)
+}
+
+func testUserDeleteReturnsStock(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 2)
+	createCoupon(t, b, model.Coupon{Name: "PLAIN", Amount: 5})
+	sharded := createCoupon(t, b, model.Coupon{Name: "SHARDED", Amount: 5, Shards: 3})
+
+	for _, id := range ids {
+		if _, err := b.Coupons.ClaimCoupon(ctx, id, "PLAIN"); err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		if _, err := b.Coupons.ClaimShardedCoupon(ctx, id, sharded); err != nil {
+			t.Fatalf("sharded claim: %v", err)
+		}
+	}
+	if err := b.Users.Delete(ctx, ids[0]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	for _, name := range []string{"PLAIN", "SHARDED"} {
+		if got := remaining(t, b, name); got != 4 {
+			t.Errorf("%s: got %d left after deleting a claimer, want 4", name, got)
+		}
+		if got := claimCount(t, b, name); got != 1 {
+			t.Errorf("%s: got %d claims after deleting a claimer, want 1", name, got)
+		}
+	}
+}
+
+func testCreateCoupon(t *testing.T, b Backend) {
+	ctx := context.Background()
+	created := createCoupon(t, b, model.Coupon{Name: "NEW", Amount: 10})
+	if created.ID == 0 || created.RemainingAmount != 10 || created.Mode != model.CouponModeFCFS || created.Shards != 1 || created.Version != 1 {
+		t.Fatalf("create: got %+v, want defaults filled in", created)
+	}
+
+	_, err := b.Coupons.CreateCoupon(ctx, &model.Coupon{Name: "NEW", Amount: 1})
+	expectErr(t, "duplicate name", err, repository.ErrCouponAlreadyExists)
+
+	errs, err := b.Coupons.CreateCoupons(ctx, []*model.Coupon{{Name: "BULK-1", Amount: 1}, {Name: "NEW", Amount: 1}, {Name: "BULK-2", Amount: 1}})
+	if err != nil {
+		t.Fatalf("create coupons: %v", err)
+	}
+	if errs[0] != nil || !errors.Is(errs[1], repository.ErrCouponAlreadyExists) || errs[2] != nil {
+		t.Fatalf("create coupons: got %v, want only the second one to fail", errs)
+	}
+
+	coupon, err := b.Coupons.GetCouponByName(ctx, "BULK-2")
+	if err != nil || coupon.Amount != 1 {
+		t.Fatalf("get by name: got %+v, %v", coupon, err)
+	}
+	_, err = b.Coupons.GetCouponByName(ctx, "MISSING")
+	expectErr(t, "get missing", err, repository.ErrCouponNotFound)
+	_, _, err = b.Coupons.GetCouponDetails(ctx, "MISSING", page(10))
+	expectErr(t, "details missing", err, repository.ErrCouponNotFound)
+}
+
+// Instances creating the same coupon at once: exactly one wins, the rest get ErrCouponAlreadyExists
+func testConcurrentCreateSameName(t *testing.T, b Backend) {
+	const creators = 20
+	var created, conflicts atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < creators; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Coupons.CreateCoupon(context.Background(), &model.Coupon{Name: "RACE", Amount: 10})
+			switch {
+			case err == nil:
+				created.Add(1)
+			case errors.Is(err, repository.ErrCouponAlreadyExists):
+				conflicts.Add(1)
+			default:
+				t.Errorf("create: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created.Load() != 1 || conflicts.Load() != creators-1 {
+		t.Fatalf("got %d created and %d conflicts, want 1 and %d", created.Load(), conflicts.Load(), creators-1)
+	}
+}
+
+func testClaimCoupon(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 3)
+	createCoupon(t, b, model.Coupon{Name: "TWO", Amount: 2})
+
+	left, err := b.Coupons.ClaimCoupon(ctx, ids[0], "TWO")
+	if err != nil || left != 1 {
+		t.Fatalf("claim: got %d, %v, want 1 left", left, err)
+	}
+	_, err = b.Coupons.ClaimCoupon(ctx, ids[0], "TWO")
+	expectErr(t, "claim twice", err, repository.ErrAlreadyClaimed)
+
+	_, err = b.Coupons.ClaimCoupon(ctx, "nobody", "TWO")
+	if err == nil || errors.Is(err, repository.ErrAlreadyClaimed) || errors.Is(err, repository.ErrNoStock) {
+		t.Fatalf("claim by unknown user: got %v, want an error", err)
+	}
+	_, err = b.Coupons.ClaimCoupon(ctx, ids[0], "MISSING")
+	expectErr(t, "claim missing coupon", err, repository.ErrCouponNotFound)
+
+	if _, err := b.Coupons.ClaimCoupon(ctx, ids[1], "TWO"); err != nil {
+		t.Fatalf("claim the last one: %v", err)
+	}
+	_, err = b.Coupons.ClaimCoupon(ctx, ids[2], "TWO")
+	expectErr(t, "claim sold out", err, repository.ErrNoStock)
+
+	coupon, claims, err := b.Coupons.GetCouponDetails(ctx, "TWO", page(10))
+	if err != nil || coupon.RemainingAmount != 0 || len(claims) != 2 {
+		t.Fatalf("details: got %+v, %d claims, %v", coupon, len(claims), err)
+	}
+	for _, claim := range claims {
+		if claim.Code == "" {
+			t.Fatalf("claim of %s has no code", claim.UserID)
+		}
+	}
+
+	user, wallet, err := b.Coupons.ListUserClaims(ctx, ids[0], page(10))
+	if err != nil || user.UserID != ids[0] || len(wallet) != 1 || wallet[0].Coupon.Name != "TWO" {
+		t.Fatalf("user claims: got %+v, %+v, %v", user, wallet, err)
+	}
+	_, _, err = b.Coupons.ListUserClaims(ctx, "nobody", page(10))
+	expectErr(t, "user claims of unknown user", err, repository.ErrUserNotFound)
+}
+
+// More users than stock claiming at once: the stock runs out exactly, never below zero
+func testFlashSale(t *testing.T, b Backend) {
+	const users, stock = 50, 10
+	ids := createUsers(t, b, users)
+	createCoupon(t, b, model.Coupon{Name: "FLASH", Amount: stock})
+
+	var won, soldOut atomic.Int32
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Coupons.ClaimCoupon(context.Background(), id, "FLASH")
+			switch {
+			case err == nil:
+				won.Add(1)
+			case errors.Is(err, repository.ErrNoStock):
+				soldOut.Add(1)
+			default:
+				t.Errorf("claim: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won.Load() != stock || soldOut.Load() != users-stock {
+		t.Fatalf("got %d claims and %d sold out, want %d and %d", won.Load(), soldOut.Load(), stock, users-stock)
+	}
+	if got := remaining(t, b, "FLASH"); got != 0 {
+		t.Fatalf("got %d left, want 0", got)
+	}
+	if got := claimCount(t, b, "FLASH"); got != stock {
+		t.Fatalf("got %d claims stored, want %d", got, stock)
+	}
+}
+
+// One user claiming many times at once: exactly one claim goes through
+func testDoubleDip(t *testing.T, b Backend) {
+	const attempts = 20
+	ids := createUsers(t, b, 1)
+	createCoupon(t, b, model.Coupon{Name: "DIP", Amount: 10})
+
+	var won, dupes atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Coupons.ClaimCoupon(context.Background(), ids[0], "DIP")
+			switch {
+			case err == nil:
+				won.Add(1)
+			case errors.Is(err, repository.ErrAlreadyClaimed):
+				dupes.Add(1)
+			default:
+				t.Errorf("claim: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won.Load() != 1 || dupes.Load() != attempts-1 {
+		t.Fatalf("got %d claims and %d duplicates, want 1 and %d", won.Load(), dupes.Load(), attempts-1)
+	}
+	if got := remaining(t, b, "DIP"); got != 9 {
+		t.Fatalf("got %d left, want 9", got)
+	}
+}
+
+func testShardedClaims(t *testing.T, b Backend) {
+	const users, stock = 40, 12
+	ctx := context.Background()
+	ids := createUsers(t, b, users)
+	coupon := createCoupon(t, b, model.Coupon{Name: "SHARDED", Amount: stock, Shards: 4})
+
+	left, err := b.Coupons.RemainingStock(ctx, coupon)
+	if err != nil || left != stock {
+		t.Fatalf("remaining stock: got %d, %v, want %d", left, err, stock)
+	}
+
+	// Users that land on an empty shard still get stock from the others
+	var won, soldOut atomic.Int32
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Coupons.ClaimShardedCoupon(context.Background(), id, coupon)
+			switch {
+			case err == nil:
+				won.Add(1)
+			case errors.Is(err, repository.ErrNoStock):
+				soldOut.Add(1)
+			default:
+				t.Errorf("sharded claim: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won.Load() != stock || soldOut.Load() != users-stock {
+		t.Fatalf("got %d claims and %d sold out, want %d and %d", won.Load(), soldOut.Load(), stock, users-stock)
+	}
+	if got := remaining(t, b, "SHARDED"); got != 0 {
+		t.Fatalf("got %d left, want 0", got)
+	}
+	if got := claimCount(t, b, "SHARDED"); got != stock {
+		t.Fatalf("got %d claims stored, want %d", got, stock)
+	}
+
+	fresh := createCoupon(t, b, model.Coupon{Name: "SHARDED-2", Amount: 5, Shards: 2})
+	if _, err := b.Coupons.ClaimShardedCoupon(ctx, ids[0], fresh); err != nil {
+		t.Fatalf("sharded claim: %v", err)
+	}
+	_, err = b.Coupons.ClaimShardedCoupon(ctx, ids[0], fresh)
+	expectErr(t, "sharded claim twice", err, repository.ErrAlreadyClaimed)
+}
+
+func testClaimBatch(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 4)
+	createCoupon(t, b, model.Coupon{Name: "BATCH", Amount: 2})
+
+	results, err := b.Coupons.ClaimCouponBatch(ctx, "BATCH", []string{ids[0], "nobody", ids[0], ids[1], ids[2]})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if results[0].Err != nil || results[0].Remaining != 1 {
+		t.Errorf("first claim: got %+v, want 1 left", results[0])
+	}
+	if results[1].Err == nil {
+		t.Errorf("unknown user: got no error")
+	}
+	expectErr(t, "same user twice in a batch", results[2].Err, repository.ErrAlreadyClaimed)
+	if results[3].Err != nil || results[3].Remaining != 0 {
+		t.Errorf("last unit: got %+v, want 0 left", results[3])
+	}
+	expectErr(t, "batch past the stock", results[4].Err, repository.ErrNoStock)
+
+	_, err = b.Coupons.ClaimCouponBatch(ctx, "MISSING", ids)
+	expectErr(t, "batch on missing coupon", err, repository.ErrCouponNotFound)
+}
+
+func testListClaims(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 5)
+	createCoupon(t, b, model.Coupon{Name: "LIST", Amount: 5})
+	createCoupon(t, b, model.Coupon{Name: "OTHER", Amount: 5})
+	for _, id := range ids {
+		if _, err := b.Coupons.ClaimCoupon(ctx, id, "LIST"); err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+	}
+	if _, err := b.Coupons.ClaimCoupon(ctx, ids[0], "OTHER"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	first, err := b.Coupons.ListClaims(ctx, "LIST", page(2))
+	if err != nil || len(first) != 3 {
+		t.Fatalf("first page: got %d claims, %v, want 3 (limit + 1)", len(first), err)
+	}
+	rest, err := b.Coupons.ListClaims(ctx, "LIST", pagination.Params{Limit: 10, After: first[1].ID})
+	if err != nil || len(rest) != 3 || rest[0].ID != first[2].ID {
+		t.Fatalf("next page: got %+v, %v", rest, err)
+	}
+	_, err = b.Coupons.ListClaims(ctx, "MISSING", page(10))
+	expectErr(t, "claims of missing coupon", err, repository.ErrCouponNotFound)
+
+	// Wallets are newest first
+	_, wallet, err := b.Coupons.ListUserClaims(ctx, ids[0], page(1))
+	if err != nil || len(wallet) != 2 || wallet[0].Coupon.Name != "OTHER" {
+		t.Fatalf("wallet: got %+v, %v, want OTHER first", wallet, err)
+	}
+	_, older, err := b.Coupons.ListUserClaims(ctx, ids[0], pagination.Params{Limit: 10, After: wallet[0].ID})
+	if err != nil || len(older) != 1 || older[0].Coupon.Name != "LIST" {
+		t.Fatalf("wallet next page: got %+v, %v", older, err)
+	}
+
+	// Claims of a deleted coupon stay in the wallet
+	if err := b.Coupons.DeleteCoupon(ctx, "OTHER", ""); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, wallet, err = b.Coupons.ListUserClaims(ctx, ids[0], page(10))
+	if err != nil || len(wallet) != 2 {
+		t.Fatalf("wallet after delete: got %d claims, %v, want 2", len(wallet), err)
+	}
+}
+
+func testUpdateCoupon(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 3)
+	coupon := createCoupon(t, b, model.Coupon{Name: "EDIT", Amount: 5})
+	for _, id := range ids {
+		if _, err := b.Coupons.ClaimCoupon(ctx, id, "EDIT"); err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+	}
+	etag := coupon.ETag()
+
+	amount := 10
+	updated, err := b.Coupons.UpdateCoupon(ctx, "EDIT", etag, repository.CouponPatch{Amount: &amount})
+	if err != nil || updated.Amount != 10 || updated.Version != 2 {
+		t.Fatalf("raise amount: got %+v, %v", updated, err)
+	}
+	if got := remaining(t, b, "EDIT"); got != 7 {
+		t.Fatalf("got %d left after raising the amount, want 7", got)
+	}
+
+	_, err = b.Coupons.UpdateCoupon(ctx, "EDIT", etag, repository.CouponPatch{Amount: &amount})
+	expectErr(t, "stale ETag", err, repository.ErrPreconditionFailed)
+
+	tooLow := 2
+	_, err = b.Coupons.UpdateCoupon(ctx, "EDIT", "*", repository.CouponPatch{Amount: &tooLow})
+	expectErr(t, "amount below claims", err, repository.ErrAmountBelowClaimed)
+
+	startsAt := time.Now().Add(time.Hour)
+	expiresAt := startsAt.Add(-time.Minute)
+	_, err = b.Coupons.UpdateCoupon(ctx, "EDIT", "", repository.CouponPatch{StartsAt: &startsAt, ExpiresAt: &expiresAt})
+	expectErr(t, "window ending before it starts", err, repository.ErrInvalidWindow)
+	_, err = b.Coupons.UpdateCoupon(ctx, "EDIT", "", repository.CouponPatch{EntryDeadline: &startsAt})
+	expectErr(t, "entry deadline on fcfs", err, repository.ErrNotLottery)
+
+	// Failed updates change nothing
+	current, err := b.Coupons.GetCouponByName(ctx, "EDIT")
+	if err != nil || current.Version != 2 || current.StartsAt != nil {
+		t.Fatalf("after failed updates: got %+v, %v", current, err)
+	}
+
+	unchanged, err := b.Coupons.UpdateCoupon(ctx, "EDIT", "", repository.CouponPatch{Amount: &amount})
+	if err != nil || unchanged.Version != 2 {
+		t.Fatalf("no-op update: got %+v, %v, want version kept", unchanged, err)
+	}
+
+	createCoupon(t, b, model.Coupon{Name: "TAKEN", Amount: 1})
+	taken := "TAKEN"
+	_, err = b.Coupons.UpdateCoupon(ctx, "EDIT", "", repository.CouponPatch{Name: &taken})
+	expectErr(t, "rename onto a live coupon", err, repository.ErrCouponAlreadyExists)
+
+	renamed := "EDITED"
+	if _, err := b.Coupons.UpdateCoupon(ctx, "EDIT", "", repository.CouponPatch{Name: &renamed}); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	_, err = b.Coupons.GetCouponByName(ctx, "EDIT")
+	expectErr(t, "old name after rename", err, repository.ErrCouponNotFound)
+
+	_, err = b.Coupons.UpdateCoupon(ctx, "MISSING", "", repository.CouponPatch{Amount: &amount})
+	expectErr(t, "update missing", err, repository.ErrCouponNotFound)
+
+	// Sharded coupons get the new stock spread over their shards
+	sharded := createCoupon(t, b, model.Coupon{Name: "EDIT-SHARDED", Amount: 4, Shards: 2})
+	for _, id := range ids {
+		if _, err := b.Coupons.ClaimShardedCoupon(ctx, id, sharded); err != nil {
+			t.Fatalf("sharded claim: %v", err)
+		}
+	}
+	if _, err := b.Coupons.UpdateCoupon(ctx, "EDIT-SHARDED", "", repository.CouponPatch{Amount: &amount}); err != nil {
+		t.Fatalf("raise sharded amount: %v", err)
+	}
+	if got := remaining(t, b, "EDIT-SHARDED"); got != 7 {
+		t.Fatalf("got %d left on the shards, want 7", got)
+	}
+}
+
+func testArchiveAndDelete(t *testing.T, b Backend) {
+	ctx := context.Background()
+	coupon := createCoupon(t, b, model.Coupon{Name: "OLD", Amount: 5})
+
+	archived, err := b.Coupons.SetArchived(ctx, "OLD", coupon.ETag(), true)
+	if err != nil || archived.ArchivedAt == nil || archived.Version != 2 {
+		t.Fatalf("archive: got %+v, %v", archived, err)
+	}
+	again, err := b.Coupons.SetArchived(ctx, "OLD", "", true)
+	if err != nil || again.Version != 2 {
+		t.Fatalf("archive again: got %+v, %v, want a no-op", again, err)
+	}
+
+	// Every claim path checks the coupon it holds the lock on, not the caller's copy from before the archive
+	user := createUsers(t, b, 1)[0]
+	_, err = b.Coupons.ClaimCoupon(ctx, user, "OLD")
+	expectErr(t, "claim archived", err, repository.ErrCouponArchived)
+	_, err = b.Coupons.ClaimCouponBatch(ctx, "OLD", []string{user})
+	expectErr(t, "batch claim archived", err, repository.ErrCouponArchived)
+	sharded := createCoupon(t, b, model.Coupon{Name: "OLD-SHARDED", Amount: 4, Shards: 2})
+	if _, err := b.Coupons.SetArchived(ctx, "OLD-SHARDED", "", true); err != nil {
+		t.Fatalf("archive sharded: %v", err)
+	}
+	_, err = b.Coupons.ClaimShardedCoupon(ctx, user, sharded)
+	expectErr(t, "sharded claim archived", err, repository.ErrCouponArchived)
+	if got := claimCount(t, b, "OLD"); got != 0 {
+		t.Fatalf("archived coupon got %d claims, want 0", got)
+	}
+
+	// Lottery entries and draws too
+	passed := time.Now().Add(-time.Second)
+	createCoupon(t, b, model.Coupon{Name: "OLD-RAFFLE", Amount: 1, Mode: model.CouponModeLottery, EntryDeadline: &passed})
+	if _, err := b.Coupons.SetArchived(ctx, "OLD-RAFFLE", "", true); err != nil {
+		t.Fatalf("archive lottery: %v", err)
+	}
+	expectErr(t, "enter archived lottery", b.Coupons.CreateEntry(ctx, user, "OLD-RAFFLE"), repository.ErrCouponArchived)
+	_, _, err = b.Coupons.DrawLottery(ctx, "OLD-RAFFLE", 42)
+	expectErr(t, "draw archived lottery", err, repository.ErrCouponArchived)
+	startsAt := time.Now().Add(time.Hour)
+	createCoupon(t, b, model.Coupon{Name: "LATER-RAFFLE", Amount: 1, Mode: model.CouponModeLottery, StartsAt: &startsAt})
+	expectErr(t, "enter lottery not started", b.Coupons.CreateEntry(ctx, user, "LATER-RAFFLE"), repository.ErrCouponNotStarted)
+	_, err = b.Coupons.SetArchived(ctx, "OLD", coupon.ETag(), false)
+	expectErr(t, "unarchive with stale ETag", err, repository.ErrPreconditionFailed)
+	unarchived, err := b.Coupons.SetArchived(ctx, "OLD", archived.ETag(), false)
+	if err != nil || unarchived.ArchivedAt != nil {
+		t.Fatalf("unarchive: got %+v, %v", unarchived, err)
+	}
+
+	expectErr(t, "delete with stale ETag", b.Coupons.DeleteCoupon(ctx, "OLD", coupon.ETag()), repository.ErrPreconditionFailed)
+	if err := b.Coupons.DeleteCoupon(ctx, "OLD", unarchived.ETag()); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = b.Coupons.GetCouponByName(ctx, "OLD")
+	expectErr(t, "get deleted", err, repository.ErrCouponNotFound)
+	expectErr(t, "delete again", b.Coupons.DeleteCoupon(ctx, "OLD", ""), repository.ErrCouponNotFound)
+
+	// The name is free again, and the old ETag doesn't match the new coupon
+	reused := createCoupon(t, b, model.Coupon{Name: "OLD", Amount: 1})
+	if reused.ID == coupon.ID {
+		t.Fatalf("reused name got the deleted coupon's ID")
+	}
+	expectErr(t, "old ETag on reused name", b.Coupons.DeleteCoupon(ctx, "OLD", unarchived.ETag()), repository.ErrPreconditionFailed)
+}
+
+func testListCoupons(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 2)
+	for i, amount := range []int{3, 1, 2, 2} {
+		createCoupon(t, b, model.Coupon{Name: fmt.Sprintf("LIST-%d", i), Amount: amount})
+	}
+	createCoupon(t, b, model.Coupon{Name: "OTHER", Amount: 1})
+	if _, err := b.Coupons.ClaimCoupon(ctx, ids[0], "LIST-1"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if _, err := b.Coupons.SetArchived(ctx, "LIST-3", "", true); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+
+	list := func(filter repository.CouponFilter, limit int) []string {
+		t.Helper()
+		var names []string
+		p := page(limit)
+		for {
+			coupons, err := b.Coupons.ListCoupons(ctx, filter, p)
+			if err != nil {
+				t.Fatalf("list %+v: %v", filter, err)
+			}
+			more := len(coupons) > limit
+			if more {
+				coupons = coupons[:limit]
+			}
+			for _, c := range coupons {
+				names = append(names, c.Name)
+			}
+			if !more {
+				return names
+			}
+			last := coupons[len(coupons)-1]
+			p = pagination.Params{Limit: limit, After: last.ID, AfterKey: repository.CouponSortKey(last, filter.Sort)}
+		}
+	}
+	expect := func(what string, got []string, want ...string) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: got %v, want %v", what, got, want)
+		}
+	}
+
+	expect("by creation", list(repository.CouponFilter{Sort: "created_at", NamePrefix: "LIST-"}, 2), "LIST-0", "LIST-1", "LIST-2", "LIST-3")
+	expect("newest first", list(repository.CouponFilter{Sort: "-created_at"}, 3), "OTHER", "LIST-3", "LIST-2", "LIST-1", "LIST-0")
+	// Ties on the stock left are broken by ID
+	expect("by stock left", list(repository.CouponFilter{Sort: "remaining_amount", NamePrefix: "LIST-"}, 1), "LIST-1", "LIST-2", "LIST-3", "LIST-0")
+	expect("most stock first", list(repository.CouponFilter{Sort: "-remaining_amount", NamePrefix: "LIST-"}, 2), "LIST-0", "LIST-3", "LIST-2", "LIST-1")
+	expect("sold out", list(repository.CouponFilter{Sort: "created_at", Status: model.CouponStatusSoldOut}, 10), "LIST-1")
+	expect("archived", list(repository.CouponFilter{Sort: "created_at", Status: model.CouponStatusArchived}, 10), "LIST-3")
+	expect("active", list(repository.CouponFilter{Sort: "created_at", Status: model.CouponStatusActive}, 10), "LIST-0", "LIST-2", "OTHER")
+
+	_, err := b.Coupons.ListCoupons(ctx, repository.CouponFilter{Sort: "name"}, page(10))
+	expectErr(t, "unknown sort", err, repository.ErrInvalidSort)
+	_, err = b.Coupons.ListCoupons(ctx, repository.CouponFilter{Sort: "remaining_amount"}, pagination.Params{Limit: 10, After: 1, AfterKey: "soon"})
+	expectErr(t, "bad sort key", err, pagination.ErrInvalidCursor)
+	_, err = b.Coupons.ListCoupons(ctx, repository.CouponFilter{Sort: "created_at"}, pagination.Params{Limit: 10, After: 1})
+	expectErr(t, "cursor without sort key", err, pagination.ErrInvalidCursor)
+}
+
+func testLottery(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 5)
+	createCoupon(t, b, model.Coupon{Name: "FCFS", Amount: 1})
+	deadline := time.Now().Add(time.Hour)
+	createCoupon(t, b, model.Coupon{Name: "RAFFLE", Amount: 2, Mode: model.CouponModeLottery, EntryDeadline: &deadline})
+
+	expectErr(t, "enter fcfs", b.Coupons.CreateEntry(ctx, ids[0], "FCFS"), repository.ErrNotLottery)
+	expectErr(t, "enter missing", b.Coupons.CreateEntry(ctx, ids[0], "MISSING"), repository.ErrCouponNotFound)
+	for _, id := range ids {
+		if err := b.Coupons.CreateEntry(ctx, id, "RAFFLE"); err != nil {
+			t.Fatalf("enter: %v", err)
+		}
+	}
+	expectErr(t, "enter twice", b.Coupons.CreateEntry(ctx, ids[0], "RAFFLE"), repository.ErrAlreadyEntered)
+	if err := b.Coupons.CreateEntry(ctx, "nobody", "RAFFLE"); err == nil {
+		t.Fatalf("enter as unknown user: got no error")
+	}
+
+	_, _, err := b.Coupons.DrawLottery(ctx, "RAFFLE", 42)
+	expectErr(t, "draw before the deadline", err, repository.ErrEntriesStillOpen)
+	_, _, _, err = b.Coupons.GetDraw(ctx, "RAFFLE")
+	expectErr(t, "draw not run yet", err, repository.ErrDrawNotFound)
+
+	passed := time.Now().Add(-time.Second)
+	if _, err := b.Coupons.UpdateCoupon(ctx, "RAFFLE", "", repository.CouponPatch{EntryDeadline: &passed}); err != nil {
+		t.Fatalf("move deadline: %v", err)
+	}
+	expectErr(t, "enter after the deadline", b.Coupons.CreateEntry(ctx, "user-new", "RAFFLE"), repository.ErrEntriesClosed)
+
+	draw, winners, err := b.Coupons.DrawLottery(ctx, "RAFFLE", 42)
+	if err != nil || draw.Seed != 42 || draw.Stock != 2 || draw.EntryCount != 5 || draw.WinnerCount != 2 || len(winners) != 2 {
+		t.Fatalf("draw: got %+v, %v, %v", draw, winners, err)
+	}
+	_, _, err = b.Coupons.DrawLottery(ctx, "RAFFLE", 42)
+	expectErr(t, "draw twice", err, repository.ErrAlreadyDrawn)
+
+	// The seed makes the draw re-runnable: the same entries and seed give the same winners
+	coupon, stored, entries, err := b.Coupons.GetDraw(ctx, "RAFFLE")
+	if err != nil || stored.Seed != 42 || len(entries) != 5 {
+		t.Fatalf("get draw: got %+v, %d entries, %v", stored, len(entries), err)
+	}
+	rerun := repository.DrawWinners(entries, stored.Seed, stored.Stock)
+	won := 0
+	for i, entry := range entries {
+		if entry.Status == model.EntryStatusWon {
+			won++
+		}
+		if i > 0 && entry.ID <= entries[i-1].ID {
+			t.Fatalf("entries not in ID order")
+		}
+	}
+	if won != 2 || len(rerun) != 2 || rerun[0].UserID != winners[0] || rerun[1].UserID != winners[1] {
+		t.Fatalf("re-run draw: got %v, stored winners %v", rerun, winners)
+	}
+	if coupon.DrawnAt == nil || remaining(t, b, "RAFFLE") != 0 || claimCount(t, b, "RAFFLE") != 2 {
+		t.Fatalf("after draw: got %+v", coupon)
+	}
+	expectErr(t, "enter after the draw", b.Coupons.CreateEntry(ctx, "user-new", "RAFFLE"), repository.ErrEntriesClosed)
+
+	// Deleting an entrant revokes their claim but keeps their entry, the draw still re-runs to the same winners
+	if err := b.Users.Delete(ctx, winners[0]); err != nil {
+		t.Fatalf("delete winner: %v", err)
+	}
+	_, _, entries, err = b.Coupons.GetDraw(ctx, "RAFFLE")
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("get draw after deleting a winner: got %d entries, %v", len(entries), err)
+	}
+	rerun = repository.DrawWinners(entries, stored.Seed, stored.Stock)
+	if rerun[0].UserID != winners[0] || rerun[1].UserID != winners[1] || claimCount(t, b, "RAFFLE") != 1 {
+		t.Fatalf("re-run draw after deleting a winner: got %v, stored winners %v", rerun, winners)
+	}
+
+	amount := 3
+	_, err = b.Coupons.UpdateCoupon(ctx, "RAFFLE", "", repository.CouponPatch{Amount: &amount})
+	expectErr(t, "resize after the draw", err, repository.ErrAlreadyDrawn)
+	_, _, _, err = b.Coupons.GetDraw(ctx, "FCFS")
+	expectErr(t, "draw of fcfs", err, repository.ErrNotLottery)
+}
+
+func testTemplates(t *testing.T, b Backend) {
+	ctx := context.Background()
+	for _, name := range []string{"weekly", "daily"} {
+		if err := b.Coupons.CreateTemplate(ctx, &model.CouponTemplate{Name: name, Amount: 100}); err != nil {
+			t.Fatalf("create template: %v", err)
+		}
+	}
+	expectErr(t, "duplicate template", b.Coupons.CreateTemplate(ctx, &model.CouponTemplate{Name: "daily", Amount: 1}), repository.ErrTemplateAlreadyExists)
+
+	templates, err := b.Coupons.ListTemplates(ctx)
+	if err != nil || len(templates) != 2 || templates[0].Name != "daily" {
+		t.Fatalf("list templates: got %+v, %v, want them by name", templates, err)
+	}
+	template, err := b.Coupons.GetTemplate(ctx, "weekly")
+	if err != nil || template.Amount != 100 || template.Mode != model.CouponModeFCFS || template.Shards != 1 {
+		t.Fatalf("get template: got %+v, %v, want defaults filled in", template, err)
+	}
+
+	if err := b.Coupons.DeleteTemplate(ctx, "weekly"); err != nil {
+		t.Fatalf("delete template: %v", err)
+	}
+	_, err = b.Coupons.GetTemplate(ctx, "weekly")
+	expectErr(t, "get deleted template", err, repository.ErrTemplateNotFound)
+	expectErr(t, "delete missing template", b.Coupons.DeleteTemplate(ctx, "weekly"), repository.ErrTemplateNotFound)
+}
+
+func testExportClaims(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 3)
+	first := createCoupon(t, b, model.Coupon{Name: "EXPORT", Amount: 5, DiscountValue: 10})
+	createCoupon(t, b, model.Coupon{Name: "SKIPPED", Amount: 5})
+	for _, id := range ids {
+		if _, err := b.Coupons.ClaimCoupon(ctx, id, "EXPORT"); err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+	}
+	if _, err := b.Coupons.ClaimCoupon(ctx, ids[0], "SKIPPED"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	var rows [][]interface{}
+	columns := []string{"claim_id", "user_id", "coupon_name", "discount_value", "expires_at"}
+	err := b.Coupons.ExportClaims(ctx, repository.ClaimExportFilter{CouponIDs: []uint{first.ID}}, columns, func(values []interface{}) error {
+		rows = append(rows, values)
+		return nil
+	})
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("export: got %d rows, %v, want 3", len(rows), err)
+	}
+	for i, row := range rows {
+		if row[1] != ids[i] || row[2] != "EXPORT" || row[3] != int64(10) || row[4] != nil {
+			t.Fatalf("export row %d: got %v", i, row)
+		}
+		if _, ok := row[0].(int64); !ok {
+			t.Fatalf("export row %d: claim_id is %T, want int64", i, row[0])
+		}
+	}
+
+	// [From, To) past every claim
+	var count int
+	err = b.Coupons.ExportClaims(ctx, repository.ClaimExportFilter{From: time.Now().Add(time.Hour)}, columns, func([]interface{}) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 0 {
+		t.Fatalf("export from the future: got %d rows, %v", count, err)
+	}
+
+	err = b.Coupons.ExportClaims(ctx, repository.ClaimExportFilter{}, []string{"password"}, func([]interface{}) error { return nil })
+	expectErr(t, "unknown column", err, repository.ErrInvalidExportColumn)
+
+	stop := errors.New("client went away")
+	err = b.Coupons.ExportClaims(ctx, repository.ClaimExportFilter{}, columns, func([]interface{}) error { return stop })
+	expectErr(t, "row error", err, stop)
+
+	// A deleted coupon is still found by name, next to the coupon that took the name after it
+	if err := b.Coupons.DeleteCoupon(ctx, "EXPORT", ""); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	second := createCoupon(t, b, model.Coupon{Name: "EXPORT", Amount: 5})
+	coupons, err := b.Coupons.FindCouponsByName(ctx, "EXPORT")
+	if err != nil || len(coupons) != 2 || coupons[0].ID != first.ID || !coupons[0].DeletedAt.Valid || coupons[1].ID != second.ID {
+		t.Fatalf("find by name: got %+v, %v", coupons, err)
+	}
+	_, err = b.Coupons.FindCouponsByName(ctx, "MISSING")
+	expectErr(t, "find missing", err, repository.ErrCouponNotFound)
+
+	count = 0
+	err = b.Coupons.ExportClaims(ctx, repository.ClaimExportFilter{CouponIDs: []uint{first.ID, second.ID}}, columns, func([]interface{}) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 3 {
+		t.Fatalf("export of a deleted coupon: got %d rows, %v, want 3", count, err)
+	}
+}
+
+// Stock that only ever changed through the repository adds up, so reconciliation finds and repairs nothing
+func testStockReconciliation(t *testing.T, b Backend) {
+	ctx := context.Background()
+	ids := createUsers(t, b, 4)
+	createCoupon(t, b, model.Coupon{Name: "PLAIN", Amount: 3})
+	sharded := createCoupon(t, b, model.Coupon{Name: "SHARDED", Amount: 5, Shards: 2})
+	for _, id := range ids {
+		b.Coupons.ClaimCoupon(ctx, id, "PLAIN")
+		if _, err := b.Coupons.ClaimShardedCoupon(ctx, id, sharded); err != nil {
+			t.Fatalf("sharded claim: %v", err)
+		}
+	}
+	amount := 4
+	if _, err := b.Coupons.UpdateCoupon(ctx, "PLAIN", "", repository.CouponPatch{Amount: &amount}); err != nil {
+		t.Fatalf("raise amount: %v", err)
+	}
+	if err := b.Users.Delete(ctx, ids[0]); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+
+	issues, err := b.Coupons.FindStockIssues(ctx)
+	if err != nil || len(issues) != 0 {
+		t.Fatalf("find stock issues: got %+v, %v, want none", issues, err)
+	}
+	for _, name := range []string{"PLAIN", "SHARDED"} {
+		issue, err := b.Coupons.RepairStock(ctx, name)
+		if err != nil || len(issue.Problems) != 0 || issue.Repaired {
+			t.Fatalf("repair %s: got %+v, %v, want nothing to repair", name, issue, err)
+		}
+	}
+	if got := remaining(t, b, "SHARDED"); got != 2 {
+		t.Fatalf("got %d left on the shards, want 2", got)
+	}
+
+	_, err = b.Coupons.RepairStock(ctx, "MISSING")
+	expectErr(t, "repair missing", err, repository.ErrCouponNotFound)
+}
+
+func testLocker(t *testing.T, b Backend) {
+	ctx := context.Background()
+	release, err := b.Locks.Acquire(ctx, "repotest:lock")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.Locks.Acquire(waitCtx, "repotest:lock"); err == nil {
+		t.Fatalf("acquired a held lock")
+	}
+
+	acquired := make(chan func(), 1)
+	go func() {
+		second, err := b.Locks.Acquire(ctx, "repotest:lock")
+		if err != nil {
+			t.Errorf("acquire after release: %v", err)
+			close(acquired)
+			return
+		}
+		acquired <- second
+	}()
+	release()
+	// Releasing twice must not free the lock the waiter just took
+	release()
+
+	select {
+	case second := <-acquired:
+		if second == nil {
+			return
+		}
+		if n := b.Locks.ReleaseAll(ctx); n != 1 {
+			t.Fatalf("release all: got %d locks, want 1", n)
+		}
+		second()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiter never got the released lock")
+	}
+
+	other, err := b.Locks.Acquire(ctx, "repotest:lock")
+	if err != nil {
+		t.Fatalf("acquire after release all: %v", err)
+	}
+	other()
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+const (
+	stockChannelPrefix = "coupon_stock:"
+	// The last sequence published only has to outlive the updates racing it
+	stockSequenceTTL = 24 * time.Hour
+)
+
+// publishStockScript publishes an update only if it's newer than the last one published for the coupon,
+// by whichever instance. The relay moves between instances, so one of them may flush an older update late.
+var publishStockScript = redis.NewScript(`
+if tonumber(ARGV[1]) <= tonumber(redis.call('GET', KEYS[1]) or '0') then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+redis.call('PUBLISH', KEYS[2], ARGV[2])
+return 1
+`)
+
+// StockFeedRepository fans stock updates out to every instance through redis pub/sub.
+// All subscriptions of an instance share one pub/sub connection.
+type StockFeedRepository struct {
+	redis *redis.Client
+
+	once    sync.Once
+	pubsub  *redis.PubSub
+	updates chan model.StockUpdate
+}
+
+func NewStockFeedRepository(redisClient *redis.Client) *StockFeedRepository {
+	return &StockFeedRepository{
+		redis:   redisClient,
+		updates: make(chan model.StockUpdate, 256),
+	}
+}
+
+// Publish sends an update to every instance, unless an update of the coupon with a higher sequence was
+// published already
+func (r *StockFeedRepository) Publish(ctx context.Context, update model.StockUpdate) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return publishStockScript.Run(ctx, r.redis,
+		[]string{"coupon_stock_sequence:" + update.CouponName, stockChannelPrefix + update.CouponName},
+		update.Sequence, payload, stockSequenceTTL.Milliseconds()).Err()
+}
+
+// Subscribe starts receiving updates of a coupon on Updates
+func (r *StockFeedRepository) Subscribe(ctx context.Context, couponName string) error {
+	r.once.Do(r.listen)
+	return r.pubsub.Subscribe(ctx, stockChannelPrefix+couponName)
+}
+
+func (r *StockFeedRepository) Unsubscribe(ctx context.Context, couponName string) error {
+	r.once.Do(r.listen)
+	return r.pubsub.Unsubscribe(ctx, stockChannelPrefix+couponName)
+}
+
+// Updates delivers the updates of every subscribed coupon
+func (r *StockFeedRepository) Updates() <-chan model.StockUpdate {
+	return r.updates
+}
+
+func (r *StockFeedRepository) listen() {
+	r.pubsub = r.redis.Subscribe(context.Background())
+
+	go func() {
+		for msg := range r.pubsub.Channel() {
+			var update model.StockUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+				log.Printf("stock feed: bad message on %s: %v", msg.Channel, err)
+				continue
+			}
+			update.CouponName = strings.TrimPrefix(msg.Channel, stockChannelPrefix)
+			r.updates <- update
+		}
+		close(r.updates)
+	}()
+}
+
+// Close stops the pub/sub connection, Updates is closed afterwards
+func (r *StockFeedRepository) Close() error {
+	r.once.Do(r.listen)
+	return r.pubsub.Close()
+}
@@ -0,0 +1,73 @@
+package repository_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// Two instances flushing out of order: the update with the lower sequence arrives last and is dropped.
+// Needs a redis db it may flush, TEST_REDIS_URL=redis://localhost:6379/15 go test ./internal/repository/
+func TestStockFeedDropsOlderUpdates(t *testing.T) {
+	redisURL := os.Getenv("TEST_REDIS_URL")
+	if redisURL == "" {
+		t.Skip("TEST_REDIS_URL is not set")
+	}
+	opts, err := goredis.ParseURL(redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient := goredis.NewClient(opts)
+	t.Cleanup(func() { redisClient.Close() })
+	ctx := context.Background()
+	if err := redisClient.FlushDB(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := repository.NewStockFeedRepository(redisClient)
+	t.Cleanup(func() { subscriber.Close() })
+	if err := subscriber.Subscribe(ctx, "HOT"); err != nil {
+		t.Fatal(err)
+	}
+	// Subscribe doesn't wait for redis to confirm
+	time.Sleep(100 * time.Millisecond)
+
+	first, second := repository.NewStockFeedRepository(redisClient), repository.NewStockFeedRepository(redisClient)
+	for _, publish := range []struct {
+		feed   *repository.StockFeedRepository
+		update model.StockUpdate
+	}{
+		{first, model.StockUpdate{CouponName: "HOT", RemainingAmount: 5, Sequence: 10}},
+		{second, model.StockUpdate{CouponName: "HOT", RemainingAmount: 7, Sequence: 8}},
+		{first, model.StockUpdate{CouponName: "HOT", RemainingAmount: 4, Sequence: 11}},
+	} {
+		if err := publish.feed.Publish(ctx, publish.update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []int
+	timeout := time.After(time.Second)
+	for len(got) < 2 {
+		select {
+		case update := <-subscriber.Updates():
+			got = append(got, update.RemainingAmount)
+		case <-timeout:
+			t.Fatalf("got %v, want [5 4]", got)
+		}
+	}
+	if got[0] != 5 || got[1] != 4 {
+		t.Fatalf("got %v, want [5 4]", got)
+	}
+	select {
+	case update := <-subscriber.Updates():
+		t.Fatalf("got an extra update %+v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+var ErrTicketNotFound = errors.New("claim ticket not found")
+
+const ticketQueueKey = "claim_tickets:queue"
+
+// TicketRepository stores async claim tickets and their work queue in redis
+type TicketRepository struct {
+	redis *redis.Client
+	// How long a ticket is kept after it's queued, for its owner to poll
+	ttl time.Duration
+}
+
+func NewTicketRepository(redisClient *redis.Client, ttl time.Duration) *TicketRepository {
+	return &TicketRepository{redis: redisClient, ttl: ttl}
+}
+
+func ticketKey(id string) string {
+	return "claim_ticket:" + id
+}
+
+// Enqueue stores a new pending ticket and pushes it onto the work queue
+func (r *TicketRepository) Enqueue(ctx context.Context, userID string, couponName string) (*model.ClaimTicket, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ticket := &model.ClaimTicket{
+		ID:         hex.EncodeToString(idBytes),
+		UserID:     userID,
+		CouponName: couponName,
+		Status:     model.TicketStatusPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	_, err := r.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, ticketKey(ticket.ID), ticket)
+		pipe.Expire(ctx, ticketKey(ticket.ID), r.ttl)
+		pipe.LPush(ctx, ticketQueueKey, ticket.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ticket, nil
+}
+
+// Dequeue blocks up to timeout for the next ticket in the queue, returning nil, nil if there was none.
+// Once popped a ticket belongs to this worker. If the process dies before SetResult,
+// the ticket stays pending until it expires.
+func (r *TicketRepository) Dequeue(ctx context.Context, timeout time.Duration) (*model.ClaimTicket, error) {
+	res, err := r.redis.BRPop(ctx, timeout, ticketQueueKey).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// res is [key, value]
+	ticket, err := r.Get(ctx, res[1])
+	if errors.Is(err, ErrTicketNotFound) {
+		// Expired while waiting in the queue, nobody is polling for it anymore
+		return nil, nil
+	}
+	return ticket, err
+}
+
+// SetResult records the final status of a ticket
+func (r *TicketRepository) SetResult(ctx context.Context, id string, status string, errMsg string) error {
+	return r.redis.HSet(ctx, ticketKey(id),
+		"status", status,
+		"error", errMsg,
+		"updated_at", time.Now(),
+	).Err()
+}
+
+func (r *TicketRepository) Get(ctx context.Context, id string) (*model.ClaimTicket, error) {
+	cmd := r.redis.HGetAll(ctx, ticketKey(id))
+	if err := cmd.Err(); err != nil {
+		return nil, err
+	}
+	if len(cmd.Val()) == 0 {
+		return nil, ErrTicketNotFound
+	}
+
+	var ticket model.ClaimTicket
+	if err := cmd.Scan(&ticket); err != nil {
+		return nil, err
+	}
+	ticket.ID = id
+
+	return &ticket, nil
+}
@@ -1,30 +1,179 @@
 package repository
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
 	"gorm.io/gorm"
 )
 
-type UserRepository struct {
-	DB *gorm.DB
+var ErrUserAlreadyExists = errors.New("user already exists")
+
+// UserRepository stores users. A user ref is the external user_id, falling back to the numeric ID. Only lookups
+// take a ref, changes take the user_id itself so an unknown user_id can't land on another user's numeric ID.
+type UserRepository interface {
+	Create(ctx context.Context, user *model.User) error
+	CreateBatch(ctx context.Context, users []model.User) ([]string, error)
+	FindAll(ctx context.Context, page pagination.Params) ([]model.User, error)
+	FindByRef(ctx context.Context, ref string) (*model.User, error)
+	Update(ctx context.Context, userID string, name string) (*model.User, error)
+	Upsert(ctx context.Context, user *model.User) (created bool, err error)
+	Delete(ctx context.Context, userID string) error
+}
+
+type userRepository struct {
+	db *gorm.DB
+}
+
+func NewUserRepository(db *gorm.DB) UserRepository {
+	return &userRepository{db: db}
 }
 
-func NewUserRepository(db *gorm.DB) *UserRepository {
-	return &UserRepository{DB: db}
+func (r *userRepository) Create(ctx context.Context, user *model.User) error {
+	err := r.db.WithContext(ctx).Create(user).Error
+	if isUniqueViolation(err) {
+		return ErrUserAlreadyExists
+	}
+	return err
 }
 
-func (r *UserRepository) Create(user *model.User) error {
-	return r.DB.Create(user).Error
+// CreateBatch inserts the users with one multi-row INSERT and returns the user_ids that were inserted.
+// Users whose user_id already exists are skipped, not updated. The batch must not repeat a user_id.
+func (r *userRepository) CreateBatch(ctx context.Context, users []model.User) ([]string, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	values := make([]string, len(users))
+	args := make([]interface{}, 0, 2*len(users))
+	for i, user := range users {
+		values[i] = "(?, ?)"
+		args = append(args, user.Name, user.UserID)
+	}
+
+	var inserted []string
+	err := r.db.WithContext(ctx).Raw("INSERT INTO users (name, user_id) VALUES "+strings.Join(values, ", ")+
+		" ON CONFLICT (user_id) DO NOTHING RETURNING user_id", args...).
+		Scan(&inserted).Error
+	return inserted, err
 }
 
-func (r *UserRepository) FindAll() ([]model.User, error) {
+// FindAll returns one page of users ordered by ID (up to page.Limit+1 rows, so the caller can tell whether there's more)
+func (r *userRepository) FindAll(ctx context.Context, page pagination.Params) ([]model.User, error) {
 	var users []model.User
-	err := r.DB.Find(&users).Error
+	err := r.db.WithContext(ctx).Where("id > ?", page.After).Order("id").Limit(page.Limit + 1).Find(&users).Error
 	return users, err
 }
 
-func (r *UserRepository) FindByID(id uint) (model.User, error) {
-	var user model.User
-	err := r.DB.First(&user, id).Error
-	return user, err
+// FindByRef looks a user up by external user_id, falling back to the numeric ID
+func (r *userRepository) FindByRef(ctx context.Context, ref string) (*model.User, error) {
+	return findUserByRef(r.db.WithContext(ctx), ref)
+}
+
+// Update renames the user, user_id itself can't change since claims reference it
+func (r *userRepository) Update(ctx context.Context, userID string, name string) (*model.User, error) {
+	db := r.db.WithContext(ctx)
+	user, err := findUserByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(user).Update("name", name).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Upsert creates the user with the given user_id, or renames it when it already exists.
+// created tells which one happened.
+func (r *userRepository) Upsert(ctx context.Context, user *model.User) (created bool, err error) {
+	var row struct {
+		model.User
+		Inserted bool
+	}
+	// xmax is only 0 on a freshly inserted row
+	err = r.db.WithContext(ctx).Raw(`INSERT INTO users (name, user_id) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id, name, user_id, (xmax = 0) AS inserted`, user.Name, user.UserID).
+		Scan(&row).Error
+	if err != nil {
+		return false, err
+	}
+
+	*user = row.User
+	return row.Inserted, nil
+}
+
+// Delete removes the user and revokes their claims: every claim is deleted, its unit goes back to the
+// coupon's stock and a coupon.revoked event is written. Entries of lotteries not drawn yet are dropped too,
+// entries of drawn ones stay as the record the draw is verified against.
+func (r *userRepository) Delete(ctx context.Context, userID string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, err := findUserByUserID(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		var claims []model.CouponClaims
+		err = tx.Preload("Coupon", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+			Where("user_id = ?", user.UserID).Order("coupon_id").Find(&claims).Error
+		if err != nil {
+			return err
+		}
+
+		events := make([]model.Event, 0, len(claims))
+		for _, claim := range claims {
+			remaining, err := returnStock(tx, &claim.Coupon, user.UserID)
+			if err != nil {
+				return err
+			}
+			events = append(events, revokedEvent(&claim.Coupon, user.UserID, remaining))
+		}
+
+		if err := tx.Where("user_id = ?", user.UserID).Delete(&model.CouponClaims{}).Error; err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? AND status = ?", user.UserID, model.EntryStatusPending).Delete(&model.CouponEntry{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(user).Error; err != nil {
+			return err
+		}
+
+		return writeOutbox(tx, events...)
+	})
+}
+
+// returnStock puts one unit back into the coupon (into the user's shard for sharded coupons)
+// and returns the stock left afterwards. The row lock taken by the UPDATE orders it with concurrent claims.
+func returnStock(tx *gorm.DB, coupon *model.Coupon, userID string) (int, error) {
+	if coupon.Shards > 1 {
+		err := tx.Model(&model.CouponShard{}).
+			Where("coupon_id = ? AND shard_index = ?", coupon.ID, shardFor(userID, coupon.Shards)).
+			Update("remaining", gorm.Expr("remaining + 1")).Error
+		if err != nil {
+			return 0, err
+		}
+		return shardedRemaining(tx, coupon.ID)
+	}
+
+	err := tx.Model(&model.Coupon{}).Unscoped().
+		Where("id = ?", coupon.ID).
+		Updates(map[string]interface{}{
+			"remaining_amount": gorm.Expr("remaining_amount + 1"),
+			"updated_at":       time.Now(),
+		}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var remaining int
+	err = tx.Model(&model.Coupon{}).Unscoped().
+		Where("id = ?", coupon.ID).Select("remaining_amount").Scan(&remaining).Error
+	return remaining, err
 }
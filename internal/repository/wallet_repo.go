@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// errUnknownUser is what claims and entries fail with when the user_id doesn't exist.
+// It's deliberately not ErrUserNotFound, callers report it as a plain error.
+func errUnknownUser(userID string) error {
+	return fmt.Errorf("user not found: %s", userID)
+}
+
+// findUserByUserID looks a user up by external user_id only
+func findUserByUserID(db *gorm.DB, userID string) (*model.User, error) {
+	var user model.User
+	if err := db.Where("user_id = ?", userID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// findUserByRef looks a user up by external user_id, falling back to the numeric primary key.
+// A numeric user_id wins over a primary key with the same value.
+func findUserByRef(db *gorm.DB, ref string) (*model.User, error) {
+	var user model.User
+	err := db.Where("user_id = ?", ref).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if id, convErr := strconv.ParseUint(ref, 10, 64); convErr == nil {
+			err = db.First(&user, id).Error
+		}
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListUserClaims returns the user and one page of their claims, newest first (up to page.Limit+1 rows).
+// Claims keep their coupon even when it was deleted since, the wallet is history too.
+func (r *couponRepository) ListUserClaims(ctx context.Context, userRef string, page pagination.Params) (*model.User, []model.CouponClaims, error) {
+	user, err := findUserByRef(r.db.WithContext(ctx), userRef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := r.db.WithContext(ctx).
+		Preload("Coupon", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+		Where("user_id = ?", user.UserID)
+	if page.After != 0 {
+		q = q.Where("id < ?", page.After)
+	}
+
+	var claims []model.CouponClaims
+	err = q.Order("id DESC").Limit(page.Limit + 1).Find(&claims).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, claims, nil
+}
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+type WebhookRepository struct {
+	db *gorm.DB
+}
+
+func NewWebhookRepository(db *gorm.DB) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+func (r *WebhookRepository) CreateSubscription(ctx context.Context, sub *model.WebhookSubscription) error {
+	return r.db.WithContext(ctx).Create(sub).Error
+}
+
+func (r *WebhookRepository) ListSubscriptions(ctx context.Context) ([]model.WebhookSubscription, error) {
+	var subs []model.WebhookSubscription
+	err := r.db.WithContext(ctx).Order("id").Find(&subs).Error
+	return subs, err
+}
+
+func (r *WebhookRepository) ActiveSubscriptions(ctx context.Context) ([]model.WebhookSubscription, error) {
+	var subs []model.WebhookSubscription
+	err := r.db.WithContext(ctx).Where("active = ?", true).Find(&subs).Error
+	return subs, err
+}
+
+func (r *WebhookRepository) GetSubscription(ctx context.Context, id uint) (*model.WebhookSubscription, error) {
+	var sub model.WebhookSubscription
+	if err := r.db.WithContext(ctx).First(&sub, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// DeleteSubscription removes a subscription, its deliveries go with it (ON DELETE CASCADE)
+func (r *WebhookRepository) DeleteSubscription(ctx context.Context, id uint) error {
+	res := r.db.WithContext(ctx).Delete(&model.WebhookSubscription{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// CreateDeliveries queues the deliveries, skipping those of an event the subscription already has one of
+func (r *WebhookRepository) CreateDeliveries(ctx context.Context, deliveries []model.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries).Error
+}
+
+// ClaimDueDeliveries picks up to limit pending deliveries that are due, and leases them until leaseUntil
+// by pushing next_attempt_at forward. SKIP LOCKED lets several instances dispatch without sending twice.
+func (r *WebhookRepository) ClaimDueDeliveries(ctx context.Context, now time.Time, leaseUntil time.Time, limit int) ([]model.WebhookDelivery, error) {
+	var ids []uint
+	err := r.db.WithContext(ctx).Raw(`
+		UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id
+	`, leaseUntil, model.DeliveryStatusPending, now, limit).Scan(&ids).Error
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	var deliveries []model.WebhookDelivery
+	err = r.db.WithContext(ctx).Preload("Subscription").Where("id IN ?", ids).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+// SaveAttempt records the outcome of a delivery attempt
+func (r *WebhookRepository) SaveAttempt(ctx context.Context, d *model.WebhookDelivery) error {
+	return r.db.WithContext(ctx).Model(d).Updates(map[string]interface{}{
+		"status":           d.Status,
+		"attempts":         d.Attempts,
+		"next_attempt_at":  d.NextAttemptAt,
+		"last_error":       d.LastError,
+		"last_status_code": d.LastStatusCode,
+	}).Error
+}
+
+func (r *WebhookRepository) ListDeliveries(ctx context.Context, subscriptionID uint, limit int) ([]model.WebhookDelivery, error) {
+	var deliveries []model.WebhookDelivery
+	err := r.db.WithContext(ctx).Where("subscription_id = ?", subscriptionID).
+		Order("id DESC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Redeliver puts a delivery (usually a dead one) back in the queue with a fresh attempt budget
+func (r *WebhookRepository) Redeliver(ctx context.Context, id uint) (*model.WebhookDelivery, error) {
+	var delivery model.WebhookDelivery
+	if err := r.db.WithContext(ctx).First(&delivery, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeliveryNotFound
+		}
+		return nil, err
+	}
+
+	delivery.Status = model.DeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	if err := r.SaveAttempt(ctx, &delivery); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+var ErrTicketNotFound = errors.New("claim ticket not found")
+
+// WithAsyncClaims switches claims to ticket mode: SubmitClaim only queues the claim,
+// and the workers started by RunClaimWorkers settle it in the background. A worker waits up to pollTimeout
+// on the queue at a time, and settles a ticket within claimTimeout.
+func WithAsyncClaims(tickets *repository.TicketRepository, pollTimeout time.Duration, claimTimeout time.Duration) CouponServiceOption {
+	return func(s *couponService) {
+		s.tickets = tickets
+		s.ticketPollTimeout = pollTimeout
+		s.ticketClaimTimeout = claimTimeout
+	}
+}
+
+func (s *couponService) AsyncClaims() bool {
+	return s.tickets != nil
+}
+
+// SubmitClaim queues a claim and returns its ticket right away.
+// The coupon isn't looked up here on purpose, keeping the accept path to a single redis round trip.
+// An unknown coupon ends up as a failed ticket.
+func (s *couponService) SubmitClaim(ctx context.Context, req *ClaimCouponRequest) (*model.ClaimTicket, error) {
+	return s.tickets.Enqueue(ctx, req.UserID, req.CouponName)
+}
+
+func (s *couponService) GetClaimTicket(ctx context.Context, id string) (*model.ClaimTicket, error) {
+	ticket, err := s.tickets.Get(ctx, id)
+	if errors.Is(err, repository.ErrTicketNotFound) {
+		return nil, ErrTicketNotFound
+	}
+	return ticket, err
+}
+
+// RunClaimWorkers processes queued tickets with the given number of workers.
+// It blocks until ctx is done and every worker finished the ticket it was on.
+func (s *couponService) RunClaimWorkers(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.claimWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *couponService) claimWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		ticket, err := s.tickets.Dequeue(ctx, s.ticketPollTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("claim worker: dequeue failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if ticket == nil {
+			continue
+		}
+
+		s.processTicket(ticket)
+	}
+}
+
+// processTicket settles one ticket. It doesn't use the worker context,
+// so a claim that already started is finished even while shutting down.
+func (s *couponService) processTicket(ticket *model.ClaimTicket) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ticketClaimTimeout)
+	defer cancel()
+
+	var status, errMsg string
+	result, err := s.ClaimCoupon(ctx, &ClaimCouponRequest{
+		UserID:     ticket.UserID,
+		CouponName: ticket.CouponName,
+	})
+	switch {
+	case err == nil && result.Status == ClaimStatusEntered:
+		status = model.TicketStatusEntered
+	case err == nil:
+		status = model.TicketStatusWon
+	case errors.Is(err, ErrNoStock):
+		status = model.TicketStatusNoStock
+	case errors.Is(err, ErrAlreadyClaimed), errors.Is(err, ErrAlreadyEntered):
+		status = model.TicketStatusAlreadyClaimed
+	default:
+		status, errMsg = model.TicketStatusFailed, err.Error()
+	}
+
+	if err := s.tickets.SetResult(ctx, ticket.ID, status, errMsg); err != nil {
+		log.Printf("claim worker: failed to record result of ticket %s: %v", ticket.ID, err)
+	}
+}
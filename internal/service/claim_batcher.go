@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// claimBatcher collects claims for the same coupon that arrive within a short window,
+// and writes them in one transaction instead of one transaction (and one lock round trip) each.
+type claimBatcher struct {
+	repo    repository.CouponRepository
+	window  time.Duration
+	maxSize int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*claimBatch
+}
+
+type claimBatch struct {
+	userIDs []string
+	results []chan repository.BatchClaimResult
+	timer   *time.Timer
+}
+
+func newClaimBatcher(repo repository.CouponRepository, window time.Duration, maxSize int, timeout time.Duration) *claimBatcher {
+	return &claimBatcher{
+		repo:    repo,
+		window:  window,
+		maxSize: maxSize,
+		timeout: timeout,
+		pending: make(map[string]*claimBatch),
+	}
+}
+
+// Submit queues a claim into the current batch of the coupon and waits for its own result,
+// returning the stock left right after this claim.
+// If ctx is done first the caller gets ctx.Err(), but the claim may still be written with the batch,
+// same as a client disconnecting mid transaction on the unbatched path.
+func (b *claimBatcher) Submit(ctx context.Context, couponName string, userID string) (int, error) {
+	result := make(chan repository.BatchClaimResult, 1)
+
+	b.mu.Lock()
+	batch, ok := b.pending[couponName]
+	if !ok {
+		batch = &claimBatch{}
+		b.pending[couponName] = batch
+		batch.timer = time.AfterFunc(b.window, func() { b.flush(couponName, batch) })
+	}
+	batch.userIDs = append(batch.userIDs, userID)
+	batch.results = append(batch.results, result)
+	full := len(batch.userIDs) >= b.maxSize
+	if full {
+		// Out of pending right away, so the next claim starts a new batch instead of growing this one
+		delete(b.pending, couponName)
+		batch.timer.Stop()
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.write(couponName, batch)
+	}
+
+	select {
+	case res := <-result:
+		return res.Remaining, res.Err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// flush writes a batch when its window is over, unless it filled up and was written already
+func (b *claimBatcher) flush(couponName string, batch *claimBatch) {
+	b.mu.Lock()
+	if b.pending[couponName] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, couponName)
+	b.mu.Unlock()
+
+	b.write(couponName, batch)
+}
+
+// write claims the batch in one transaction and hands every claim its result. The batch is out of pending already.
+func (b *claimBatcher) write(couponName string, batch *claimBatch) {
+	// Requests have their own contexts, the batch as a whole gets its own budget
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	results, err := b.repo.ClaimCouponBatch(ctx, couponName, batch.userIDs)
+	for i, ch := range batch.results {
+		if err != nil {
+			ch <- repository.BatchClaimResult{Err: err}
+			continue
+		}
+		ch <- results[i]
+	}
+}
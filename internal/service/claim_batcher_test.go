@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// batchSizes records the size of every batch written
+type batchSizes struct {
+	repository.CouponRepository
+
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (r *batchSizes) ClaimCouponBatch(ctx context.Context, couponName string, userIDs []string) ([]repository.BatchClaimResult, error) {
+	r.mu.Lock()
+	r.sizes = append(r.sizes, len(userIDs))
+	r.mu.Unlock()
+	return r.CouponRepository.ClaimCouponBatch(ctx, couponName, userIDs)
+}
+
+func TestClaimBatcherKeepsBatchesUpToMaxSize(t *testing.T) {
+	ctx := context.Background()
+	store := repository.NewMemoryStore()
+	users := repository.NewMemoryUserRepository(store)
+	repo := &batchSizes{CouponRepository: repository.NewMemoryCouponRepository(store, repository.NewMemoryLocker())}
+
+	const claims, maxSize = 200, 8
+	if _, err := repo.CreateCoupon(ctx, &model.Coupon{Name: "HOT", Amount: claims}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < claims; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		if err := users.Create(ctx, &model.User{Name: id, UserID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A long window, batches are only written by filling up (and the last one by the window)
+	b := newClaimBatcher(repo, 50*time.Millisecond, maxSize, time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < claims; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := b.Submit(ctx, "HOT", id); err != nil {
+				t.Errorf("submit %s: %v", id, err)
+			}
+		}(fmt.Sprintf("user-%d", i))
+	}
+	wg.Wait()
+
+	total := 0
+	for _, size := range repo.sizes {
+		if size > maxSize {
+			t.Fatalf("batch of %d claims, max is %d", size, maxSize)
+		}
+		total += size
+	}
+	if total != claims {
+		t.Fatalf("batches held %d claims, want %d", total, claims)
+	}
+}
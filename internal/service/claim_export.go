@@ -0,0 +1,186 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// Export formats
+const (
+	ExportFormatCSV    = "csv"
+	ExportFormatNDJSON = "ndjson"
+)
+
+var (
+	ErrInvalidExportFormat = errors.New("format must be csv or ndjson")
+	ErrInvalidExportColumn = errors.New("unknown export column")
+	ErrInvalidExportRange  = errors.New("to must be after from")
+)
+
+type ClaimExportRequest struct {
+	Format string
+	// Optional filters
+	CouponName string
+	From       time.Time
+	To         time.Time
+	// Empty for every column, see repository.ClaimExportColumns
+	Columns []string
+}
+
+// ClaimExport is a validated export, ready to be written out
+type ClaimExport struct {
+	repo    repository.CouponRepository
+	format  string
+	filter  repository.ClaimExportFilter
+	columns []string
+}
+
+// NewClaimExport checks the request and resolves the coupon, so every error that isn't an I/O error
+// comes up before anything was written
+func (s *couponService) NewClaimExport(ctx context.Context, req *ClaimExportRequest) (*ClaimExport, error) {
+	export := &ClaimExport{
+		repo:    s.repo,
+		format:  req.Format,
+		filter:  repository.ClaimExportFilter{From: req.From, To: req.To},
+		columns: req.Columns,
+	}
+
+	if export.format == "" {
+		export.format = ExportFormatCSV
+	}
+	if export.format != ExportFormatCSV && export.format != ExportFormatNDJSON {
+		return nil, ErrInvalidExportFormat
+	}
+	if !req.From.IsZero() && !req.To.IsZero() && !req.To.After(req.From) {
+		return nil, ErrInvalidExportRange
+	}
+
+	if len(export.columns) == 0 {
+		export.columns = repository.ClaimExportColumns
+	}
+	known := make(map[string]bool, len(repository.ClaimExportColumns))
+	for _, column := range repository.ClaimExportColumns {
+		known[column] = true
+	}
+	for _, column := range export.columns {
+		if !known[column] {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidExportColumn, column)
+		}
+	}
+
+	// Deleted coupons are part of the history, their claims are exported by name too. A name taken again after
+	// a delete covers the claims of every coupon that had it.
+	if req.CouponName != "" {
+		coupons, err := s.repo.FindCouponsByName(ctx, req.CouponName)
+		if err != nil {
+			return nil, translateError(err)
+		}
+		for _, coupon := range coupons {
+			export.filter.CouponIDs = append(export.filter.CouponIDs, coupon.ID)
+		}
+	}
+
+	return export, nil
+}
+
+func (e *ClaimExport) ContentType() string {
+	if e.format == ExportFormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+func (e *ClaimExport) FileExtension() string {
+	return e.format
+}
+
+// Stream writes the claims to w, one row at a time. An error halfway leaves a truncated export behind.
+func (e *ClaimExport) Stream(ctx context.Context, w io.Writer) error {
+	if e.format == ExportFormatNDJSON {
+		return e.writeNDJSON(ctx, w)
+	}
+	return e.writeCSV(ctx, w)
+}
+
+func (e *ClaimExport) writeCSV(ctx context.Context, w io.Writer) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(e.columns); err != nil {
+		return err
+	}
+
+	record := make([]string, len(e.columns))
+	err := e.repo.ExportClaims(ctx, e.filter, e.columns, func(values []interface{}) error {
+		for i, value := range values {
+			record[i] = exportCSVValue(value)
+		}
+		return out.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// writeNDJSON writes the objects by hand, a map would lose the column order
+func (e *ClaimExport) writeNDJSON(ctx context.Context, w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	keys := make([][]byte, len(e.columns))
+	for i, column := range e.columns {
+		key, _ := json.Marshal(column)
+		keys[i] = key
+	}
+
+	err := e.repo.ExportClaims(ctx, e.filter, e.columns, func(values []interface{}) error {
+		out.WriteByte('{')
+		for i, value := range values {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			out.Write(keys[i])
+			out.WriteByte(':')
+			out.Write(encoded)
+		}
+		_, err := out.WriteString("}\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return out.Flush()
+}
+
+func exportCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
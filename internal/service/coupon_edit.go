@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+type UpdateCouponRequest struct {
+	Name          *string
+	Amount        *int
+	StartsAt      *time.Time
+	ExpiresAt     *time.Time
+	EntryDeadline *time.Time
+}
+
+// UpdateCoupon edits the coupon. ifMatch is the If-Match header, empty to update whatever version is current.
+func (s *couponService) UpdateCoupon(ctx context.Context, name string, ifMatch string, req *UpdateCouponRequest) (*model.Coupon, error) {
+	coupon, err := s.repo.UpdateCoupon(ctx, name, ifMatch, repository.CouponPatch{
+		Name:          req.Name,
+		Amount:        req.Amount,
+		StartsAt:      req.StartsAt,
+		ExpiresAt:     req.ExpiresAt,
+		EntryDeadline: req.EntryDeadline,
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	// A rename leaves the details under the old name behind
+	s.invalidateDetails(ctx, name)
+	return coupon, nil
+}
+
+// SetArchived archives (or brings back) a coupon, archived coupons can't be claimed
+func (s *couponService) SetArchived(ctx context.Context, name string, ifMatch string, archived bool) (*model.Coupon, error) {
+	coupon, err := s.repo.SetArchived(ctx, name, ifMatch, archived)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	// The ETag changed
+	s.invalidateDetails(ctx, name)
+	return coupon, nil
+}
+
+// DeleteCoupon soft deletes a coupon, its claims stay
+func (s *couponService) DeleteCoupon(ctx context.Context, name string, ifMatch string) error {
+	if err := s.repo.DeleteCoupon(ctx, name, ifMatch); err != nil {
+		return translateError(err)
+	}
+	s.invalidateDetails(ctx, name)
+	return nil
+}
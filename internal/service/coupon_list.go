@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+type ListCouponsRequest struct {
+	Status     string
+	NamePrefix string
+	Sort       string
+	Page       pagination.Params
+}
+
+type CouponSummary struct {
+	Name            string     `json:"name"`
+	Mode            string     `json:"mode"`
+	Status          string     `json:"status"`
+	Amount          int        `json:"amount"`
+	RemainingAmount int        `json:"remaining_amount"`
+	StartsAt        *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type CouponListResponse struct {
+	Coupons    []CouponSummary `json:"coupons"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// ListCoupons lists coupons, newest first unless req.Sort says otherwise
+func (s *couponService) ListCoupons(ctx context.Context, req *ListCouponsRequest) (*CouponListResponse, error) {
+	sort := req.Sort
+	if sort == "" {
+		sort = "-created_at"
+	}
+
+	coupons, err := s.repo.ListCoupons(ctx, repository.CouponFilter{
+		Status:     req.Status,
+		NamePrefix: req.NamePrefix,
+		Sort:       sort,
+	}, req.Page)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	coupons, next := pagination.KeyedPage(coupons, req.Page, func(c model.Coupon) (string, uint) {
+		return repository.CouponSortKey(c, sort), c.ID
+	})
+
+	now := time.Now()
+	resp := &CouponListResponse{
+		Coupons:    make([]CouponSummary, len(coupons)),
+		NextCursor: next,
+	}
+	for i, c := range coupons {
+		resp.Coupons[i] = CouponSummary{
+			Name:            c.Name,
+			Mode:            c.Mode,
+			Status:          c.Status(c.RemainingAmount, now),
+			Amount:          c.Amount,
+			RemainingAmount: c.RemainingAmount,
+			StartsAt:        c.StartsAt,
+			ExpiresAt:       c.ExpiresAt,
+			CreatedAt:       c.CreatedAt,
+		}
+	}
+
+	return resp, nil
+}
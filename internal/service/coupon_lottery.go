@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// DrawLottery draws the winners of a lottery coupon.
+// If seed is nil a random one is generated, either way it's recorded so the draw can be re-run.
+func (s *couponService) DrawLottery(ctx context.Context, name string, seed *int64) (*DrawResponse, error) {
+	var drawSeed int64
+	if seed != nil {
+		drawSeed = *seed
+	} else {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		// Keep it positive, negative seeds look weird in audit logs
+		drawSeed = int64(binary.BigEndian.Uint64(b[:]) >> 1)
+	}
+
+	draw, winners, err := s.repo.DrawLottery(ctx, name, drawSeed)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	s.invalidateDetails(ctx, name)
+
+	return &DrawResponse{
+		CouponName:  name,
+		Seed:        draw.Seed,
+		EntryCount:  draw.EntryCount,
+		WinnerCount: draw.WinnerCount,
+		Winners:     winners,
+		DrawnAt:     draw.CreatedAt,
+	}, nil
+}
+
+// VerifyDraw re-runs a recorded draw with its seed and checks the result against the stored entry statuses
+func (s *couponService) VerifyDraw(ctx context.Context, name string) (*DrawResponse, error) {
+	coupon, draw, entries, err := s.repo.GetDraw(ctx, name)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	recorded := make(map[string]bool)
+	for _, e := range entries {
+		if e.Status == model.EntryStatusWon {
+			recorded[e.UserID] = true
+		}
+	}
+
+	rerun := repository.DrawWinners(entries, draw.Seed, draw.Stock)
+	winners := make([]string, len(rerun))
+	verified := len(entries) == draw.EntryCount && len(rerun) == len(recorded)
+	for i, w := range rerun {
+		winners[i] = w.UserID
+		if !recorded[w.UserID] {
+			verified = false
+		}
+	}
+
+	return &DrawResponse{
+		CouponName:  coupon.Name,
+		Seed:        draw.Seed,
+		EntryCount:  draw.EntryCount,
+		WinnerCount: draw.WinnerCount,
+		Winners:     winners,
+		DrawnAt:     draw.CreatedAt,
+		Verified:    &verified,
+	}, nil
+}
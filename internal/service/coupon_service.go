@@ -3,31 +3,166 @@ package service
 import (
 	"context"
 	"errors"
+	"log"
+	"time"
 
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
 )
 
 var (
-	ErrCouponNotFound      = errors.New("coupon not found")
-	ErrCouponAlreadyExists = errors.New("coupon already exists")
-	ErrNoStock             = errors.New("no stock available")
-	ErrAlreadyClaimed      = errors.New("coupon already claimed by user")
+	ErrCouponNotFound        = errors.New("coupon not found")
+	ErrCouponAlreadyExists   = errors.New("coupon already exists")
+	ErrNoStock               = errors.New("no stock available")
+	ErrAlreadyClaimed        = errors.New("coupon already claimed by user")
+	ErrNotLottery            = errors.New("coupon is not a lottery coupon")
+	ErrAlreadyEntered        = errors.New("user already entered this lottery")
+	ErrEntriesClosed         = errors.New("lottery entries are closed")
+	ErrEntriesStillOpen      = errors.New("lottery entries are still open")
+	ErrAlreadyDrawn          = errors.New("lottery already drawn")
+	ErrDrawNotFound          = errors.New("lottery not drawn yet")
+	ErrShardedLottery        = errors.New("sharding is only supported for fcfs coupons")
+	ErrInvalidWindow         = errors.New("expires_at must be after starts_at")
+	ErrCouponNotStarted      = errors.New("coupon is not claimable yet")
+	ErrCouponExpired         = errors.New("coupon expired")
+	ErrInvalidSort           = errors.New("sort must be one of created_at, -created_at, remaining_amount, -remaining_amount")
+	ErrInvalidCursor         = errors.New("invalid cursor")
+	ErrUserNotFound          = errors.New("user not found")
+	ErrCouponArchived        = errors.New("coupon is archived")
+	ErrPreconditionFailed    = errors.New("coupon was modified, ETag does not match")
+	ErrAmountBelowClaimed    = errors.New("amount can't go below the number of claims")
+	ErrInvalidDiscount       = errors.New("discount_type must be percent (discount_value 1-100) or fixed (discount_value above 0)")
+	ErrTemplateNotFound      = errors.New("coupon template not found")
+	ErrTemplateAlreadyExists = errors.New("coupon template already exists")
 )
 
-type CouponService struct {
-	repo *repository.CouponRepository
+// Claim result statuses
+const (
+	ClaimStatusClaimed = "claimed"
+	ClaimStatusEntered = "entered"
+)
+
+// CouponService is what the coupon handlers are built on. Errors are the Err* values of this package.
+type CouponService interface {
+	CreateCoupon(ctx context.Context, req *CreateCouponRequest) (*model.Coupon, error)
+	GetCouponDetails(ctx context.Context, name string, page pagination.Params) (*CouponDetailsResponse, error)
+	ListCoupons(ctx context.Context, req *ListCouponsRequest) (*CouponListResponse, error)
+	GetStock(ctx context.Context, name string) (*model.StockUpdate, error)
+	UpdateCoupon(ctx context.Context, name string, ifMatch string, req *UpdateCouponRequest) (*model.Coupon, error)
+	SetArchived(ctx context.Context, name string, ifMatch string, archived bool) (*model.Coupon, error)
+	DeleteCoupon(ctx context.Context, name string, ifMatch string) error
+
+	// Claims
+	ClaimCoupon(ctx context.Context, req *ClaimCouponRequest) (*ClaimCouponResult, error)
+	ListClaims(ctx context.Context, name string, page pagination.Params) (*ClaimListResponse, error)
+	GetWallet(ctx context.Context, userRef string, page pagination.Params) (*WalletResponse, error)
+	NewClaimExport(ctx context.Context, req *ClaimExportRequest) (*ClaimExport, error)
+
+	// Async claims, see WithAsyncClaims
+	AsyncClaims() bool
+	SubmitClaim(ctx context.Context, req *ClaimCouponRequest) (*model.ClaimTicket, error)
+	GetClaimTicket(ctx context.Context, id string) (*model.ClaimTicket, error)
+	RunClaimWorkers(ctx context.Context, workers int)
+
+	// Lottery
+	DrawLottery(ctx context.Context, name string, seed *int64) (*DrawResponse, error)
+	VerifyDraw(ctx context.Context, name string) (*DrawResponse, error)
+
+	// Templates
+	CreateTemplate(ctx context.Context, req *CreateTemplateRequest) (*model.CouponTemplate, error)
+	ListTemplates(ctx context.Context) ([]model.CouponTemplate, error)
+	GetTemplate(ctx context.Context, name string) (*model.CouponTemplate, error)
+	DeleteTemplate(ctx context.Context, name string) error
+	CreateCouponsFromTemplate(ctx context.Context, templateName string, items []CouponOverride) (*BulkCouponResponse, error)
+}
+
+type couponService struct {
+	repo    repository.CouponRepository
+	batcher *claimBatcher
+	tickets *repository.TicketRepository
+	// How long a claim worker waits on the queue at a time, and may take to settle a ticket
+	ticketPollTimeout  time.Duration
+	ticketClaimTimeout time.Duration
+	// Optional, see WithDetailsCache
+	detailsCache *DetailsCache
 }
 
-func NewCouponService(repo *repository.CouponRepository) *CouponService {
-	return &CouponService{
+// CouponServiceOption turns on an optional claim mode
+type CouponServiceOption func(*couponService)
+
+func NewCouponService(repo repository.CouponRepository, opts ...CouponServiceOption) CouponService {
+	s := &couponService{
 		repo: repo,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithBatching turns on group commit for fcfs claims: claims for the same coupon arriving within
+// window are written together in one transaction, up to maxSize claims per transaction. Writing a batch
+// may take up to timeout.
+func WithBatching(window time.Duration, maxSize int, timeout time.Duration) CouponServiceOption {
+	return func(s *couponService) {
+		s.batcher = newClaimBatcher(s.repo, window, maxSize, timeout)
+	}
 }
 
 type CreateCouponRequest struct {
-	Name   string `json:"name" binding:"required"`
-	Amount int    `json:"amount" binding:"required,min=1"`
+	Name          string                 `json:"name" binding:"required"`
+	Amount        int                    `json:"amount" binding:"required,min=1"`
+	Mode          string                 `json:"mode" binding:"omitempty,oneof=fcfs lottery"`
+	EntryDeadline *time.Time             `json:"entry_deadline"`
+	Shards        int                    `json:"shards" binding:"omitempty,min=1,max=256"`
+	StartsAt      *time.Time             `json:"starts_at"`
+	ExpiresAt     *time.Time             `json:"expires_at"`
+	DiscountType  string                 `json:"discount_type"`
+	DiscountValue int                    `json:"discount_value"`
+	Rules         map[string]interface{} `json:"rules"`
+}
+
+// validate checks what binding can't, the same rules hold for coupons created one by one or from a template
+func (req *CreateCouponRequest) validate() error {
+	if req.Mode == model.CouponModeLottery && req.Shards > 1 {
+		return ErrShardedLottery
+	}
+	if req.StartsAt != nil && req.ExpiresAt != nil && !req.ExpiresAt.After(*req.StartsAt) {
+		return ErrInvalidWindow
+	}
+	switch req.DiscountType {
+	case "":
+		if req.DiscountValue != 0 {
+			return ErrInvalidDiscount
+		}
+	case model.DiscountTypePercent:
+		if req.DiscountValue < 1 || req.DiscountValue > 100 {
+			return ErrInvalidDiscount
+		}
+	case model.DiscountTypeFixed:
+		if req.DiscountValue < 1 {
+			return ErrInvalidDiscount
+		}
+	default:
+		return ErrInvalidDiscount
+	}
+	return nil
+}
+
+func (req *CreateCouponRequest) toModel() *model.Coupon {
+	return &model.Coupon{
+		Name:          req.Name,
+		Amount:        req.Amount,
+		Mode:          req.Mode,
+		EntryDeadline: req.EntryDeadline,
+		Shards:        req.Shards,
+		StartsAt:      req.StartsAt,
+		ExpiresAt:     req.ExpiresAt,
+		DiscountType:  req.DiscountType,
+		DiscountValue: req.DiscountValue,
+		Rules:         req.Rules,
+	}
 }
 
 type ClaimCouponRequest struct {
@@ -35,49 +170,164 @@ type ClaimCouponRequest struct {
 	CouponName string `json:"coupon_name" binding:"required"`
 }
 
+type ClaimCouponResult struct {
+	Status string `json:"status"`
+}
+
 type CouponDetailsResponse struct {
 	Name            string   `json:"name"`
 	Amount          int      `json:"amount"`
 	RemainingAmount int      `json:"remaining_amount"`
 	ClaimedBy       []string `json:"claimed_by"`
+	// Cursor of the next page of claimed_by, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Sent as the ETag header, see model.Coupon.ETag
+	ETag string `json:"-"`
+}
+
+type ClaimResponse struct {
+	UserID    string    `json:"user_id"`
+	ClaimedAt time.Time `json:"claimed_at"`
 }
 
-func (s *CouponService) CreateCoupon(ctx context.Context, req *CreateCouponRequest) (*model.Coupon, error) {
-	// Check if coupon already exists
-	_, err := s.repo.GetCouponByName(ctx, req.Name)
-	if err == nil {
-		return nil, ErrCouponAlreadyExists
+type ClaimListResponse struct {
+	CouponName string          `json:"coupon_name"`
+	Claims     []ClaimResponse `json:"claims"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type DrawResponse struct {
+	CouponName  string    `json:"coupon_name"`
+	Seed        int64     `json:"seed"`
+	EntryCount  int       `json:"entry_count"`
+	WinnerCount int       `json:"winner_count"`
+	Winners     []string  `json:"winners"`
+	DrawnAt     time.Time `json:"drawn_at"`
+	// Only set when verifying, true if re-running the draw with Seed gives the recorded winners
+	Verified *bool `json:"verified,omitempty"`
+}
+
+// translateError maps repository errors into service errors, so the controller only needs to know about this package
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrCouponNotFound):
+		return ErrCouponNotFound
+	case errors.Is(err, repository.ErrCouponAlreadyExists):
+		return ErrCouponAlreadyExists
+	case errors.Is(err, repository.ErrAlreadyClaimed):
+		return ErrAlreadyClaimed
+	case errors.Is(err, repository.ErrCouponArchived):
+		return ErrCouponArchived
+	case errors.Is(err, repository.ErrCouponNotStarted):
+		return ErrCouponNotStarted
+	case errors.Is(err, repository.ErrCouponExpired):
+		return ErrCouponExpired
+	case errors.Is(err, repository.ErrNoStock):
+		return ErrNoStock
+	case errors.Is(err, repository.ErrNotLottery):
+		return ErrNotLottery
+	case errors.Is(err, repository.ErrAlreadyEntered):
+		return ErrAlreadyEntered
+	case errors.Is(err, repository.ErrEntriesClosed):
+		return ErrEntriesClosed
+	case errors.Is(err, repository.ErrEntriesStillOpen):
+		return ErrEntriesStillOpen
+	case errors.Is(err, repository.ErrAlreadyDrawn):
+		return ErrAlreadyDrawn
+	case errors.Is(err, repository.ErrDrawNotFound):
+		return ErrDrawNotFound
+	case errors.Is(err, repository.ErrUserNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, repository.ErrUserAlreadyExists):
+		return ErrUserAlreadyExists
+	case errors.Is(err, repository.ErrPreconditionFailed):
+		return ErrPreconditionFailed
+	case errors.Is(err, repository.ErrAmountBelowClaimed):
+		return ErrAmountBelowClaimed
+	case errors.Is(err, repository.ErrInvalidWindow):
+		return ErrInvalidWindow
+	case errors.Is(err, repository.ErrTemplateNotFound):
+		return ErrTemplateNotFound
+	case errors.Is(err, repository.ErrTemplateAlreadyExists):
+		return ErrTemplateAlreadyExists
+	case errors.Is(err, repository.ErrInvalidExportColumn):
+		return ErrInvalidExportColumn
+	case errors.Is(err, repository.ErrInvalidSort):
+		return ErrInvalidSort
+	case errors.Is(err, pagination.ErrInvalidCursor):
+		return ErrInvalidCursor
 	}
-	if !errors.Is(err, repository.ErrCouponNotFound) {
+	return err
+}
+
+func (s *couponService) CreateCoupon(ctx context.Context, req *CreateCouponRequest) (*model.Coupon, error) {
+	if err := req.validate(); err != nil {
 		return nil, err
 	}
 
-	// Create new coupon
-	return s.repo.CreateCoupon(ctx, req.Name, req.Amount)
+	coupon, err := s.repo.CreateCoupon(ctx, req.toModel())
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return coupon, nil
 }
 
-func (s *CouponService) ClaimCoupon(ctx context.Context, req *ClaimCouponRequest) error {
-	err := s.repo.ClaimCoupon(ctx, req.UserID, req.CouponName)
-	if err == nil {
-		return nil
+// ClaimCoupon claims an FCFS coupon right away, or records an entry for a lottery coupon
+func (s *couponService) ClaimCoupon(ctx context.Context, req *ClaimCouponRequest) (*ClaimCouponResult, error) {
+	coupon, err := s.repo.GetCouponByName(ctx, req.CouponName)
+	if err != nil {
+		return nil, translateError(err)
 	}
 
-	// Quick fix error handling at controller
-	if errors.Is(err, repository.ErrCouponNotFound) {
-		return ErrCouponNotFound
+	// Checked again by the repository under the coupon's lock, this only fails early
+	if coupon.ArchivedAt != nil {
+		return nil, ErrCouponArchived
 	}
-	if errors.Is(err, repository.ErrAlreadyClaimed) {
-		return ErrAlreadyClaimed
+
+	now := time.Now()
+	if coupon.StartsAt != nil && now.Before(*coupon.StartsAt) {
+		return nil, ErrCouponNotStarted
 	}
-	if errors.Is(err, repository.ErrNoStock) {
-		return ErrNoStock
+	if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+		return nil, ErrCouponExpired
 	}
 
-	return err
+	if coupon.Mode == model.CouponModeLottery {
+		if err := s.repo.CreateEntry(ctx, req.UserID, req.CouponName); err != nil {
+			return nil, translateError(err)
+		}
+		return &ClaimCouponResult{Status: ClaimStatusEntered}, nil
+	}
+
+	// Claim events are written to the outbox by the repository, in the claim transaction
+	if coupon.Shards > 1 {
+		_, err = s.repo.ClaimShardedCoupon(ctx, req.UserID, coupon)
+	} else if s.batcher != nil {
+		_, err = s.batcher.Submit(ctx, req.CouponName, req.UserID)
+	} else {
+		_, err = s.repo.ClaimCoupon(ctx, req.UserID, req.CouponName)
+	}
+	// Quick fix error handling at controller
+	if err != nil {
+		return nil, translateError(err)
+	}
+	s.invalidateDetails(ctx, req.CouponName)
+
+	return &ClaimCouponResult{Status: ClaimStatusClaimed}, nil
 }
 
-func (s *CouponService) GetCouponDetails(ctx context.Context, name string) (*CouponDetailsResponse, error) {
-	coupon, claimedBy, err := s.repo.GetCouponDetails(ctx, name)
+// GetCouponDetails returns the coupon with one page of claimed_by, oldest claim first
+func (s *couponService) GetCouponDetails(ctx context.Context, name string, page pagination.Params) (*CouponDetailsResponse, error) {
+	if s.detailsCache != nil {
+		return s.detailsCache.Get(ctx, name, page, func(ctx context.Context) (*CouponDetailsResponse, error) {
+			return s.loadCouponDetails(ctx, name, page)
+		})
+	}
+	return s.loadCouponDetails(ctx, name, page)
+}
+
+func (s *couponService) loadCouponDetails(ctx context.Context, name string, page pagination.Params) (*CouponDetailsResponse, error) {
+	coupon, claims, err := s.repo.GetCouponDetails(ctx, name, page)
 	if err != nil {
 		if errors.Is(err, repository.ErrCouponNotFound) {
 			return nil, ErrCouponNotFound
@@ -85,10 +335,54 @@ func (s *CouponService) GetCouponDetails(ctx context.Context, name string) (*Cou
 		return nil, err
 	}
 
+	claims, next := pagination.Page(claims, page, func(c model.CouponClaims) uint { return c.ID })
+	claimedBy := make([]string, len(claims))
+	for i, claim := range claims {
+		claimedBy[i] = claim.UserID
+	}
+
 	return &CouponDetailsResponse{
 		Name:            coupon.Name,
 		Amount:          coupon.Amount,
 		RemainingAmount: coupon.RemainingAmount,
 		ClaimedBy:       claimedBy,
+		NextCursor:      next,
+		ETag:            coupon.ETag(),
 	}, nil
 }
+
+// invalidateDetails drops the cached details of the coupons after the service changed them. The change already
+// happened, so a failure is only logged: claims are invalidated again by their outbox events, anything else
+// may be stale until the cache TTL.
+func (s *couponService) invalidateDetails(ctx context.Context, names ...string) {
+	if s.detailsCache == nil {
+		return
+	}
+	// The change is done even if the request went away meanwhile
+	ctx = context.WithoutCancel(ctx)
+	for _, name := range names {
+		if err := s.detailsCache.Invalidate(ctx, name); err != nil {
+			log.Printf("details cache: failed to invalidate %s: %v", name, err)
+		}
+	}
+}
+
+// ListClaims returns one page of the claims of a coupon with their claim time, oldest first
+func (s *couponService) ListClaims(ctx context.Context, name string, page pagination.Params) (*ClaimListResponse, error) {
+	claims, err := s.repo.ListClaims(ctx, name, page)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	claims, next := pagination.Page(claims, page, func(c model.CouponClaims) uint { return c.ID })
+	resp := &ClaimListResponse{
+		CouponName: name,
+		Claims:     make([]ClaimResponse, len(claims)),
+		NextCursor: next,
+	}
+	for i, claim := range claims {
+		resp.Claims[i] = ClaimResponse{UserID: claim.UserID, ClaimedAt: claim.ClaimedAt}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// Bulk create item statuses
+const (
+	BulkStatusCreated = "created"
+	BulkStatusFailed  = "failed"
+)
+
+type CreateTemplateRequest struct {
+	Name          string
+	Amount        int
+	Mode          string
+	Shards        int
+	StartsAt      *time.Time
+	ExpiresAt     *time.Time
+	EntryDeadline *time.Time
+	DiscountType  string
+	DiscountValue int
+	Rules         map[string]interface{}
+}
+
+// CouponOverride is one coupon to create from a template. Name is required, nil fields take the template's value.
+type CouponOverride struct {
+	Name          string
+	Amount        *int
+	Mode          *string
+	Shards        *int
+	StartsAt      *time.Time
+	ExpiresAt     *time.Time
+	EntryDeadline *time.Time
+	DiscountType  *string
+	DiscountValue *int
+	// Replaces the template's rules as a whole
+	Rules map[string]interface{}
+}
+
+// apply builds the create request for the coupon, the template's values overridden by o
+func (o *CouponOverride) apply(template *model.CouponTemplate) *CreateCouponRequest {
+	req := &CreateCouponRequest{
+		Name:          o.Name,
+		Amount:        template.Amount,
+		Mode:          template.Mode,
+		Shards:        template.Shards,
+		StartsAt:      template.StartsAt,
+		ExpiresAt:     template.ExpiresAt,
+		EntryDeadline: template.EntryDeadline,
+		DiscountType:  template.DiscountType,
+		DiscountValue: template.DiscountValue,
+		Rules:         template.Rules,
+	}
+	if o.Amount != nil {
+		req.Amount = *o.Amount
+	}
+	if o.Mode != nil {
+		req.Mode = *o.Mode
+	}
+	if o.Shards != nil {
+		req.Shards = *o.Shards
+	}
+	if o.StartsAt != nil {
+		req.StartsAt = o.StartsAt
+	}
+	if o.ExpiresAt != nil {
+		req.ExpiresAt = o.ExpiresAt
+	}
+	if o.EntryDeadline != nil {
+		req.EntryDeadline = o.EntryDeadline
+	}
+	if o.DiscountType != nil {
+		req.DiscountType = *o.DiscountType
+	}
+	if o.DiscountValue != nil {
+		req.DiscountValue = *o.DiscountValue
+	}
+	if o.Rules != nil {
+		req.Rules = o.Rules
+	}
+	return req
+}
+
+type BulkCouponResult struct {
+	Name   string        `json:"name"`
+	Status string        `json:"status"`
+	Coupon *model.Coupon `json:"coupon,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type BulkCouponResponse struct {
+	Template string             `json:"template"`
+	Created  int                `json:"created"`
+	Failed   int                `json:"failed"`
+	Results  []BulkCouponResult `json:"results"`
+}
+
+func (s *couponService) CreateTemplate(ctx context.Context, req *CreateTemplateRequest) (*model.CouponTemplate, error) {
+	template := &model.CouponTemplate{
+		Name:          req.Name,
+		Amount:        req.Amount,
+		Mode:          req.Mode,
+		Shards:        req.Shards,
+		StartsAt:      req.StartsAt,
+		ExpiresAt:     req.ExpiresAt,
+		EntryDeadline: req.EntryDeadline,
+		DiscountType:  req.DiscountType,
+		DiscountValue: req.DiscountValue,
+		Rules:         req.Rules,
+	}
+	// A template must be able to make a valid coupon without any override
+	if err := (&CouponOverride{Name: req.Name}).apply(template).validate(); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.CreateTemplate(ctx, template); err != nil {
+		return nil, translateError(err)
+	}
+	return template, nil
+}
+
+func (s *couponService) ListTemplates(ctx context.Context) ([]model.CouponTemplate, error) {
+	return s.repo.ListTemplates(ctx)
+}
+
+func (s *couponService) GetTemplate(ctx context.Context, name string) (*model.CouponTemplate, error) {
+	template, err := s.repo.GetTemplate(ctx, name)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return template, nil
+}
+
+func (s *couponService) DeleteTemplate(ctx context.Context, name string) error {
+	return translateError(s.repo.DeleteTemplate(ctx, name))
+}
+
+// CreateCouponsFromTemplate creates one coupon per item, the template filling in what the item leaves out.
+// Everything is written in one transaction, but each item succeeds or fails on its own (same validation
+// and duplicate name handling as CreateCoupon). Results are in the order of items.
+func (s *couponService) CreateCouponsFromTemplate(ctx context.Context, templateName string, items []CouponOverride) (*BulkCouponResponse, error) {
+	template, err := s.repo.GetTemplate(ctx, templateName)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	resp := &BulkCouponResponse{
+		Template: template.Name,
+		Results:  make([]BulkCouponResult, len(items)),
+	}
+
+	// Invalid items are failed right away, only the valid ones go to the database
+	var coupons []*model.Coupon
+	var positions []int
+	for i := range items {
+		req := items[i].apply(template)
+		resp.Results[i].Name = req.Name
+		if err := req.validate(); err != nil {
+			resp.Results[i].Status, resp.Results[i].Error = BulkStatusFailed, err.Error()
+			continue
+		}
+		coupons = append(coupons, req.toModel())
+		positions = append(positions, i)
+	}
+
+	errs, err := s.repo.CreateCoupons(ctx, coupons)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range positions {
+		if errs[j] != nil {
+			resp.Results[i].Status, resp.Results[i].Error = BulkStatusFailed, translateError(errs[j]).Error()
+			continue
+		}
+		resp.Results[i].Status, resp.Results[i].Coupon = BulkStatusCreated, coupons[j]
+	}
+
+	for _, result := range resp.Results {
+		if result.Status == BulkStatusCreated {
+			resp.Created++
+		} else {
+			resp.Failed++
+		}
+	}
+	return resp, nil
+}
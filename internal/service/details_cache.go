@@ -0,0 +1,310 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+// How long one load of coupon details may take, whoever started it
+const detailsLoadTimeout = 10 * time.Second
+
+// DetailsCache is a read-through cache of coupon details, the response of GET /api/coupons/{name}. Entries live
+// in redis, shared by every instance, and optionally for a short while in memory as well.
+//
+// An entry is fresh for ttl. For staleWhileRevalidate after that it's still served while one request refreshes
+// it in the background, past that the request waits for the refresh. Concurrent loads of the same page on an
+// instance are one load (single flight), so a hot coupon going out of the cache costs one query per instance.
+//
+// Claims, revokes, restocks and reconciliation invalidate the coupon through their outbox events (see Publish),
+// the coupon service also invalidates right after its own changes. Every instance drops what it keeps in memory
+// when any instance invalidates a coupon (see Run).
+type DetailsCache struct {
+	repo                 *repository.DetailsCacheRepository
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+	localTTL             time.Duration
+
+	mu      sync.Mutex
+	coupons map[string]*localDetails
+	flights map[string]*detailsFlight
+}
+
+// localDetails is what an instance keeps of a coupon, while it has pages in memory or reads going on
+type localDetails struct {
+	// Bumped by every invalidation, a read only keeps its result if it didn't change meanwhile
+	generation uint64
+	reads      int
+	pages      map[string]localPage
+}
+
+type localPage struct {
+	entry    *cachedDetails
+	storedAt time.Time
+}
+
+type detailsFlight struct {
+	done    chan struct{}
+	details *CouponDetailsResponse
+	err     error
+}
+
+// cachedDetails is a cache entry as stored in redis
+type cachedDetails struct {
+	Details  *CouponDetailsResponse `json:"details"`
+	ETag     string                 `json:"etag"`
+	CachedAt time.Time              `json:"cached_at"`
+}
+
+// NewDetailsCache makes a cache keeping entries for ttl plus staleWhileRevalidate, and in memory for localTTL
+// (0 to keep nothing in memory)
+func NewDetailsCache(repo *repository.DetailsCacheRepository, ttl time.Duration, staleWhileRevalidate time.Duration, localTTL time.Duration) *DetailsCache {
+	return &DetailsCache{
+		repo:                 repo,
+		ttl:                  ttl,
+		staleWhileRevalidate: staleWhileRevalidate,
+		localTTL:             localTTL,
+		coupons:              make(map[string]*localDetails),
+		flights:              make(map[string]*detailsFlight),
+	}
+}
+
+// WithDetailsCache serves GetCouponDetails through cache, and invalidates it on every change the service makes
+func WithDetailsCache(cache *DetailsCache) CouponServiceOption {
+	return func(s *couponService) {
+		s.detailsCache = cache
+	}
+}
+
+func detailsPageKey(page pagination.Params) string {
+	return fmt.Sprintf("%d:%d:%s", page.Limit, page.After, page.AfterKey)
+}
+
+// Get returns a page of the coupon's details from the cache, loading it with load when it isn't there.
+// The response may be shared with other callers, it must not be modified.
+func (c *DetailsCache) Get(ctx context.Context, name string, page pagination.Params, load func(ctx context.Context) (*CouponDetailsResponse, error)) (*CouponDetailsResponse, error) {
+	key := detailsPageKey(page)
+	entry, generation := c.lookup(name, key)
+	if entry != nil {
+		return entry.Details, nil
+	}
+
+	entry, err := c.fetch(ctx, name, key)
+	if err != nil {
+		// The cache being down shouldn't take coupon details down with it
+		c.release(name, generation, key, nil)
+		log.Printf("details cache: %v", err)
+		return load(ctx)
+	}
+
+	if entry != nil {
+		age := time.Since(entry.CachedAt)
+		if age < c.ttl {
+			c.release(name, generation, key, entry)
+			return entry.Details, nil
+		}
+		if age < c.ttl+c.staleWhileRevalidate {
+			c.refresh(name, key, generation, load)
+			c.release(name, generation, key, nil)
+			return entry.Details, nil
+		}
+	}
+
+	flight := c.refresh(name, key, generation, load)
+	c.release(name, generation, key, nil)
+	select {
+	case <-flight.done:
+		return flight.details, flight.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup returns the page if it's fresh in memory. Otherwise it registers a read of the coupon,
+// which the caller has to release.
+func (c *DetailsCache) lookup(name string, key string) (*cachedDetails, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	coupon, ok := c.coupons[name]
+	if !ok {
+		coupon = &localDetails{pages: make(map[string]localPage)}
+		c.coupons[name] = coupon
+	}
+	if page, ok := coupon.pages[key]; ok {
+		if time.Since(page.storedAt) < c.localTTL && time.Since(page.entry.CachedAt) < c.ttl {
+			return page.entry, coupon.generation
+		}
+		delete(coupon.pages, key)
+	}
+	coupon.reads++
+	return nil, coupon.generation
+}
+
+// release ends a read started by lookup, keeping entry in memory if the coupon wasn't invalidated since
+func (c *DetailsCache) release(name string, generation uint64, key string, entry *cachedDetails) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	coupon := c.coupons[name]
+	coupon.reads--
+	if entry != nil && c.localTTL > 0 && coupon.generation == generation {
+		coupon.pages[key] = localPage{entry: entry, storedAt: time.Now()}
+	}
+	c.prune(name, coupon)
+}
+
+// prune forgets a coupon once nothing of it is kept or going on, c.mu must be held
+func (c *DetailsCache) prune(name string, coupon *localDetails) {
+	if coupon.reads == 0 && len(coupon.pages) == 0 {
+		delete(c.coupons, name)
+	}
+}
+
+func (c *DetailsCache) fetch(ctx context.Context, name string, key string) (*cachedDetails, error) {
+	data, err := c.repo.Get(ctx, name, key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var entry cachedDetails
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Details == nil {
+		return nil, fmt.Errorf("bad entry of %s: %v", name, err)
+	}
+	entry.Details.ETag = entry.ETag
+	return &entry, nil
+}
+
+// refresh loads the page in the background, or joins the load of it already going on.
+// Reads that started after an invalidation don't join loads from before it.
+func (c *DetailsCache) refresh(name string, key string, generation uint64, load func(ctx context.Context) (*CouponDetailsResponse, error)) *detailsFlight {
+	flightKey := fmt.Sprintf("%s\x00%s\x00%d", name, key, generation)
+
+	c.mu.Lock()
+	if flight, ok := c.flights[flightKey]; ok {
+		c.mu.Unlock()
+		return flight
+	}
+	flight := &detailsFlight{done: make(chan struct{})}
+	c.flights[flightKey] = flight
+	// The load is a read of the coupon too, it keeps the generation around until it's done
+	c.coupons[name].reads++
+	c.mu.Unlock()
+
+	go func() {
+		// Not tied to any one request, every request waiting on it would fail when the first one goes away
+		ctx, cancel := context.WithTimeout(context.Background(), detailsLoadTimeout)
+		defer cancel()
+
+		entry, err := c.load(ctx, name, key, load)
+		if err == nil {
+			flight.details = entry.Details
+		}
+		flight.err = err
+
+		c.mu.Lock()
+		delete(c.flights, flightKey)
+		c.mu.Unlock()
+		c.release(name, generation, key, entry)
+		close(flight.done)
+	}()
+	return flight
+}
+
+// load reads the page from the database and stores it, unless the coupon was invalidated meanwhile
+func (c *DetailsCache) load(ctx context.Context, name string, key string, load func(ctx context.Context) (*CouponDetailsResponse, error)) (*cachedDetails, error) {
+	// Read before the database, a change committed after it invalidates the version
+	version, err := c.repo.Version(ctx, name)
+	if err != nil {
+		log.Printf("details cache: %v", err)
+	}
+
+	details, loadErr := load(ctx)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	entry := &cachedDetails{Details: details, ETag: details.ETag, CachedAt: time.Now()}
+	if err != nil {
+		return entry, nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.repo.Set(ctx, name, key, data, version, c.ttl+c.staleWhileRevalidate); err != nil {
+		log.Printf("details cache: %v", err)
+	}
+	return entry, nil
+}
+
+// Invalidate drops every cached page of the coupon, on every instance
+func (c *DetailsCache) Invalidate(ctx context.Context, name string) error {
+	c.forget(name)
+	return c.repo.Invalidate(ctx, name)
+}
+
+// forget drops what this instance keeps of the coupon, and keeps reads going on from keeping their result
+func (c *DetailsCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if coupon, ok := c.coupons[name]; ok {
+		coupon.generation++
+		coupon.pages = make(map[string]localPage)
+		c.prune(name, coupon)
+	}
+}
+
+// Publish makes the cache an outbox sink, events that change the stock or the claims invalidate their coupon
+func (c *DetailsCache) Publish(ctx context.Context, event model.Event) error {
+	switch event.Type {
+	case model.EventCouponClaimed, model.EventCouponSoldOut, model.EventCouponRestocked, model.EventCouponRevoked,
+		model.EventCouponReconciled:
+		return c.Invalidate(ctx, event.CouponName)
+	}
+	return nil
+}
+
+// Run drops what this instance keeps of the coupons any instance invalidates, and sweeps expired pages
+// out of memory, until ctx is done
+func (c *DetailsCache) Run(ctx context.Context) {
+	invalidations := c.repo.Invalidations(ctx)
+	ticker := time.NewTicker(max(c.localTTL, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case name, ok := <-invalidations:
+			if !ok {
+				return
+			}
+			c.forget(name)
+		case <-ticker.C:
+			c.sweep()
+		}
+	}
+}
+
+func (c *DetailsCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, coupon := range c.coupons {
+		for key, page := range coupon.pages {
+			if time.Since(page.storedAt) >= c.localTTL {
+				delete(coupon.pages, key)
+			}
+		}
+		c.prune(name, coupon)
+	}
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// EventPublisher receives coupon events, it's what the outbox relay publishes to.
+// Delivery is at least once, implementations should be fine seeing the same event ID twice.
+type EventPublisher interface {
+	Publish(ctx context.Context, event model.Event) error
+}
+
+// LogSink writes events as JSON lines, e.g. to an append-only file
+type LogSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogSink(w io.Writer) *LogSink {
+	return &LogSink{w: w}
+}
+
+func (s *LogSink) Publish(ctx context.Context, event model.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
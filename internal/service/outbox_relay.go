@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// OutboxRelay publishes events from the outbox table to the configured sinks.
+// An event is marked published only once every sink took it, so a failing sink means
+// the others may see it again (at least once). Events of one coupon are published in order.
+type OutboxRelay struct {
+	repo  *repository.OutboxRepository
+	sinks []EventPublisher
+}
+
+func NewOutboxRelay(repo *repository.OutboxRepository, sinks ...EventPublisher) *OutboxRelay {
+	return &OutboxRelay{
+		repo:  repo,
+		sinks: sinks,
+	}
+}
+
+// Run relays pending events every interval until ctx is done
+func (r *OutboxRelay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Keep going while there's a backlog, otherwise wait for the next tick
+		for {
+			n, err := r.repo.ProcessPending(ctx, 100, func(event model.Event) error {
+				return r.publish(ctx, event)
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Printf("outbox relay: %v", err)
+			}
+			if err != nil || n < 100 {
+				break
+			}
+		}
+	}
+}
+
+func (r *OutboxRelay) publish(ctx context.Context, event model.Event) error {
+	for _, sink := range r.sinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			return fmt.Errorf("%T: %w", sink, err)
+		}
+	}
+	return nil
+}
+
+// RunRetention deletes events published more than retention ago every interval until ctx is done.
+// Every instance may run it, deleting the same rows twice is harmless.
+func (r *OutboxRelay) RunRetention(ctx context.Context, interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := r.Prune(ctx, time.Now().Add(-retention))
+		if err != nil && ctx.Err() == nil {
+			log.Printf("outbox retention: %v", err)
+		}
+		if n > 0 {
+			log.Printf("outbox retention: deleted %d published events", n)
+		}
+	}
+}
+
+// Prune deletes every event published before the given time, in batches so no delete holds many rows at once
+func (r *OutboxRelay) Prune(ctx context.Context, before time.Time) (int64, error) {
+	const batch = 1000
+	var total int64
+	for {
+		n, err := r.repo.DeletePublished(ctx, before, batch)
+		total += n
+		if err != nil || n < batch {
+			return total, err
+		}
+	}
+}
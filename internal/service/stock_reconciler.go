@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// StockReconciler checks that the stock left of every coupon is its amount minus its claims, and that no user
+// holds a coupon twice. Claims keep that true, drift comes from bugs or hand edits in the database.
+//
+// It runs on a schedule (Run), from POST /api/reconcile and from the reconcile subcommand. Running it on
+// several instances at once is safe, repairs re-check under the coupon lock before changing anything.
+type StockReconciler struct {
+	repo repository.CouponRepository
+}
+
+func NewStockReconciler(repo repository.CouponRepository) *StockReconciler {
+	return &StockReconciler{repo: repo}
+}
+
+type ReconcileReport struct {
+	Repair bool `json:"repair"`
+	// Coupons whose stock didn't add up. With Repair, the counts are the ones found under the lock.
+	Issues     []repository.StockIssue `json:"issues"`
+	StartedAt  time.Time               `json:"started_at"`
+	FinishedAt time.Time               `json:"finished_at"`
+}
+
+// Unresolved is the number of issues still there after the run: unrepaired ones, and over-issued coupons
+// which repair can't fix
+func (r *ReconcileReport) Unresolved() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired || slices.Contains(issue.Problems, repository.StockProblemOverIssued) {
+			n++
+		}
+	}
+	return n
+}
+
+// Reconcile finds the coupons whose stock doesn't add up, and with repair fixes them one at a time
+func (s *StockReconciler) Reconcile(ctx context.Context, repair bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		Repair:    repair,
+		Issues:    []repository.StockIssue{},
+		StartedAt: time.Now(),
+	}
+
+	issues, err := s.repo.FindStockIssues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, issue := range issues {
+		if repair {
+			repaired, err := s.repo.RepairStock(ctx, issue.CouponName)
+			switch {
+			case errors.Is(err, repository.ErrCouponNotFound):
+				// Deleted or renamed since, report what was found
+			case err != nil:
+				return nil, fmt.Errorf("repair %s: %w", issue.CouponName, err)
+			case len(repaired.Problems) == 0:
+				// Fixed in between, e.g. by another instance's run
+				continue
+			default:
+				issue = *repaired
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// Run reconciles every interval until ctx is done, logging every issue it finds
+func (s *StockReconciler) Run(ctx context.Context, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := s.Reconcile(ctx, repair)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("stock reconciler: %v", err)
+			}
+			continue
+		}
+		for _, issue := range report.Issues {
+			log.Printf("stock reconciler: %s: %v (amount %d, remaining %d, expected %d, claims %d, duplicates %d, repaired %t)",
+				issue.CouponName, issue.Problems, issue.Amount, issue.Remaining, issue.Expected,
+				issue.Claims, issue.DuplicateClaims, issue.Repaired)
+		}
+	}
+}
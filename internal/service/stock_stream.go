@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+// StockPublisher is an outbox sink that turns coupon events into live stock updates.
+// Updates are coalesced per coupon and flushed at most once per interval, so a burst of claims
+// produces a bounded update rate. Sold out skips the wait. Every update carries its event's sequence, the feed
+// drops one older than what another instance published already.
+type StockPublisher struct {
+	feed     *repository.StockFeedRepository
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]model.StockUpdate
+}
+
+func NewStockPublisher(feed *repository.StockFeedRepository, interval time.Duration) *StockPublisher {
+	return &StockPublisher{
+		feed:     feed,
+		interval: interval,
+		pending:  make(map[string]model.StockUpdate),
+	}
+}
+
+func (p *StockPublisher) Publish(ctx context.Context, event model.Event) error {
+	update := model.StockUpdate{
+		CouponName:      event.CouponName,
+		RemainingAmount: event.RemainingAmount,
+		UpdatedAt:       event.OccurredAt,
+		Sequence:        event.Sequence,
+	}
+
+	switch event.Type {
+	case model.EventCouponCreated, model.EventCouponClaimed, model.EventCouponRestocked, model.EventCouponRevoked,
+		model.EventCouponReconciled:
+	case model.EventCouponSoldOut:
+		update.SoldOut = true
+		// Nothing can come after sold out (short of a restock), drop whatever was waiting and send now
+		p.mu.Lock()
+		delete(p.pending, event.CouponName)
+		p.mu.Unlock()
+		return p.feed.Publish(ctx, update)
+	default:
+		return nil
+	}
+
+	p.mu.Lock()
+	// An event published again by the relay can be older than what's waiting
+	if waiting, ok := p.pending[event.CouponName]; !ok || waiting.Sequence < update.Sequence {
+		p.pending[event.CouponName] = update
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Run flushes the latest pending update of every coupon each interval until ctx is done
+func (p *StockPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		pending := p.pending
+		p.pending = make(map[string]model.StockUpdate)
+		p.mu.Unlock()
+
+		for _, update := range pending {
+			if err := p.feed.Publish(ctx, update); err != nil && ctx.Err() == nil {
+				log.Printf("stock publisher: %v", err)
+			}
+		}
+	}
+}
+
+var ErrStockHubClosed = errors.New("stock hub is closed")
+
+// StockHub hands live stock updates from the feed to the local stream subscribers.
+// A coupon's redis channel is only subscribed while this instance has subscribers for it.
+type StockHub struct {
+	feed *repository.StockFeedRepository
+
+	mu     sync.Mutex
+	topics map[string]map[chan model.StockUpdate]struct{}
+	closed bool
+
+	// Serializes the redis (un)subscribes, which happen outside mu so dispatching never waits on the network
+	feedMu     sync.Mutex
+	subscribed map[string]bool
+}
+
+func NewStockHub(feed *repository.StockFeedRepository) *StockHub {
+	return &StockHub{
+		feed:       feed,
+		topics:     make(map[string]map[chan model.StockUpdate]struct{}),
+		subscribed: make(map[string]bool),
+	}
+}
+
+// Subscribe returns a channel of stock updates of a coupon, and a func to stop them.
+// The channel only ever holds the latest update, a slow reader skips the ones in between.
+// It's closed when the hub shuts down.
+func (h *StockHub) Subscribe(ctx context.Context, couponName string) (<-chan model.StockUpdate, func(), error) {
+	ch := make(chan model.StockUpdate, 1)
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, nil, ErrStockHubClosed
+	}
+	subs, ok := h.topics[couponName]
+	if !ok {
+		subs = make(map[chan model.StockUpdate]struct{})
+		h.topics[couponName] = subs
+	}
+	subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	if err := h.syncFeed(ctx, couponName); err != nil {
+		h.unsubscribe(couponName, ch)
+		return nil, nil, err
+	}
+	return ch, func() { h.unsubscribe(couponName, ch) }, nil
+}
+
+func (h *StockHub) unsubscribe(couponName string, ch chan model.StockUpdate) {
+	h.mu.Lock()
+	subs, ok := h.topics[couponName]
+	if !ok {
+		// Already dropped by the hub closing
+		h.mu.Unlock()
+		return
+	}
+	delete(subs, ch)
+	if len(subs) == 0 {
+		delete(h.topics, couponName)
+	}
+	h.mu.Unlock()
+
+	if err := h.syncFeed(context.Background(), couponName); err != nil {
+		log.Printf("stock hub: failed to update the subscription of %s: %v", couponName, err)
+	}
+}
+
+// syncFeed subscribes the coupon's redis channel if it has subscribers now, and unsubscribes it otherwise.
+// It goes by the subscribers at the time it runs, so (un)subscribes racing each other end up right.
+func (h *StockHub) syncFeed(ctx context.Context, couponName string) error {
+	h.feedMu.Lock()
+	defer h.feedMu.Unlock()
+
+	h.mu.Lock()
+	_, wanted := h.topics[couponName]
+	h.mu.Unlock()
+
+	if wanted == h.subscribed[couponName] {
+		return nil
+	}
+	if wanted {
+		if err := h.feed.Subscribe(ctx, couponName); err != nil {
+			return err
+		}
+		h.subscribed[couponName] = true
+		return nil
+	}
+	delete(h.subscribed, couponName)
+	return h.feed.Unsubscribe(context.Background(), couponName)
+}
+
+// Run dispatches updates from the feed until the feed is closed, then closes every subscriber channel
+func (h *StockHub) Run() {
+	defer h.close()
+
+	for update := range h.feed.Updates() {
+		h.mu.Lock()
+		for ch := range h.topics[update.CouponName] {
+			// Latest wins, replace an update the subscriber hasn't read yet
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- update
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *StockHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.topics {
+		for ch := range subs {
+			close(ch)
+		}
+	}
+	h.topics = make(map[string]map[chan model.StockUpdate]struct{})
+}
+
+// Close closes the feed, which ends Run and with it every stream
+func (h *StockHub) Close() error {
+	return h.feed.Close()
+}
+
+// GetStock returns the current stock of a coupon, the first thing a stream subscriber gets
+func (s *couponService) GetStock(ctx context.Context, name string) (*model.StockUpdate, error) {
+	coupon, err := s.repo.GetCouponByName(ctx, name)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	remaining, err := s.repo.RemainingStock(ctx, coupon)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.StockUpdate{
+		CouponName:      coupon.Name,
+		RemainingAmount: remaining,
+		SoldOut:         remaining == 0,
+		UpdatedAt:       time.Now(),
+	}, nil
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+)
+
+// Import formats
+const (
+	UserImportNDJSON = "ndjson"
+	UserImportCSV    = "csv"
+)
+
+// Users are inserted this many at a time, well under the 65535 bind parameters of one statement
+const userImportBatchSize = 500
+
+var ErrUnsupportedImportFormat = errors.New("unsupported import format, use NDJSON or CSV")
+
+// UserImportError is a row that wasn't imported. Line is the line of the row in the input, from 1.
+type UserImportError struct {
+	Line   int    `json:"line"`
+	UserID string `json:"user_id,omitempty"`
+	Error  string `json:"error"`
+}
+
+type UserImportSummary struct {
+	Inserted int `json:"inserted"`
+	Failed   int `json:"failed"`
+}
+
+type userImportRow struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+
+	// Line of the row in the input, and what's wrong with the row if it couldn't be parsed
+	Line int   `json:"-"`
+	Err  error `json:"-"`
+}
+
+// userRowReader yields the rows of an import. An error ends the import, io.EOF when there are no rows left.
+type userRowReader interface {
+	Next() (userImportRow, error)
+}
+
+type ndjsonRowReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonRowReader) Next() (userImportRow, error) {
+	for r.scanner.Scan() {
+		r.line++
+		text := strings.TrimSpace(r.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var row userImportRow
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			row.Err = fmt.Errorf("invalid JSON: %w", err)
+		}
+		row.Line = r.line
+		return row, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return userImportRow{}, err
+	}
+	return userImportRow{}, io.EOF
+}
+
+// csvRowReader reads CSV with a header row, user_id is required and name optional. Other columns are ignored.
+type csvRowReader struct {
+	reader  *csv.Reader
+	userID  int
+	name    int
+	started bool
+}
+
+func (r *csvRowReader) Next() (userImportRow, error) {
+	if !r.started {
+		r.started = true
+		header, err := r.reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return userImportRow{}, io.EOF
+			}
+			return userImportRow{}, fmt.Errorf("invalid CSV header: %w", err)
+		}
+		r.userID, r.name = -1, -1
+		for i, column := range header {
+			switch strings.ToLower(strings.TrimSpace(column)) {
+			case "user_id":
+				r.userID = i
+			case "name":
+				r.name = i
+			}
+		}
+		if r.userID < 0 {
+			return userImportRow{}, errors.New("CSV header has no user_id column")
+		}
+	}
+
+	record, err := r.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return userImportRow{Line: parseErr.StartLine, Err: parseErr}, nil
+		}
+		return userImportRow{}, err
+	}
+
+	var row userImportRow
+	row.Line, _ = r.reader.FieldPos(0)
+	if r.userID < len(record) {
+		row.UserID = record[r.userID]
+	}
+	if r.name >= 0 && r.name < len(record) {
+		row.Name = record[r.name]
+	}
+	return row, nil
+}
+
+func newUserRowReader(format string, r io.Reader) (userRowReader, error) {
+	switch format {
+	case UserImportNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &ndjsonRowReader{scanner: scanner}, nil
+	case UserImportCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.ReuseRecord = true
+		return &csvRowReader{reader: reader}, nil
+	}
+	return nil, ErrUnsupportedImportFormat
+}
+
+// ImportUsers reads users from r as they arrive and inserts them userImportBatchSize at a time.
+// Rows that can't be imported (bad row, duplicate user_id) go to report and the import carries on.
+// An error is only returned when the input itself can't be read any further, the batches before it stay inserted
+// and the summary counts them.
+func (s *userService) ImportUsers(ctx context.Context, format string, r io.Reader, report func(UserImportError)) (*UserImportSummary, error) {
+	summary := &UserImportSummary{}
+	rows, err := newUserRowReader(format, r)
+	if err != nil {
+		return summary, err
+	}
+	fail := func(e UserImportError) {
+		summary.Failed++
+		report(e)
+	}
+
+	type pendingRow struct {
+		line int
+		user model.User
+	}
+	batch := make([]pendingRow, 0, userImportBatchSize)
+	inBatch := make(map[string]bool, userImportBatchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		users := make([]model.User, len(batch))
+		for i, row := range batch {
+			users[i] = row.user
+		}
+
+		inserted, err := s.repo.CreateBatch(ctx, users)
+		if err != nil {
+			// Only this batch is lost, report its rows and keep going
+			for _, row := range batch {
+				fail(UserImportError{Line: row.line, UserID: row.user.UserID, Error: err.Error()})
+			}
+		} else {
+			created := make(map[string]bool, len(inserted))
+			for _, userID := range inserted {
+				created[userID] = true
+			}
+			summary.Inserted += len(inserted)
+			for _, row := range batch {
+				if !created[row.user.UserID] {
+					fail(UserImportError{Line: row.line, UserID: row.user.UserID, Error: ErrUserAlreadyExists.Error()})
+				}
+			}
+		}
+
+		batch = batch[:0]
+		clear(inBatch)
+	}
+
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			flush()
+			return summary, err
+		}
+
+		row.UserID = strings.TrimSpace(row.UserID)
+		switch {
+		case row.Err != nil:
+			fail(UserImportError{Line: row.Line, Error: row.Err.Error()})
+			continue
+		case row.UserID == "":
+			fail(UserImportError{Line: row.Line, Error: "user_id is required"})
+			continue
+		case inBatch[row.UserID]:
+			// One INSERT can't tell which of two equal rows it skipped, so catch those here
+			fail(UserImportError{Line: row.Line, UserID: row.UserID, Error: ErrUserAlreadyExists.Error()})
+			continue
+		}
+
+		inBatch[row.UserID] = true
+		batch = append(batch, pendingRow{line: row.Line, user: model.User{Name: row.Name, UserID: row.UserID}})
+		if len(batch) == userImportBatchSize {
+			flush()
+		}
+	}
+
+	flush()
+	return summary, nil
+}
@@ -1,26 +1,69 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"io"
+
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
 	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
 )
 
-type UserService struct {
-	Repo *repository.UserRepository
+var ErrUserAlreadyExists = errors.New("user already exists")
+
+// UserService is what the user handlers are built on. Errors are the Err* values of this package.
+type UserService interface {
+	CreateUser(ctx context.Context, user *model.User) error
+	GetAllUsers(ctx context.Context, page pagination.Params) ([]model.User, string, error)
+	GetUser(ctx context.Context, ref string) (*model.User, error)
+	UpdateUser(ctx context.Context, userID string, name string) (*model.User, error)
+	UpsertUser(ctx context.Context, user *model.User) (bool, error)
+	DeleteUser(ctx context.Context, userID string) error
+	ImportUsers(ctx context.Context, format string, r io.Reader, report func(UserImportError)) (*UserImportSummary, error)
+}
+
+type userService struct {
+	repo repository.UserRepository
+}
+
+func NewUserService(repo repository.UserRepository) UserService {
+	return &userService{repo: repo}
+}
+
+func (s *userService) CreateUser(ctx context.Context, user *model.User) error {
+	return translateError(s.repo.Create(ctx, user))
+}
+
+// GetAllUsers returns one page of users and the cursor of the next page (empty on the last page)
+func (s *userService) GetAllUsers(ctx context.Context, page pagination.Params) ([]model.User, string, error) {
+	users, err := s.repo.FindAll(ctx, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	users, next := pagination.Page(users, page, func(u model.User) uint { return u.ID })
+	return users, next, nil
 }
 
-func NewUserService(repo *repository.UserRepository) *UserService {
-	return &UserService{Repo: repo}
+// GetUser looks a user up by external user_id, falling back to the numeric ID
+func (s *userService) GetUser(ctx context.Context, ref string) (*model.User, error) {
+	user, err := s.repo.FindByRef(ctx, ref)
+	return user, translateError(err)
 }
 
-func (s *UserService) CreateUser(user *model.User) error {
-	return s.Repo.Create(user)
+// UpdateUser renames the user with the user_id, there's no numeric ID fallback for changes
+func (s *userService) UpdateUser(ctx context.Context, userID string, name string) (*model.User, error) {
+	user, err := s.repo.Update(ctx, userID, name)
+	return user, translateError(err)
 }
 
-func (s *UserService) GetAllUsers() ([]model.User, error) {
-	return s.Repo.FindAll()
+// UpsertUser creates or renames the user with user.UserID, created tells which one happened
+func (s *userService) UpsertUser(ctx context.Context, user *model.User) (bool, error) {
+	return s.repo.Upsert(ctx, user)
 }
 
-func (s *UserService) GetUserByID(id uint) (model.User, error) {
-	return s.Repo.FindByID(id)
+// DeleteUser deletes the user and revokes their claims, the claimed units go back to stock
+func (s *userService) DeleteUser(ctx context.Context, userID string) error {
+	return translateError(s.repo.Delete(ctx, userID))
 }
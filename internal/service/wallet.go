@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/pagination"
+)
+
+type WalletItem struct {
+	CouponName string     `json:"coupon_name"`
+	Code       string     `json:"code"`
+	Status     string     `json:"status"`
+	ClaimedAt  time.Time  `json:"claimed_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+type WalletResponse struct {
+	UserID     string       `json:"user_id"`
+	Coupons    []WalletItem `json:"coupons"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// GetWallet returns the coupons a user claimed, newest first.
+// userRef is the external user_id, or the numeric ID as a fallback.
+func (s *couponService) GetWallet(ctx context.Context, userRef string, page pagination.Params) (*WalletResponse, error) {
+	user, claims, err := s.repo.ListUserClaims(ctx, userRef, page)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	claims, next := pagination.Page(claims, page, func(c model.CouponClaims) uint { return c.ID })
+
+	now := time.Now()
+	resp := &WalletResponse{
+		UserID:     user.UserID,
+		Coupons:    make([]WalletItem, len(claims)),
+		NextCursor: next,
+	}
+	for i, claim := range claims {
+		resp.Coupons[i] = WalletItem{
+			CouponName: claim.Coupon.Name,
+			Code:       claim.Code,
+			Status:     claim.Status(now),
+			ClaimedAt:  claim.ClaimedAt,
+			ExpiresAt:  claim.Coupon.ExpiresAt,
+		}
+	}
+
+	return resp, nil
+}
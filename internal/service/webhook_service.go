@@ -0,0 +1,269 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrUnknownEventType = errors.New("unknown event type")
+)
+
+// Webhook request headers
+const (
+	HeaderWebhookEvent     = "X-Webhook-Event"
+	HeaderWebhookDelivery  = "X-Webhook-Delivery"
+	HeaderWebhookSignature = "X-Webhook-Signature-256"
+)
+
+var webhookEventTypes = map[string]bool{
+	"*":                         true,
+	model.EventCouponCreated:    true,
+	model.EventCouponClaimed:    true,
+	model.EventCouponSoldOut:    true,
+	model.EventCouponRestocked:  true,
+	model.EventCouponRevoked:    true,
+	model.EventCouponRedeemed:   true,
+	model.EventCouponReconciled: true,
+}
+
+// WebhookService fans coupon events out to webhook subscriptions and delivers them.
+// Deliveries are stored first and sent by RunDispatcher, so a slow receiver never slows down a claim.
+type WebhookService struct {
+	repo   *repository.WebhookRepository
+	client *http.Client
+
+	// Retry policy, attempt n waits baseBackoff * 2^(n-1) (capped at maxBackoff) before the next one
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+// NewWebhookService creates the service. A delivery attempt may take up to timeout, after maxAttempts failed
+// ones the delivery is dead.
+func NewWebhookService(repo *repository.WebhookRepository, timeout time.Duration, maxAttempts int, baseBackoff time.Duration, maxBackoff time.Duration) *WebhookService {
+	return &WebhookService{
+		repo:        repo,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL        string   `json:"url" binding:"required,url"`
+	EventTypes []string `json:"event_types" binding:"required,min=1"`
+	// Optional, generated when empty. Only ever returned on create.
+	Secret string `json:"secret"`
+}
+
+// SignPayload returns the signature header value for body: "sha256=" + hex(HMAC-SHA256(secret, body)).
+// Receivers should compute the same and compare with hmac.Equal.
+func SignPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *WebhookService) CreateSubscription(ctx context.Context, req *CreateWebhookRequest) (*model.WebhookSubscription, string, error) {
+	for _, t := range req.EventTypes {
+		if !webhookEventTypes[t] {
+			return nil, "", fmt.Errorf("%w: %s", ErrUnknownEventType, t)
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	sub := &model.WebhookSubscription{
+		URL:        req.URL,
+		EventTypes: strings.Join(req.EventTypes, ","),
+		Secret:     secret,
+		Active:     true,
+	}
+	if err := s.repo.CreateSubscription(ctx, sub); err != nil {
+		return nil, "", err
+	}
+
+	return sub, secret, nil
+}
+
+func (s *WebhookService) ListSubscriptions(ctx context.Context) ([]model.WebhookSubscription, error) {
+	return s.repo.ListSubscriptions(ctx)
+}
+
+func (s *WebhookService) DeleteSubscription(ctx context.Context, id uint) error {
+	err := s.repo.DeleteSubscription(ctx, id)
+	if errors.Is(err, repository.ErrWebhookNotFound) {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func (s *WebhookService) ListDeliveries(ctx context.Context, subscriptionID uint) ([]model.WebhookDelivery, error) {
+	if _, err := s.repo.GetSubscription(ctx, subscriptionID); err != nil {
+		if errors.Is(err, repository.ErrWebhookNotFound) {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return s.repo.ListDeliveries(ctx, subscriptionID, 100)
+}
+
+func (s *WebhookService) Redeliver(ctx context.Context, deliveryID uint) (*model.WebhookDelivery, error) {
+	delivery, err := s.repo.Redeliver(ctx, deliveryID)
+	if errors.Is(err, repository.ErrDeliveryNotFound) {
+		return nil, ErrDeliveryNotFound
+	}
+	return delivery, err
+}
+
+func subscribedTo(sub model.WebhookSubscription, eventType string) bool {
+	for _, t := range strings.Split(sub.EventTypes, ",") {
+		if t == "*" || t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish queues a delivery of event for every active subscription that wants it. The outbox relay may publish an
+// event again, a subscription still gets one delivery of it.
+func (s *WebhookService) Publish(ctx context.Context, event model.Event) error {
+	subs, err := s.repo.ActiveSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []model.WebhookDelivery
+	for _, sub := range subs {
+		if !subscribedTo(sub, event.Type) {
+			continue
+		}
+		deliveries = append(deliveries, model.WebhookDelivery{
+			SubscriptionID: sub.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        string(payload),
+			Status:         model.DeliveryStatusPending,
+			NextAttemptAt:  time.Now(),
+		})
+	}
+
+	return s.repo.CreateDeliveries(ctx, deliveries)
+}
+
+// RunDispatcher sends due deliveries every interval until ctx is done
+func (s *WebhookService) RunDispatcher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.DispatchDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("webhook dispatcher: %v", err)
+		}
+	}
+}
+
+// DispatchDue sends one round of due deliveries
+func (s *WebhookService) DispatchDue(ctx context.Context) error {
+	now := time.Now()
+	// The lease only has to outlive one attempt, it's replaced by the real next_attempt_at right after
+	deliveries, err := s.repo.ClaimDueDeliveries(ctx, now, now.Add(2*s.client.Timeout+time.Minute), 50)
+	if err != nil {
+		return err
+	}
+
+	for i := range deliveries {
+		s.attempt(ctx, &deliveries[i])
+		if err := s.repo.SaveAttempt(ctx, &deliveries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt sends one delivery and updates its status, attempt count and next attempt time
+func (s *WebhookService) attempt(ctx context.Context, d *model.WebhookDelivery) {
+	d.Attempts++
+	d.LastStatusCode = 0
+
+	err := s.send(ctx, d)
+	if err == nil {
+		d.Status = model.DeliveryStatusDelivered
+		d.LastError = ""
+		return
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= s.maxAttempts {
+		d.Status = model.DeliveryStatusDead
+		return
+	}
+
+	backoff := s.baseBackoff << (d.Attempts - 1)
+	if backoff > s.maxBackoff || backoff <= 0 {
+		backoff = s.maxBackoff
+	}
+	d.NextAttemptAt = time.Now().Add(backoff)
+}
+
+func (s *WebhookService) send(ctx context.Context, d *model.WebhookDelivery) error {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookEvent, d.EventType)
+	req.Header.Set(HeaderWebhookDelivery, fmt.Sprintf("%d", d.ID))
+	req.Header.Set(HeaderWebhookSignature, SignPayload(d.Subscription.Secret, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	d.LastStatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return nil
+}
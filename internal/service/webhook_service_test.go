@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/repository"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/db"
+)
+
+// receiver is a local webhook receiver, it answers every request with the status set last and keeps what it got
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, receivedRequest{header: req.Header.Clone(), body: body})
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) answer(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *receiver) received() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func testDelivery(url string) *model.WebhookDelivery {
+	return &model.WebhookDelivery{
+		ID:           7,
+		EventID:      "evt-1",
+		EventType:    model.EventCouponClaimed,
+		Payload:      `{"id":"evt-1","type":"coupon.claimed"}`,
+		Status:       model.DeliveryStatusPending,
+		Subscription: model.WebhookSubscription{URL: url, Secret: "s3cret"},
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	body := []byte(`{"id":"evt-1"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := SignPayload("s3cret", body); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if SignPayload("other", body) == want {
+		t.Fatalf("signature doesn't depend on the secret")
+	}
+}
+
+func TestWebhookAttemptDelivers(t *testing.T) {
+	r := newReceiver(t, http.StatusNoContent)
+	s := NewWebhookService(nil, time.Second, 8, time.Second, time.Hour)
+	d := testDelivery(r.URL)
+
+	s.attempt(context.Background(), d)
+	if d.Status != model.DeliveryStatusDelivered || d.Attempts != 1 || d.LastStatusCode != http.StatusNoContent || d.LastError != "" {
+		t.Fatalf("got %+v", d)
+	}
+
+	requests := r.received()
+	if len(requests) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(requests))
+	}
+	got := requests[0]
+	if string(got.body) != d.Payload {
+		t.Fatalf("body: got %s", got.body)
+	}
+	if got.header.Get(HeaderWebhookEvent) != model.EventCouponClaimed || got.header.Get(HeaderWebhookDelivery) != "7" {
+		t.Fatalf("headers: got %v", got.header)
+	}
+	// What a receiver does: sign the body it got with its secret and compare
+	if !hmac.Equal([]byte(got.header.Get(HeaderWebhookSignature)), []byte(SignPayload("s3cret", got.body))) {
+		t.Fatalf("signature doesn't verify: %s", got.header.Get(HeaderWebhookSignature))
+	}
+}
+
+func TestWebhookAttemptBacksOffThenDies(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError)
+	s := NewWebhookService(nil, time.Second, 4, time.Second, 3*time.Second)
+	d := testDelivery(r.URL)
+
+	// 1s, 2s, then capped at 3s
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		before := time.Now()
+		s.attempt(context.Background(), d)
+		if d.Status != model.DeliveryStatusPending || d.Attempts != i+1 || d.LastStatusCode != http.StatusInternalServerError || d.LastError == "" {
+			t.Fatalf("attempt %d: got %+v", i+1, d)
+		}
+		if d.NextAttemptAt.Before(before.Add(backoff)) || d.NextAttemptAt.After(time.Now().Add(backoff)) {
+			t.Fatalf("attempt %d: next attempt in %v, want %v", i+1, d.NextAttemptAt.Sub(before), backoff)
+		}
+	}
+
+	s.attempt(context.Background(), d)
+	if d.Status != model.DeliveryStatusDead || d.Attempts != 4 {
+		t.Fatalf("last attempt: got %+v, want dead", d)
+	}
+	if got := len(r.received()); got != 4 {
+		t.Fatalf("receiver got %d requests, want 4", got)
+	}
+}
+
+func TestWebhookAttemptUnreachable(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	url := r.URL
+	r.Close()
+
+	s := NewWebhookService(nil, time.Second, 8, time.Second, time.Hour)
+	d := testDelivery(url)
+	s.attempt(context.Background(), d)
+	if d.Status != model.DeliveryStatusPending || d.LastStatusCode != 0 || d.LastError == "" {
+		t.Fatalf("got %+v", d)
+	}
+}
+
+// Publish, dispatch and redeliver on Postgres, against a local receiver. Needs a database it may wipe the
+// webhook tables of:
+//
+//	TEST_DATABASE_DSN="host=localhost user=postgres password=postgres dbname=coupon_test sslmode=disable" \
+//	go test ./internal/service/
+func TestWebhookDispatchAndRedeliver(t *testing.T) {
+	s := NewWebhookService(repository.NewWebhookRepository(openWebhookDB(t)), time.Second, 2, time.Millisecond, time.Millisecond)
+	ctx := context.Background()
+
+	r := newReceiver(t, http.StatusServiceUnavailable)
+	sub, secret, err := s.CreateSubscription(ctx, &CreateWebhookRequest{URL: r.URL, EventTypes: []string{model.EventCouponClaimed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := s.CreateSubscription(ctx, &CreateWebhookRequest{URL: r.URL, EventTypes: []string{model.EventCouponSoldOut}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The relay publishing an event twice still makes one delivery
+	event := model.Event{ID: "evt-1", Type: model.EventCouponClaimed, CouponName: "PROMO"}
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(ctx, event); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	deliveries, err := s.ListDeliveries(ctx, sub.ID)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("deliveries: got %d, %v, want 1", len(deliveries), err)
+	}
+	if unrelated, _ := s.ListDeliveries(ctx, other.ID); len(unrelated) != 0 {
+		t.Fatalf("subscription to another type got %d deliveries", len(unrelated))
+	}
+
+	// Two failed attempts make it dead
+	for i := 0; i < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+		if err := s.DispatchDue(ctx); err != nil {
+			t.Fatalf("dispatch: %v", err)
+		}
+	}
+	deliveries, _ = s.ListDeliveries(ctx, sub.ID)
+	if deliveries[0].Status != model.DeliveryStatusDead || deliveries[0].Attempts != 2 || deliveries[0].LastStatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("after failing: got %+v, want dead", deliveries[0])
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := s.DispatchDue(ctx); err != nil || len(r.received()) != 2 {
+		t.Fatalf("dead delivery was sent again: %d requests, %v", len(r.received()), err)
+	}
+
+	// Redeliver queues it with a fresh attempt budget
+	r.answer(http.StatusOK)
+	redelivered, err := s.Redeliver(ctx, deliveries[0].ID)
+	if err != nil || redelivered.Status != model.DeliveryStatusPending || redelivered.Attempts != 0 {
+		t.Fatalf("redeliver: got %+v, %v", redelivered, err)
+	}
+	if err := s.DispatchDue(ctx); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	deliveries, _ = s.ListDeliveries(ctx, sub.ID)
+	if deliveries[0].Status != model.DeliveryStatusDelivered || deliveries[0].Attempts != 1 {
+		t.Fatalf("after redeliver: got %+v, want delivered", deliveries[0])
+	}
+
+	requests := r.received()
+	last := requests[len(requests)-1]
+	if len(requests) != 3 || last.header.Get(HeaderWebhookDelivery) != strconv.Itoa(int(deliveries[0].ID)) ||
+		last.header.Get(HeaderWebhookSignature) != SignPayload(secret, last.body) {
+		t.Fatalf("receiver got %d requests, last %v", len(requests), last.header)
+	}
+
+	_, err = s.Redeliver(ctx, deliveries[0].ID+100)
+	if err != ErrDeliveryNotFound {
+		t.Fatalf("redeliver missing: got %v", err)
+	}
+}
+
+// openWebhookDB connects to the test database with the webhook tables emptied, skipping the test when it isn't
+// configured
+func openWebhookDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	gormDB, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close(gormDB) })
+	migrator, err := db.NewMigrator(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gormDB.Exec("TRUNCATE webhook_subscriptions, webhook_deliveries RESTART IDENTITY CASCADE").Error; err != nil {
+		t.Fatal(err)
+	}
+	return gormDB
+}
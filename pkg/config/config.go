@@ -0,0 +1,256 @@
+// Package config loads the settings of the service. Every setting has a default, which an optional
+// YAML or TOML file, then environment variables, then command line flags override in that order.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Config struct {
+	Server    ServerConfig    `json:"server" toml:"server"`
+	Database  DatabaseConfig  `json:"database" toml:"database"`
+	Redis     RedisConfig     `json:"redis" toml:"redis"`
+	Claims    ClaimsConfig    `json:"claims" toml:"claims"`
+	Outbox    OutboxConfig    `json:"outbox" toml:"outbox"`
+	Webhooks  WebhookConfig   `json:"webhooks" toml:"webhooks"`
+	Stock     StockConfig     `json:"stock" toml:"stock"`
+	Reconcile ReconcileConfig `json:"reconcile" toml:"reconcile"`
+	Cache     CacheConfig     `json:"cache" toml:"cache"`
+}
+
+type ServerConfig struct {
+	Port int `json:"port" toml:"port" env:"PORT"`
+	// On SIGTERM the health check turns unhealthy for DrainDelay while the server still takes requests,
+	// then in-flight requests get up to ShutdownTimeout to finish
+	DrainDelay      Duration `json:"drain_delay" toml:"drain_delay" env:"SERVER_DRAIN_DELAY"`
+	ShutdownTimeout Duration `json:"shutdown_timeout" toml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	// Releasing the claim locks cut off requests left behind, after the shutdown timeout
+	LockReleaseTimeout Duration `json:"lock_release_timeout" toml:"lock_release_timeout" env:"SERVER_LOCK_RELEASE_TIMEOUT"`
+	// How long the health check waits on each dependency
+	HealthCheckTimeout Duration `json:"health_check_timeout" toml:"health_check_timeout" env:"SERVER_HEALTH_CHECK_TIMEOUT"`
+}
+
+type DatabaseConfig struct {
+	Host     string `json:"host" toml:"host" env:"DB_HOST"`
+	Port     int    `json:"port" toml:"port" env:"DB_PORT"`
+	User     string `json:"user" toml:"user" env:"DB_USER"`
+	Password string `json:"password" toml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name     string `json:"name" toml:"name" env:"DB_NAME"`
+	SSLMode  string `json:"sslmode" toml:"sslmode" env:"DB_SSLMODE"`
+	// Connection attempts on start, the wait grows by a second after each one
+	ConnectRetries int `json:"connect_retries" toml:"connect_retries" env:"DB_CONNECT_RETRIES"`
+	// Drops every table and migrates from scratch on start. Dev only!
+	ResetOnBoot bool `json:"reset_on_boot" toml:"reset_on_boot" env:"DB_RESET_ON_BOOT"`
+}
+
+// DSN is the connection string for the postgres driver
+func (c DatabaseConfig) DSN() string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
+		c.Host, c.User, c.Password, c.Name, c.Port, c.SSLMode)
+}
+
+type RedisConfig struct {
+	Addr           string   `json:"addr" toml:"addr" env:"REDIS_ADDR"`
+	Password       string   `json:"password" toml:"password" env:"REDIS_PASSWORD" secret:"true"`
+	DB             int      `json:"db" toml:"db" env:"REDIS_DB"`
+	ConnectTimeout Duration `json:"connect_timeout" toml:"connect_timeout" env:"REDIS_CONNECT_TIMEOUT"`
+}
+
+type ClaimsConfig struct {
+	// Redis lock held around a claim, and how often a waiting claim retries it
+	LockTTL           Duration `json:"lock_ttl" toml:"lock_ttl" env:"CLAIM_LOCK_TTL"`
+	LockRetryInterval Duration `json:"lock_retry_interval" toml:"lock_retry_interval" env:"CLAIM_LOCK_RETRY_INTERVAL"`
+	// Group commit, off while BatchWindow is 0
+	BatchWindow Duration `json:"batch_window" toml:"batch_window" env:"CLAIM_BATCH_WINDOW"`
+	BatchSize   int      `json:"batch_size" toml:"batch_size" env:"CLAIM_BATCH_SIZE"`
+	// How long writing one batch may take
+	BatchTimeout Duration `json:"batch_timeout" toml:"batch_timeout" env:"CLAIM_BATCH_TIMEOUT"`
+	// Async claims, off while AsyncWorkers is 0. A worker waits up to AsyncPollTimeout on the queue at a time,
+	// settles a ticket within AsyncClaimTimeout, and tickets are kept for TicketTTL.
+	AsyncWorkers      int      `json:"async_workers" toml:"async_workers" env:"CLAIM_ASYNC_WORKERS"`
+	AsyncPollTimeout  Duration `json:"async_poll_timeout" toml:"async_poll_timeout" env:"CLAIM_ASYNC_POLL_TIMEOUT"`
+	AsyncClaimTimeout Duration `json:"async_claim_timeout" toml:"async_claim_timeout" env:"CLAIM_ASYNC_CLAIM_TIMEOUT"`
+	TicketTTL         Duration `json:"ticket_ttl" toml:"ticket_ttl" env:"CLAIM_TICKET_TTL"`
+}
+
+type OutboxConfig struct {
+	// Any of webhook, redis and log
+	Sinks         []string `json:"sinks" toml:"sinks" env:"OUTBOX_SINKS"`
+	LogFile       string   `json:"log_file" toml:"log_file" env:"OUTBOX_LOG_FILE"`
+	RelayInterval Duration `json:"relay_interval" toml:"relay_interval" env:"OUTBOX_RELAY_INTERVAL"`
+	// Published events are deleted once they're older than Retention, checked every RetentionInterval.
+	// Off while Retention is 0.
+	Retention         Duration `json:"retention" toml:"retention" env:"OUTBOX_RETENTION"`
+	RetentionInterval Duration `json:"retention_interval" toml:"retention_interval" env:"OUTBOX_RETENTION_INTERVAL"`
+}
+
+type WebhookConfig struct {
+	DispatchInterval Duration `json:"dispatch_interval" toml:"dispatch_interval" env:"WEBHOOK_DISPATCH_INTERVAL"`
+	Timeout          Duration `json:"timeout" toml:"timeout" env:"WEBHOOK_TIMEOUT"`
+	MaxAttempts      int      `json:"max_attempts" toml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	BaseBackoff      Duration `json:"base_backoff" toml:"base_backoff" env:"WEBHOOK_BASE_BACKOFF"`
+	MaxBackoff       Duration `json:"max_backoff" toml:"max_backoff" env:"WEBHOOK_MAX_BACKOFF"`
+}
+
+type StockConfig struct {
+	// Live stock updates of a coupon are coalesced over this interval
+	PublishInterval Duration `json:"publish_interval" toml:"publish_interval" env:"STOCK_PUBLISH_INTERVAL"`
+}
+
+type ReconcileConfig struct {
+	// Stock reconciliation runs every Interval, off while 0
+	Interval Duration `json:"interval" toml:"interval" env:"RECONCILE_INTERVAL"`
+	// Repair what the scheduled runs find instead of only logging it
+	Repair bool `json:"repair" toml:"repair" env:"RECONCILE_REPAIR"`
+}
+
+type CacheConfig struct {
+	// Coupon details are cached in redis and fresh for TTL, off while 0
+	TTL Duration `json:"ttl" toml:"ttl" env:"CACHE_TTL"`
+	// How long past TTL an entry is still served while it's refreshed in the background
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate" toml:"stale_while_revalidate" env:"CACHE_STALE_WHILE_REVALIDATE"`
+	// Each instance also keeps entries in memory for LocalTTL, off while 0
+	LocalTTL Duration `json:"local_ttl" toml:"local_ttl" env:"CACHE_LOCAL_TTL"`
+}
+
+// Default is the configuration before any file, env var or flag
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:               8080,
+			DrainDelay:         Duration(5 * time.Second),
+			ShutdownTimeout:    Duration(20 * time.Second),
+			LockReleaseTimeout: Duration(5 * time.Second),
+			HealthCheckTimeout: Duration(3 * time.Second),
+		},
+		Database: DatabaseConfig{
+			Host:           "localhost",
+			Port:           5432,
+			User:           "postgres",
+			Name:           "scalabe-coupon-excercise_db",
+			SSLMode:        "disable",
+			ConnectRetries: 10,
+		},
+		Redis: RedisConfig{
+			Addr:           "localhost:6379",
+			ConnectTimeout: Duration(5 * time.Second),
+		},
+		Claims: ClaimsConfig{
+			LockTTL:           Duration(30 * time.Second),
+			LockRetryInterval: Duration(50 * time.Millisecond),
+			BatchSize:         100,
+			BatchTimeout:      Duration(30 * time.Second),
+			AsyncPollTimeout:  Duration(5 * time.Second),
+			AsyncClaimTimeout: Duration(30 * time.Second),
+			TicketTTL:         Duration(24 * time.Hour),
+		},
+		Outbox: OutboxConfig{
+			Sinks:             []string{"webhook", "redis"},
+			LogFile:           "outbox-events.log",
+			RelayInterval:     Duration(500 * time.Millisecond),
+			Retention:         Duration(7 * 24 * time.Hour),
+			RetentionInterval: Duration(time.Hour),
+		},
+		Webhooks: WebhookConfig{
+			DispatchInterval: Duration(time.Second),
+			Timeout:          Duration(10 * time.Second),
+			MaxAttempts:      8,
+			BaseBackoff:      Duration(5 * time.Second),
+			MaxBackoff:       Duration(time.Hour),
+		},
+		Stock: StockConfig{
+			PublishInterval: Duration(250 * time.Millisecond),
+		},
+		Reconcile: ReconcileConfig{
+			Interval: Duration(time.Hour),
+		},
+		Cache: CacheConfig{
+			TTL:                  Duration(30 * time.Second),
+			StaleWhileRevalidate: Duration(30 * time.Second),
+			LocalTTL:             Duration(time.Second),
+		},
+	}
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay can't be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.LockReleaseTimeout > 0, "server.lock_release_timeout must be positive")
+	check(c.Server.HealthCheckTimeout > 0, "server.health_check_timeout must be positive")
+
+	check(c.Database.Host != "", "database.host is required")
+	check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be between 1 and 65535")
+	check(c.Database.User != "", "database.user is required")
+	check(c.Database.Name != "", "database.name is required")
+	check(c.Database.ConnectRetries >= 1, "database.connect_retries must be at least 1")
+
+	check(c.Redis.Addr != "", "redis.addr is required")
+	check(c.Redis.DB >= 0, "redis.db can't be negative")
+	check(c.Redis.ConnectTimeout > 0, "redis.connect_timeout must be positive")
+
+	check(c.Claims.LockTTL > 0, "claims.lock_ttl must be positive")
+	check(c.Claims.LockRetryInterval > 0, "claims.lock_retry_interval must be positive")
+	check(c.Claims.LockRetryInterval < c.Claims.LockTTL, "claims.lock_retry_interval must be shorter than claims.lock_ttl")
+	check(c.Claims.BatchWindow >= 0, "claims.batch_window can't be negative")
+	check(c.Claims.BatchSize >= 1, "claims.batch_size must be at least 1")
+	check(c.Claims.BatchTimeout > 0, "claims.batch_timeout must be positive")
+	check(c.Claims.AsyncWorkers >= 0, "claims.async_workers can't be negative")
+	check(c.Claims.AsyncPollTimeout > 0, "claims.async_poll_timeout must be positive")
+	check(c.Claims.AsyncClaimTimeout > 0, "claims.async_claim_timeout must be positive")
+	check(c.Claims.TicketTTL > 0, "claims.ticket_ttl must be positive")
+
+	for _, sink := range c.Outbox.Sinks {
+		check(sink == "webhook" || sink == "redis" || sink == "log", "outbox.sinks: unknown sink %q", sink)
+	}
+	check(c.Outbox.RelayInterval > 0, "outbox.relay_interval must be positive")
+	check(c.Outbox.Retention >= 0, "outbox.retention can't be negative")
+	check(c.Outbox.RetentionInterval > 0, "outbox.retention_interval must be positive")
+
+	check(c.Webhooks.DispatchInterval > 0, "webhooks.dispatch_interval must be positive")
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout must be positive")
+	check(c.Webhooks.MaxAttempts >= 1, "webhooks.max_attempts must be at least 1")
+	check(c.Webhooks.BaseBackoff > 0, "webhooks.base_backoff must be positive")
+	check(c.Webhooks.MaxBackoff >= c.Webhooks.BaseBackoff, "webhooks.max_backoff can't be below webhooks.base_backoff")
+
+	check(c.Stock.PublishInterval > 0, "stock.publish_interval must be positive")
+
+	check(c.Reconcile.Interval >= 0, "reconcile.interval can't be negative")
+
+	check(c.Cache.TTL >= 0, "cache.ttl can't be negative")
+	check(c.Cache.StaleWhileRevalidate >= 0, "cache.stale_while_revalidate can't be negative")
+	check(c.Cache.LocalTTL >= 0, "cache.local_ttl can't be negative")
+	check(c.Cache.LocalTTL <= c.Cache.TTL, "cache.local_ttl can't be longer than cache.ttl")
+
+	return errors.Join(errs...)
+}
+
+// Duration is a time.Duration written as "250ms", "30s" etc. in files, env vars, flags and the dump
+type Duration time.Duration
+
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
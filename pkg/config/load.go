@@ -0,0 +1,165 @@
+package config
+
+import (
+	"encoding"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const redacted = "[REDACTED]"
+
+// Load builds the configuration from the defaults, the config file, the environment and args, then validates it.
+//
+// The config file is the -config flag, or CONFIG_FILE, and is YAML or TOML going by its extension.
+// Every setting has a flag named after its path in the file, e.g. -claims.lock_ttl=10s, and most an env var
+// (see the env tags). Flag parsing stops at the first argument that isn't a flag, those are returned as rest.
+func Load(args []string) (cfg *Config, rest []string, err error) {
+	cfg = Default()
+
+	fs := flag.NewFlagSet("main", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	// Flags win over everything else, so they're only recorded here and applied last
+	flagValues := map[string]string{}
+	walk(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.StructField, _ reflect.Value) {
+		usage := path
+		if env := field.Tag.Get("env"); env != "" {
+			usage += " (env " + env + ")"
+		}
+		fs.Func(path, usage, func(value string) error {
+			flagValues[path] = value
+			return nil
+		})
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(cfg, *configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var errs []string
+	walk(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		if env == "" {
+			return
+		}
+		if raw, ok := os.LookupEnv(env); ok && raw != "" {
+			if err := setFromString(value, raw); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", env, err))
+			}
+		}
+	})
+	walk(reflect.ValueOf(cfg).Elem(), "", func(path string, _ reflect.StructField, value reflect.Value) {
+		if raw, ok := flagValues[path]; ok {
+			if err := setFromString(value, raw); err != nil {
+				errs = append(errs, fmt.Sprintf("-%s: %v", path, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, fs.Args(), nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalWithOptions(data, cfg, yaml.DisallowUnknownField())
+	case ".toml":
+		decoder := toml.NewDecoder(strings.NewReader(string(data)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	default:
+		return fmt.Errorf("config file %s: extension must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// walk calls fn for every setting of the struct v, path being the dotted file keys (e.g. "claims.lock_ttl")
+func walk(v reflect.Value, prefix string, fn func(path string, field reflect.StructField, value reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		path := prefix + name
+
+		if field.Type.Kind() == reflect.Struct {
+			walk(v.Field(i), path+".", fn)
+			continue
+		}
+		fn(path, field, v.Field(i))
+	}
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// setFromString sets a setting from its env var or flag text, lists are comma separated
+func setFromString(value reflect.Value, raw string) error {
+	if value.Addr().Type().Implements(textUnmarshaler) {
+		return value.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config that's safe to show, secrets replaced by a placeholder
+func (c *Config) Redacted() *Config {
+	clone := *c
+	clone.Outbox.Sinks = append([]string(nil), c.Outbox.Sinks...)
+	walk(reflect.ValueOf(&clone).Elem(), "", func(_ string, field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value.SetString(redacted)
+		}
+	})
+	return &clone
+}
@@ -1,39 +1,32 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
-	"github.com/jotafauzanh/scalabe-coupon-excercise/internal/model"
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
+
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-var DB *gorm.DB
-
-func ConnectDatabase() {
+// ConnectDatabase opens the connection pool, waiting for the database to come up
+func ConnectDatabase(cfg config.DatabaseConfig) *gorm.DB {
+	var db *gorm.DB
 	var err error
 
-	host := os.Getenv("DB_HOST")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	dbname := os.Getenv("DB_NAME")
-	port := os.Getenv("DB_PORT")
-
 	// Setting timezone kept returning error, so i will omit it for now
 	// TODO: Figure out db timezone
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable", host, user, password, dbname, port)
-
-	for i := 1; i <= 10; i++ {
-		DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	for i := 1; i <= cfg.ConnectRetries; i++ {
+		db, err = gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{})
 		if err == nil {
 			log.Println("Database connected")
 			break
 		}
 
-		log.Printf("Database not ready (attempt %d/10): %v", i, err)
+		log.Printf("Database not ready (attempt %d/%d): %v", i, cfg.ConnectRetries, err)
 		time.Sleep(time.Duration(i) * time.Second)
 	}
 
@@ -41,26 +34,51 @@ func ConnectDatabase() {
 		log.Fatal("Database never ready:", err)
 	}
 
-	log.Println("Nuking tables")
-	// Nuke the tables each run, for clean slate, lol
-	err = DB.Migrator().DropTable(&model.User{}, &model.Coupon{}, &model.CouponClaims{})
+	log.Println("Database connection established")
+	return db
+}
+
+// MigrateDatabase brings the schema up to date. With cfg.ResetOnBoot it drops every table first,
+// which wipes all data, so only set that on a dev database.
+func MigrateDatabase(db *gorm.DB, cfg config.DatabaseConfig) {
+	migrator, err := NewMigrator(db)
 	if err != nil {
-		log.Fatal("Failed to nuke tables!", err)
+		log.Fatal("Failed to load migrations: ", err)
+	}
+
+	if cfg.ResetOnBoot {
+		log.Println("Reset on boot is set, resetting database")
+		if err := migrator.Reset(context.Background()); err != nil {
+			log.Fatal("Failed to reset database: ", err)
+		}
+		return
 	}
 
-	log.Println("Migrating database")
-	// Auto-migrate the schema
-	err = DB.AutoMigrate(&model.User{}, &model.Coupon{}, &model.CouponClaims{})
+	applied, err := migrator.Up(context.Background())
 	if err != nil {
-		log.Fatal("Failed to migrate database!", err)
+		log.Fatal("Failed to migrate database: ", err)
 	}
+	for _, m := range applied {
+		log.Printf("Applied migration %d_%s", m.Version, m.Name)
+	}
+}
 
-	// For some reason, User.user_id kept being created with type int8. So, this is a very bad fix for that
-	// Fixed with model edits
-	// DB.Exec(`
-	// 	ALTER TABLE users
-	// 	ALTER COLUMN user_id TYPE TEXT
-	// `)
+func CheckHealth(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database instance: %w", err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database ping failed: %w", err)
+	}
+	return nil
+}
 
-	log.Println("Database connection established")
+// Close closes the connection pool, once nothing uses the database anymore
+func Close(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
 }
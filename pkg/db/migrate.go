@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migrations live in migrations/ as <version>_<name>.up.sql and <version>_<name>.down.sql.
+// Every schema change gets a new pair, applied files are never edited.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Held for the whole migration transaction, so instances booting together apply migrations one at a time
+const migrationLockKey = 7_340_032
+
+// The migration that creates the schema the server used to AutoMigrate. A database from back then has some of
+// those tables, of whatever version it last ran, but no schema_migrations rows (see dropLegacySchema).
+const baselineVersion = 1
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// loadMigrations reads the migrations of fsys ordered by version, each one needs both its up and down file
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, path := range paths {
+		base := strings.TrimPrefix(path, "migrations/")
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction, base = "up", strings.TrimSuffix(base, ".up.sql")
+		case strings.HasSuffix(base, ".down.sql"):
+			direction, base = "down", strings.TrimSuffix(base, ".down.sql")
+		default:
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", path)
+		}
+
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with a positive version", path)
+		}
+
+		sql, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d: %s and %s share a version", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s: needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// locked runs fn in a transaction holding the migration lock, with schema_migrations in place.
+// Postgres DDL is transactional, so a failing migration leaves nothing half applied.
+func (m *Migrator) locked(ctx context.Context, fn func(tx *gorm.DB, applied map[int]time.Time) error) error {
+	return m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+			return err
+		}
+		err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`).Error
+		if err != nil {
+			return err
+		}
+
+		var rows []struct {
+			Version   int
+			AppliedAt time.Time
+		}
+		if err := tx.Raw("SELECT version, applied_at FROM schema_migrations").Scan(&rows).Error; err != nil {
+			return err
+		}
+		applied := make(map[int]time.Time, len(rows))
+		for _, row := range rows {
+			applied[row.Version] = row.AppliedAt
+		}
+
+		return fn(tx, applied)
+	})
+}
+
+// Up applies every pending migration in order and returns the ones it applied
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(tx *gorm.DB, applied map[int]time.Time) error {
+		done = nil
+		if len(applied) == 0 {
+			if err := m.dropLegacySchema(tx); err != nil {
+				return err
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", migration.Version, migration.Name).Error
+			if err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// dropLegacySchema drops the tables left by the AutoMigrate days, so the baseline migration can create them as it
+// defines them. Those tables can miss any column or table added since, and the server dropped them on every
+// start back then anyway, so there's no data worth keeping in them.
+func (m *Migrator) dropLegacySchema(tx *gorm.DB) error {
+	var exists bool
+	if err := tx.Raw("SELECT to_regclass('coupons') IS NOT NULL").Scan(&exists).Error; err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version != baselineVersion {
+			continue
+		}
+		if err := tx.Exec(migration.Down).Error; err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		log.Printf("Found tables from before migrations, dropped them to apply %d_%s from scratch", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns the ones it reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(tx *gorm.DB, applied map[int]time.Time) error {
+		done = nil
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version).Error; err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Reset drops everything the migrations create and applies them all again. It wipes every row, dev only.
+// The down files are run whether or not they're recorded as applied, so it also cleans up a schema
+// that predates the migrations.
+func (m *Migrator) Reset(ctx context.Context) error {
+	err := m.locked(ctx, func(tx *gorm.DB, _ map[int]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if err := tx.Exec(m.migrations[i].Down).Error; err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.migrations[i].Version, m.migrations[i].Name, err)
+			}
+		}
+		return tx.Exec("DELETE FROM schema_migrations").Error
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Up(ctx)
+	return err
+}
+
+// Status lists every known migration and when it was applied (nil while pending)
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.locked(ctx, func(tx *gorm.DB, applied map[int]time.Time) error {
+		statuses = make([]MigrationStatus, len(m.migrations))
+		for i, migration := range m.migrations {
+			statuses[i].Migration = migration
+			if at, ok := applied[migration.Version]; ok {
+				statuses[i].AppliedAt = &at
+			}
+		}
+		return nil
+	})
+	return statuses, err
+}
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS outbox_events;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_subscriptions;
+DROP TABLE IF EXISTS coupon_templates;
+DROP TABLE IF EXISTS coupon_shards;
+DROP TABLE IF EXISTS coupon_draws;
+DROP TABLE IF EXISTS coupon_entries;
+DROP TABLE IF EXISTS coupon_claims;
+DROP TABLE IF EXISTS coupons;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,133 @@
+-- Schema as it was built by gorm AutoMigrate, before migrations existed
+
+CREATE TABLE users (
+    id bigserial PRIMARY KEY,
+    name text,
+    user_id text
+);
+CREATE UNIQUE INDEX idx_users_user_id ON users (user_id);
+
+CREATE TABLE coupons (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    name text,
+    amount bigint,
+    remaining_amount bigint,
+    mode text NOT NULL DEFAULT 'fcfs',
+    shards bigint NOT NULL DEFAULT 1,
+    starts_at timestamptz,
+    expires_at timestamptz,
+    entry_deadline timestamptz,
+    drawn_at timestamptz,
+    discount_type text,
+    discount_value bigint,
+    rules jsonb,
+    archived_at timestamptz,
+    version bigint NOT NULL DEFAULT 1
+);
+-- Only coupons that aren't deleted hold on to their name
+CREATE UNIQUE INDEX idx_coupons_name_live ON coupons (name) WHERE deleted_at IS NULL;
+CREATE INDEX idx_coupons_deleted_at ON coupons (deleted_at);
+
+CREATE TABLE coupon_claims (
+    id bigserial PRIMARY KEY,
+    coupon_id bigint NOT NULL,
+    user_id text NOT NULL,
+    code text NOT NULL,
+    claimed_at timestamptz,
+    CONSTRAINT fk_coupon_claims_coupon FOREIGN KEY (coupon_id) REFERENCES coupons (id),
+    CONSTRAINT fk_coupon_claims_user FOREIGN KEY (user_id) REFERENCES users (user_id)
+);
+CREATE UNIQUE INDEX idx_coupon_claims_code ON coupon_claims (code);
+CREATE INDEX idx_coupon_claims_user ON coupon_claims (user_id);
+CREATE UNIQUE INDEX idx_coupon_user ON coupon_claims (coupon_id, user_id);
+CREATE INDEX idx_coupon_claims_keyset ON coupon_claims (coupon_id, id);
+
+CREATE TABLE coupon_entries (
+    id bigserial PRIMARY KEY,
+    coupon_id bigint NOT NULL,
+    user_id text NOT NULL,
+    status text NOT NULL,
+    created_at timestamptz
+);
+CREATE UNIQUE INDEX idx_entry_coupon_user ON coupon_entries (coupon_id, user_id);
+
+CREATE TABLE coupon_draws (
+    id bigserial PRIMARY KEY,
+    coupon_id bigint NOT NULL,
+    seed bigint,
+    stock bigint,
+    entry_count bigint,
+    winner_count bigint,
+    created_at timestamptz
+);
+CREATE UNIQUE INDEX idx_coupon_draws_coupon_id ON coupon_draws (coupon_id);
+
+CREATE TABLE coupon_shards (
+    id bigserial PRIMARY KEY,
+    coupon_id bigint NOT NULL,
+    shard_index bigint NOT NULL,
+    remaining bigint NOT NULL
+);
+CREATE UNIQUE INDEX idx_coupon_shard ON coupon_shards (coupon_id, shard_index);
+
+CREATE TABLE coupon_templates (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    amount bigint NOT NULL,
+    mode text NOT NULL DEFAULT 'fcfs',
+    shards bigint NOT NULL DEFAULT 1,
+    starts_at timestamptz,
+    expires_at timestamptz,
+    entry_deadline timestamptz,
+    discount_type text,
+    discount_value bigint,
+    rules jsonb,
+    created_at timestamptz
+);
+CREATE UNIQUE INDEX idx_coupon_templates_name ON coupon_templates (name);
+
+CREATE TABLE webhook_subscriptions (
+    id bigserial PRIMARY KEY,
+    url text NOT NULL,
+    event_types text NOT NULL,
+    secret text NOT NULL,
+    active boolean NOT NULL DEFAULT true,
+    created_at timestamptz
+);
+
+CREATE TABLE webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    subscription_id bigint NOT NULL,
+    event_id text NOT NULL,
+    event_type text NOT NULL,
+    payload text NOT NULL,
+    status text NOT NULL,
+    attempts bigint NOT NULL,
+    next_attempt_at timestamptz,
+    last_error text,
+    last_status_code bigint,
+    created_at timestamptz,
+    updated_at timestamptz,
+    CONSTRAINT fk_webhook_deliveries_subscription FOREIGN KEY (subscription_id)
+        REFERENCES webhook_subscriptions (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_delivery_due ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX idx_webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id);
+
+CREATE TABLE outbox_events (
+    id bigserial PRIMARY KEY,
+    event_id text NOT NULL,
+    type text NOT NULL,
+    coupon_name text NOT NULL,
+    payload text NOT NULL,
+    status text NOT NULL,
+    attempts bigint NOT NULL,
+    last_error text,
+    created_at timestamptz,
+    published_at timestamptz
+);
+CREATE INDEX idx_outbox_events_status ON outbox_events (status);
+CREATE UNIQUE INDEX idx_outbox_events_event_id ON outbox_events (event_id);
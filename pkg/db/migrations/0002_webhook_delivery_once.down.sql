@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id);
+DROP INDEX IF EXISTS idx_webhook_deliveries_event;
@@ -0,0 +1,7 @@
+-- One delivery per subscription and event, the outbox relay may publish an event more than once
+DELETE FROM webhook_deliveries a
+    USING webhook_deliveries b
+    WHERE a.subscription_id = b.subscription_id AND a.event_id = b.event_id AND a.id > b.id;
+CREATE UNIQUE INDEX idx_webhook_deliveries_event ON webhook_deliveries (subscription_id, event_id);
+-- Covered by the unique index
+DROP INDEX idx_webhook_deliveries_subscription_id;
@@ -0,0 +1,111 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Params is a keyset page request: up to Limit rows that come after the row with ID After,
+// in whichever direction the list is sorted.
+// Lists sorted by something else than ID also get the sort key of the last row in AfterKey,
+// the ID then only breaks ties.
+type Params struct {
+	Limit    int
+	After    uint
+	AfterKey string
+}
+
+// Parse reads the limit and after query parameters. Empty values fall back to the first page of DefaultLimit.
+func Parse(limit string, after string) (Params, error) {
+	p := Params{Limit: DefaultLimit}
+
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return p, errors.New("limit must be a positive number")
+		}
+		if n > MaxLimit {
+			n = MaxLimit
+		}
+		p.Limit = n
+	}
+
+	if after != "" {
+		key, id, err := DecodeKeyedCursor(after)
+		if err != nil {
+			return p, err
+		}
+		p.After, p.AfterKey = id, key
+	}
+
+	return p, nil
+}
+
+// EncodeCursor turns the last ID of a page into an opaque cursor.
+// It's just the ID, but clients shouldn't depend on that.
+func EncodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+func DecodeCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return uint(id), nil
+}
+
+// EncodeKeyedCursor is EncodeCursor for lists sorted by key first, then by ID
+func EncodeKeyedCursor(key string, id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key + "|" + strconv.FormatUint(uint64(id), 10)))
+}
+
+// DecodeKeyedCursor decodes both kinds of cursors, key is empty for plain ones
+func DecodeKeyedCursor(cursor string) (string, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	s := string(raw)
+	key := ""
+	if i := strings.LastIndex(s, "|"); i >= 0 {
+		key, s = s[:i], s[i+1:]
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	return key, uint(id), nil
+}
+
+// Page trims rows fetched with Limit+1 down to Limit, and returns the cursor of the next page
+// (empty when this is the last one). id returns the keyset ID of a row.
+func Page[T any](rows []T, p Params, id func(T) uint) ([]T, string) {
+	if len(rows) <= p.Limit {
+		return rows, ""
+	}
+	rows = rows[:p.Limit]
+	return rows, EncodeCursor(id(rows[len(rows)-1]))
+}
+
+// KeyedPage is Page for lists sorted by key first, cursor returns the sort key and ID of a row
+func KeyedPage[T any](rows []T, p Params, cursor func(T) (string, uint)) ([]T, string) {
+	if len(rows) <= p.Limit {
+		return rows, ""
+	}
+	rows = rows[:p.Limit]
+	return rows, EncodeKeyedCursor(cursor(rows[len(rows)-1]))
+}
@@ -4,44 +4,34 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
-	"time"
 
 	"github.com/redis/go-redis/v9"
-)
-
-var Client *redis.Client
-
-func ConnectRedis() {
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
-	}
 
-	redisPassword := os.Getenv("REDIS_PASSWORD")
+	"github.com/jotafauzanh/scalabe-coupon-excercise/pkg/config"
+)
 
-	Client = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: redisPassword,
-		DB:       0,
+// ConnectRedis opens the connection pool and makes sure redis answers
+func ConnectRedis(cfg config.RedisConfig) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout.D())
 	defer cancel()
 
-	_, err := Client.Ping(ctx).Result()
+	_, err := client.Ping(ctx).Result()
 	if err != nil {
 		log.Fatal("Failed to connect to Redis!", err)
 	}
 
 	log.Println("Redis connection established")
+	return client
 }
 
-func CheckHealth() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	_, err := Client.Ping(ctx).Result()
+func CheckHealth(ctx context.Context, client *redis.Client) error {
+	_, err := client.Ping(ctx).Result()
 	if err != nil {
 		return fmt.Errorf("redis connection failed: %w", err)
 	}
@@ -0,0 +1,132 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StreamConsumer reads a redis stream as one member of a consumer group.
+// Each message is handed to exactly one consumer of the group, and stays pending until the handler succeeds.
+// Messages left pending by a consumer that died are taken over once they've been idle for MinIdle.
+type StreamConsumer struct {
+	client   *redis.Client
+	stream   string
+	group    string
+	consumer string
+
+	// Messages per read, how long a read blocks, and how long a message stays pending before another consumer takes it
+	Count   int64
+	Block   time.Duration
+	MinIdle time.Duration
+}
+
+func NewStreamConsumer(client *redis.Client, stream string, group string, consumer string) *StreamConsumer {
+	return &StreamConsumer{
+		client:   client,
+		stream:   stream,
+		group:    group,
+		consumer: consumer,
+		Count:    100,
+		Block:    5 * time.Second,
+		MinIdle:  time.Minute,
+	}
+}
+
+// EnsureGroup creates the consumer group (and the stream) if needed.
+// A new group starts at the end of the stream, it only sees messages added afterwards.
+func (c *StreamConsumer) EnsureGroup(ctx context.Context) error {
+	err := c.client.XGroupCreateMkStream(ctx, c.stream, c.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// Consume calls handle for every message until ctx is done. A message is acked when handle returns nil,
+// otherwise it stays pending and is retried after MinIdle. Delivery is at least once.
+func (c *StreamConsumer) Consume(ctx context.Context, handle func(ctx context.Context, msg redis.XMessage) error) error {
+	if err := c.EnsureGroup(ctx); err != nil {
+		return err
+	}
+
+	// Start with our own pending messages (from before a restart), then switch to new ones
+	lastID := "0"
+	for ctx.Err() == nil {
+		block := c.Block
+		if lastID != ">" {
+			// Negative means no BLOCK, pending messages are either there or not
+			block = -1
+		}
+
+		streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.consumer,
+			Streams:  []string{c.stream, lastID},
+			Count:    c.Count,
+			Block:    block,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+
+		var msgs []redis.XMessage
+		if len(streams) > 0 {
+			msgs = streams[0].Messages
+		}
+
+		if lastID != ">" {
+			if len(msgs) == 0 {
+				lastID = ">"
+				continue
+			}
+			lastID = msgs[len(msgs)-1].ID
+		}
+		c.handleAll(ctx, msgs, handle)
+
+		if lastID == ">" {
+			if err := c.reclaimIdle(ctx, handle); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// reclaimIdle takes over messages other consumers (probably dead ones) left pending for longer than MinIdle
+func (c *StreamConsumer) reclaimIdle(ctx context.Context, handle func(ctx context.Context, msg redis.XMessage) error) error {
+	msgs, _, err := c.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   c.stream,
+		Group:    c.group,
+		Consumer: c.consumer,
+		MinIdle:  c.MinIdle,
+		Start:    "0-0",
+		Count:    c.Count,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	c.handleAll(ctx, msgs, handle)
+	return nil
+}
+
+func (c *StreamConsumer) handleAll(ctx context.Context, msgs []redis.XMessage, handle func(ctx context.Context, msg redis.XMessage) error) {
+	for _, msg := range msgs {
+		if err := handle(ctx, msg); err != nil {
+			log.Printf("stream %s: group %s failed to handle %s, will retry: %v", c.stream, c.group, msg.ID, err)
+			continue
+		}
+		if err := c.client.XAck(ctx, c.stream, c.group, msg.ID).Err(); err != nil {
+			log.Printf("stream %s: group %s failed to ack %s: %v", c.stream, c.group, msg.ID, err)
+		}
+	}
+}